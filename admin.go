@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version is overridden at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// requireAdmin guards administrative routes with the ADMIN_TOKEN bearer
+// token. Without a configured token the admin surface does not exist.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.adminToken == "" {
+			notFound(c)
+			c.Abort()
+			return
+		}
+
+		if !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdmin reports whether the request carries the ADMIN_TOKEN bearer token.
+func isAdmin(c *gin.Context) bool {
+	if cfg.adminToken == "" {
+		return false
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
+
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":  version,
+		"features": featureSnapshot(),
+	})
+}
+
+func getAdminConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"features": featureSnapshot()})
+}
+
+func patchAdminConfig(c *gin.Context) {
+	var body struct {
+		Features map[string]bool `json:"features"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid config body"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"features": updateFeatures(body.Features)})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aggregateDimensions and aggregateMetrics are the allow-lists for the
+// aggregate endpoint, mapping public names to SQL expressions.
+var aggregateDimensions = map[string]string{
+	"category":    "category",
+	"name":        "name",
+	"create_date": "to_char(create_date, 'YYYY-MM-DD')",
+	"batch_id":    "COALESCE(batch_id::text, '')",
+}
+
+var aggregateMetrics = map[string]string{
+	"count":     "COUNT(*)::float8",
+	"sum_price": "COALESCE(SUM(price), 0)::float8",
+	"avg_price": "COALESCE(AVG(price), 0)::float8",
+	"min_price": "COALESCE(MIN(price), 0)::float8",
+	"max_price": "COALESCE(MAX(price), 0)::float8",
+}
+
+type aggregateRequest struct {
+	dimensions []string
+	metrics    []string
+	format     string
+	rounding   roundingMode
+}
+
+func parseAggregateRequest(c *gin.Context) (aggregateRequest, error) {
+	req := aggregateRequest{format: c.DefaultQuery("format", formatJSON)}
+
+	if req.format != formatJSON && req.format != "csv" {
+		return req, &filterError{param: "format", message: "must be one of json, csv"}
+	}
+
+	seen := make(map[string]bool)
+	for _, dim := range splitList(c.Query("group_by")) {
+		if _, ok := aggregateDimensions[dim]; !ok {
+			return req, &filterError{param: "group_by", message: fmt.Sprintf("unknown dimension %q", dim)}
+		}
+		if !seen[dim] {
+			seen[dim] = true
+			req.dimensions = append(req.dimensions, dim)
+		}
+	}
+
+	req.metrics = splitList(c.DefaultQuery("metrics", "count"))
+	for _, metric := range req.metrics {
+		if _, ok := aggregateMetrics[metric]; !ok || seen[metric] {
+			return req, &filterError{param: "metrics", message: fmt.Sprintf("unknown or repeated metric %q", metric)}
+		}
+		seen[metric] = true
+	}
+
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		return req, err
+	}
+	req.rounding = rounding
+
+	return req, nil
+}
+
+// aggregateQuery compiles the request into a single GROUP BY query.
+func aggregateQuery(req aggregateRequest, filter *priceFilter) string {
+	var columns, groups []string
+	for i, dim := range req.dimensions {
+		columns = append(columns, aggregateDimensions[dim])
+		groups = append(groups, strconv.Itoa(i+1))
+	}
+	for _, metric := range req.metrics {
+		columns = append(columns, strings.ReplaceAll(aggregateMetrics[metric], "price", priceColumn()))
+	}
+
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM prices WHERE 1=1" + filter.sql()
+	if len(groups) > 0 {
+		query += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	}
+	return query
+}
+
+func getAggregate(c *gin.Context) {
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	req, err := parseAggregateRequest(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	query := aggregateQuery(req, filter)
+
+	if len(req.dimensions) > 0 {
+		var groups int
+		err = withRetry(c.Request.Context(), "aggregate", func() error {
+			return db.QueryRow(context.Background(), "SELECT COUNT(*) FROM ("+query+") g", filter.args...).Scan(&groups)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+			return
+		}
+		if groups > cfg.aggregateMaxGroups {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("grouping produces %d rows, more than the limit of %d", groups, cfg.aggregateMaxGroups)})
+			return
+		}
+	}
+
+	rows, err := queryWithRetry(c.Request.Context(), "aggregate", query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	header := append(append([]string{}, req.dimensions...), req.metrics...)
+	dims := make([]string, len(req.dimensions))
+	metrics := make([]float64, len(req.metrics))
+	dest := make([]interface{}, 0, len(header))
+	for i := range dims {
+		dest = append(dest, &dims[i])
+	}
+	for i := range metrics {
+		dest = append(dest, &metrics[i])
+	}
+
+	formatMetric := func(i int) string {
+		if req.metrics[i] == "count" {
+			return strconv.FormatFloat(metrics[i], 'f', 0, 64)
+		}
+		return formatMoney(metrics[i], req.rounding)
+	}
+
+	// Results are streamed as they are read, the group cap above keeps the
+	// response size bounded.
+	var csvWriter *csv.Writer
+	if req.format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		csvWriter = csv.NewWriter(c.Writer)
+		csvWriter.Write(header)
+	} else {
+		c.Header("Content-Type", "application/json")
+		c.Writer.WriteString("[")
+	}
+
+	first := true
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Aggregate stream aborted: %v", err)
+			return
+		}
+
+		if csvWriter != nil {
+			record := append([]string{}, dims...)
+			for i := range metrics {
+				record = append(record, formatMetric(i))
+			}
+			csvWriter.Write(record)
+			continue
+		}
+
+		obj := make(map[string]interface{}, len(header))
+		for i, dim := range req.dimensions {
+			obj[dim] = dims[i]
+		}
+		for i, metric := range req.metrics {
+			obj[metric] = json.Number(formatMetric(i))
+		}
+		encoded, _ := json.Marshal(obj)
+		if !first {
+			c.Writer.WriteString(",")
+		}
+		c.Writer.Write(encoded)
+		first = false
+	}
+
+	// As in streamJSONExport, a failure midway leaves the response cut
+	// short, without the closing bracket or final flush that would make it
+	// look complete.
+	if err := rows.Err(); err != nil {
+		log.Printf("Aggregate stream aborted: %v", err)
+		return
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+	} else {
+		c.Writer.WriteString("]")
+	}
+}
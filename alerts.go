@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// alertPeriods are the periods an alert total can cover, each from the
+// start of the current one (UTC) by create_date.
+var alertPeriods = []string{"day", "week", "month", "year"}
+
+const (
+	maxAlertThreshold   = 999999999999.99
+	alertEvalTimeout    = 30 * time.Second
+	alertWebhookTimeout = 10 * time.Second
+)
+
+// alert is a budget threshold on the total price of a category per period.
+type alert struct {
+	ID              int64      `json:"id"`
+	Category        string     `json:"category"`
+	Period          string     `json:"period"`
+	Threshold       float64    `json:"threshold"`
+	Target          string     `json:"target"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	LastFiredPeriod *string    `json:"last_fired_period"`
+	LastFiredAt     *time.Time `json:"last_fired_at"`
+	LastTotal       *float64   `json:"last_total"`
+}
+
+const alertColumns = `id, category, period, threshold, target, created_at, updated_at,
+	last_fired_period::text, last_fired_at, last_total`
+
+func scanAlert(row pgx.Row) (alert, error) {
+	var a alert
+	err := row.Scan(&a.ID, &a.Category, &a.Period, &a.Threshold, &a.Target, &a.CreatedAt, &a.UpdatedAt,
+		&a.LastFiredPeriod, &a.LastFiredAt, &a.LastTotal)
+	return a, err
+}
+
+type alertInput struct {
+	Category  string  `json:"category"`
+	Period    string  `json:"period"`
+	Threshold float64 `json:"threshold"`
+	Target    string  `json:"target"`
+}
+
+func (in alertInput) validate() error {
+	switch {
+	case strings.TrimSpace(in.Category) == "" || len(in.Category) > 255:
+		return errors.New("category must be between 1 and 255 bytes")
+	case !slices.Contains(alertPeriods, in.Period):
+		return errors.New("period must be one of " + strings.Join(alertPeriods, ", "))
+	case in.Threshold <= 0 || in.Threshold > maxAlertThreshold:
+		return errors.New("threshold must be positive and fit DECIMAL(14, 2)")
+	}
+	u, err := url.Parse(in.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("target must be an http or https URL")
+	}
+	return nil
+}
+
+func bindAlertInput(c *gin.Context) (alertInput, bool) {
+	var in alertInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return in, false
+	}
+	if err := in.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return in, false
+	}
+	return in, true
+}
+
+func alertID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+func listAlerts(c *gin.Context) {
+	rows, err := db.Query(context.Background(), "SELECT "+alertColumns+" FROM alerts ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	alerts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (alert, error) { return scanAlert(row) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+		return
+	}
+	if alerts == nil {
+		alerts = []alert{}
+	}
+	c.JSON(http.StatusOK, alerts)
+}
+
+func createAlert(c *gin.Context) {
+	in, ok := bindAlertInput(c)
+	if !ok {
+		return
+	}
+	a, err := scanAlert(db.QueryRow(context.Background(),
+		"INSERT INTO alerts (category, period, threshold, target) VALUES ($1, $2, $3, $4) RETURNING "+alertColumns,
+		in.Category, in.Period, in.Threshold, in.Target))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save alert"})
+		return
+	}
+	c.JSON(http.StatusCreated, a)
+}
+
+func getAlert(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	a, err := scanAlert(db.QueryRow(context.Background(), "SELECT "+alertColumns+" FROM alerts WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// updateAlert replaces the alert's settings. The record of the last crossing
+// is cleared, so the new settings are evaluated afresh.
+func updateAlert(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	in, ok := bindAlertInput(c)
+	if !ok {
+		return
+	}
+	a, err := scanAlert(db.QueryRow(context.Background(),
+		`UPDATE alerts SET category = $2, period = $3, threshold = $4, target = $5, updated_at = now(),
+			last_fired_period = NULL, last_fired_at = NULL, last_total = NULL
+		WHERE id = $1 RETURNING `+alertColumns,
+		id, in.Category, in.Period, in.Threshold, in.Target))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save alert"})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func deleteAlert(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	tag, err := db.Exec(context.Background(), "DELETE FROM alerts WHERE id = $1", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete alert"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// alertEvaluations tracks evaluations still running, so shutdown can wait
+// for them before closing the pool.
+var alertEvaluations sync.WaitGroup
+
+// evaluateAlertsAsync checks the alerts of the categories an upload wrote
+// to, after it committed and without holding up its response.
+func evaluateAlertsAsync(batchID string, categories []string) {
+	alertEvaluations.Add(1)
+	go func() {
+		defer alertEvaluations.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), alertEvalTimeout)
+		defer cancel()
+		if err := evaluateAlerts(ctx, batchID, categories); err != nil {
+			log.Printf("Evaluating alerts after upload %s failed: %v", batchID, err)
+			markDegraded(subsystemAlerts, err)
+			return
+		}
+		markRecovered(subsystemAlerts)
+	}()
+}
+
+type alertFiring struct {
+	AlertID     int64     `json:"alert_id"`
+	Category    string    `json:"category"`
+	Period      string    `json:"period"`
+	PeriodStart string    `json:"period_start"`
+	Total       float64   `json:"total"`
+	Threshold   float64   `json:"threshold"`
+	BatchID     string    `json:"batch_id"`
+	FiredAt     time.Time `json:"fired_at"`
+}
+
+// evaluateAlerts runs one aggregate query per category that has alerts and
+// fires every alert whose period total has reached its threshold, unless
+// it already fired for the current period. Recording the crossing is a
+// conditional update, so concurrent uploads fire an alert only once.
+func evaluateAlerts(ctx context.Context, batchID string, categories []string) error {
+	rows, err := db.Query(ctx, "SELECT "+alertColumns+" FROM alerts WHERE category = ANY($1) ORDER BY id", categories)
+	if err != nil {
+		return err
+	}
+	alerts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (alert, error) { return scanAlert(row) })
+	if err != nil {
+		return err
+	}
+
+	byCategory := make(map[string][]alert)
+	for _, a := range alerts {
+		byCategory[a.Category] = append(byCategory[a.Category], a)
+	}
+
+	for category, categoryAlerts := range byCategory {
+		totals, starts, err := periodTotals(ctx, category)
+		if err != nil {
+			return err
+		}
+		for _, a := range categoryAlerts {
+			total, start := totals[a.Period], starts[a.Period]
+			if total < a.Threshold || (a.LastFiredPeriod != nil && *a.LastFiredPeriod == start) {
+				continue
+			}
+			var firedAt time.Time
+			err := db.QueryRow(ctx,
+				`UPDATE alerts SET last_fired_period = $2, last_fired_at = now(), last_total = $3
+				WHERE id = $1 AND last_fired_period IS DISTINCT FROM $2::date RETURNING last_fired_at`,
+				a.ID, start, total).Scan(&firedAt)
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			notifyAlert(a.Target, alertFiring{
+				AlertID: a.ID, Category: category, Period: a.Period, PeriodStart: start,
+				Total: total, Threshold: a.Threshold, BatchID: batchID, FiredAt: firedAt,
+			})
+		}
+	}
+	return nil
+}
+
+// periodTotals sums the category's prices for the current period of every
+// alert period in a single scan, with the start date of each period.
+func periodTotals(ctx context.Context, category string) (map[string]float64, map[string]string, error) {
+	columns := make([]string, 0, 2*len(alertPeriods))
+	for _, period := range alertPeriods {
+		start := fmt.Sprintf("date_trunc('%s', localtimestamp)", period)
+		columns = append(columns,
+			fmt.Sprintf("COALESCE(SUM(%s) FILTER (WHERE create_date >= %s AND create_date < %s + interval '1 %s'), 0)::float8",
+				priceColumn(), start, start, period),
+			start+"::date::text")
+	}
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM prices WHERE category = $1" +
+		" AND create_date >= LEAST(date_trunc('week', localtimestamp), date_trunc('year', localtimestamp))"
+
+	totals := make([]float64, len(alertPeriods))
+	starts := make([]string, len(alertPeriods))
+	dest := make([]interface{}, 0, 2*len(alertPeriods))
+	for i := range alertPeriods {
+		dest = append(dest, &totals[i], &starts[i])
+	}
+	if err := db.QueryRow(ctx, query, category).Scan(dest...); err != nil {
+		return nil, nil, err
+	}
+
+	totalByPeriod := make(map[string]float64, len(alertPeriods))
+	startByPeriod := make(map[string]string, len(alertPeriods))
+	for i, period := range alertPeriods {
+		totalByPeriod[period] = totals[i]
+		startByPeriod[period] = starts[i]
+	}
+	return totalByPeriod, startByPeriod, nil
+}
+
+var alertClient = &http.Client{Timeout: alertWebhookTimeout}
+
+// notifyAlert posts the firing to the alert's target. Delivery is best
+// effort: the crossing is already recorded and is not retried.
+func notifyAlert(target string, firing alertFiring) {
+	body, _ := json.Marshal(firing)
+	if err := postWebhook(subsystemAlertWebhook, target, body); err != nil {
+		log.Printf("Alert %d webhook failed: %v", firing.AlertID, err)
+	}
+}
+
+// postWebhook posts body to target and records the outcome under
+// subsystem; a response other than 2xx counts as a failure.
+func postWebhook(subsystem, target string, body []byte) error {
+	resp, err := alertClient.Post(target, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		markDegraded(subsystem, err)
+		return err
+	}
+	markRecovered(subsystem)
+	return nil
+}
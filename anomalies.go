@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAnomaliesLimit = 100
+	maxAnomaliesLimit     = 1000
+)
+
+// maxStoredPrice is the largest value DECIMAL(10, 2) holds; rows at it were
+// most likely clamped or typed in as a placeholder.
+const maxStoredPrice = 99999999.99
+
+// blankChars are trimmed before a name or category counts as blank: ASCII
+// whitespace, the no-break space, and the zero-width space and BOM, which
+// strings.TrimSpace in the upload validation does not treat as space.
+const blankChars = " \t\r\n\u00a0\u200b\ufeff"
+
+// anomalyRule is a check for rows that today's validation would reject or
+// that look like bad data. predicate returns an SQL condition and may
+// register arguments on f.
+type anomalyRule struct {
+	name      string
+	predicate func(f *priceFilter) string
+}
+
+var anomalyRules = []anomalyRule{
+	{"price_at_max", func(f *priceFilter) string {
+		return priceColumn() + " >= " + f.arg(maxStoredPrice) + "::numeric"
+	}},
+	{"below_min_price", func(f *priceFilter) string {
+		return priceColumn() + " < " + f.arg(cfg.minPrice) + "::numeric"
+	}},
+	{"blank_name", func(f *priceFilter) string {
+		return "btrim(name, " + f.arg(blankChars) + ") = ''"
+	}},
+	{"blank_category", func(f *priceFilter) string {
+		return "btrim(category, " + f.arg(blankChars) + ") = ''"
+	}},
+	{"field_too_long", func(f *priceFilter) string {
+		limit := f.arg(cfg.maxFieldSize)
+		return fmt.Sprintf("(octet_length(name) > %s OR octet_length(category) > %s)", limit, limit)
+	}},
+	{"future_date", func(f *priceFilter) string {
+		return "create_date >= current_date + " + f.arg(cfg.anomalyFutureDays+1) + "::int"
+	}},
+	{"invalid_validity", func(f *priceFilter) string {
+		return "valid_to < valid_from"
+	}},
+}
+
+type anomaly struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Category   string   `json:"category"`
+	Price      float64  `json:"price"`
+	CreateDate string   `json:"create_date"`
+	BatchID    *string  `json:"batch_id"`
+	Rules      []string `json:"rules"`
+}
+
+// parseAnomalyRules returns the rules named in ?rules=, all of them by
+// default, in their declared order.
+func parseAnomalyRules(raw string) ([]anomalyRule, error) {
+	names := splitList(raw)
+	if names == nil {
+		return anomalyRules, nil
+	}
+	var rules []anomalyRule
+	for _, name := range names {
+		i := slices.IndexFunc(anomalyRules, func(r anomalyRule) bool { return r.name == name })
+		if i < 0 {
+			known := make([]string, len(anomalyRules))
+			for j, r := range anomalyRules {
+				known[j] = r.name
+			}
+			return nil, &filterError{param: "rules", message: "must be a list of " + strings.Join(known, ", ")}
+		}
+		if !slices.ContainsFunc(rules, func(r anomalyRule) bool { return r.name == name }) {
+			rules = append(rules, anomalyRules[i])
+		}
+	}
+	return rules, nil
+}
+
+// getPriceAnomalies lists stored rows that break at least one of the
+// requested rules, in id order, with every rule each row breaks. It is a
+// read-only diagnostic for data loaded before validation was tightened;
+// ?after= takes the next_after of the previous page.
+func getPriceAnomalies(c *gin.Context) {
+	rules, err := parseAnomalyRules(c.Query("rules"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	limit := defaultAnomaliesLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAnomaliesLimit {
+			respondFilterError(c, &filterError{param: "limit", message: fmt.Sprintf("must be an integer between 1 and %d", maxAnomaliesLimit)})
+			return
+		}
+		limit = n
+	}
+	after, err := strconv.Atoi(c.DefaultQuery("after", "0"))
+	if err != nil || after < 0 {
+		respondFilterError(c, &filterError{param: "after", message: "must be a non-negative integer"})
+		return
+	}
+
+	filter := &priceFilter{}
+	labels := make([]string, len(rules))
+	conditions := make([]string, len(rules))
+	for i, rule := range rules {
+		conditions[i] = rule.predicate(filter)
+		labels[i] = fmt.Sprintf("CASE WHEN %s THEN '%s' END", conditions[i], rule.name)
+	}
+	if allowed := readCategories(c); allowed != nil {
+		filter.add("category = ANY(%s)", allowed)
+	}
+	query := "SELECT id, name, category, " + priceColumn() + ", create_date, batch_id::text, " +
+		"array_remove(ARRAY[" + strings.Join(labels, ", ") + "], NULL) FROM prices " +
+		"WHERE id > " + filter.arg(after) + " AND (" + strings.Join(conditions, " OR ") + ")" +
+		filter.sql() + " ORDER BY id LIMIT " + filter.arg(limit)
+	logQuery("anomalies", query, filter.args)
+
+	rows, err := queryWithRetry(c.Request.Context(), "anomalies", query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	anomalies := []anomaly{}
+	for rows.Next() {
+		var a anomaly
+		var createDate time.Time
+		if err := rows.Scan(&a.ID, &a.Name, &a.Category, &a.Price, &createDate, &a.BatchID, &a.Rules); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		a.CreateDate = createDate.Format("2006-01-02")
+		anomalies = append(anomalies, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	var next *int
+	if len(anomalies) == limit {
+		next = &anomalies[len(anomalies)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"anomalies": anomalies, "next_after": next})
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+	// archiveTgz is accepted for ?type= as another name of tar.gz.
+	archiveTgz = "tgz"
+	// archiveCSV is a single CSV file uploaded as is, without an archive.
+	archiveCSV = "csv"
+)
+
+// maxArchiveDepth is how deep ?recurse=true follows archives nested in the
+// upload; the upload itself is depth 0.
+const maxArchiveDepth = 1
+
+var errArchiveLimit = errors.New("archive exceeds extraction limits")
+
+// errEmptyCSV is a type=csv upload without a single byte, which would
+// otherwise be stored as an upload of nothing.
+var errEmptyCSV = errors.New("uploaded csv file is empty")
+
+// errCorruptGzip is a tar.gz whose gzip stream cannot be decompressed: a bad
+// header, a truncated stream or a checksum mismatch.
+var errCorruptGzip = errors.New("archive is not a valid gzip stream")
+
+// errCorruptArchive is a zip or tar whose directory or headers cannot be
+// read: a truncated file, or one that is not an archive of the declared
+// type at all.
+var errCorruptArchive = errors.New("archive cannot be read")
+
+// gzipErrorReader marks the errors of a gzip reader as errCorruptGzip, so
+// they are told apart from failures to spool the decompressed tar.
+type gzipErrorReader struct {
+	r io.Reader
+}
+
+func (g gzipErrorReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errCorruptGzip, err)
+	}
+	return n, err
+}
+
+// csvEntryError reports a CSV entry that could not be parsed.
+type csvEntryError struct {
+	name string
+	err  error
+}
+
+func (e *csvEntryError) Error() string {
+	return fmt.Sprintf("unable to read csv file %s: %v", e.name, e.err)
+}
+
+func (e *csvEntryError) Unwrap() error {
+	return e.err
+}
+
+// csvEntryFunc is called for every CSV entry of an uploaded archive with a
+// reader positioned at the start of its content.
+type csvEntryFunc func(name string, r io.Reader) error
+
+// Reasons an archive entry is skipped without being parsed.
+const (
+	skipMacOSMetadata = "macos_metadata"
+	skipHiddenFile    = "hidden_file"
+	skipNotCSV        = "not_csv"
+	skipEmptyFile     = "empty_file"
+	skipNestedArchive = "nested_archive"
+	// skipSupersededDuplicate is an entry stored again under the same name
+	// later in the archive.
+	skipSupersededDuplicate = "superseded_duplicate_entry"
+)
+
+// skippedFile is reported in the upload response for every archive entry
+// that was not parsed; directories are left out.
+type skippedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// splitEntryPath splits an entry path into its parts. Windows tools may
+// write zip paths with backslashes, so both separators are accepted.
+func splitEntryPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+}
+
+// csvEntrySkipReason returns why an archive entry should not be parsed as
+// CSV, or "" if it should. name is the full resolved path (PAX and GNU long
+// names included).
+func csvEntrySkipReason(name string, size int64) string {
+	parts := splitEntryPath(name)
+	if len(parts) == 0 {
+		return skipNotCSV
+	}
+	for _, part := range parts[:len(parts)-1] {
+		if part == "__MACOSX" {
+			return skipMacOSMetadata
+		}
+	}
+
+	base := parts[len(parts)-1]
+	switch {
+	case strings.HasPrefix(base, "._"):
+		return skipMacOSMetadata
+	case strings.HasPrefix(base, "."):
+		return skipHiddenFile
+	case nestedArchiveType(base) != "":
+		return skipNestedArchive
+	case !strings.HasSuffix(strings.ToLower(base), ".csv"):
+		return skipNotCSV
+	case size == 0:
+		return skipEmptyFile
+	}
+	return ""
+}
+
+// nestedArchiveType recognizes archive entries by extension.
+func nestedArchiveType(base string) string {
+	lower := strings.ToLower(base)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	}
+	return ""
+}
+
+// archiveMember is a regular file of an archive, collected so that members
+// can be processed in the order asked for rather than the stored one.
+type archiveMember struct {
+	name       string
+	modTime    time.Time
+	size       int64
+	compressed int64
+	open       func() (io.ReadCloser, error)
+}
+
+// supersedeDuplicates keeps only the last member stored under each name,
+// the one extracting the archive with unzip or tar would leave on disk, and
+// reports the earlier ones as skipped. members must be in archive order.
+func (w *archiveWalker) supersedeDuplicates(members []archiveMember) []archiveMember {
+	last := make(map[string]int, len(members))
+	for i, m := range members {
+		last[m.name] = i
+	}
+	if len(last) == len(members) {
+		return members
+	}
+	kept := members[:0]
+	for i, m := range members {
+		if last[m.name] != i {
+			w.skipped = append(w.skipped, skippedFile{Name: m.name, Reason: skipSupersededDuplicate})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// sortMembers orders members by ?order=. Members with the same modification
+// time, or the same name, keep their order by name and then by position.
+func sortMembers(members []archiveMember, order string) {
+	slices.SortStableFunc(members, func(a, b archiveMember) int {
+		switch order {
+		case orderModTime:
+			if c := a.modTime.Compare(b.modTime); c != 0 {
+				return c
+			}
+		case orderModTimeDesc:
+			if c := b.modTime.Compare(a.modTime); c != 0 {
+				return c
+			}
+		}
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// archiveWalker streams the CSV entries of an upload to fn. The file count,
+// total uncompressed size and compression ratio limits apply to all nesting
+// levels combined.
+type archiveWalker struct {
+	password string
+	recurse  bool
+	order    string
+	fn       csvEntryFunc
+	skipped  []skippedFile
+
+	files        int
+	uncompressed int64
+}
+
+// walkCSVEntries streams each CSV entry of the archive to fn in the order of
+// opts.order. Entries are never read into memory as a whole. Sorting needs
+// the whole member list before the first entry is read, so both zip and tar
+// are read from a spooled file; for tar.gz that is the decompressed tar.
+// Entries that are not parsed are returned with the reason. With
+// type=csv the upload is the only entry, named filename.
+func walkCSVEntries(archive io.Reader, filename string, opts uploadOptions, fn csvEntryFunc) ([]skippedFile, error) {
+	w := &archiveWalker{password: opts.password, recurse: opts.recurse, order: opts.order, fn: fn, skipped: []skippedFile{}}
+	if opts.archiveType == archiveCSV {
+		return w.skipped, walkPlainCSV(archive, filename, fn)
+	}
+	err := w.walk(archive, opts.archiveType, "", 0)
+	return w.skipped, err
+}
+
+// walkPlainCSV hands a type=csv upload to fn as it is: there is no entry
+// to skip, so neither its name nor the extraction limits are checked.
+func walkPlainCSV(r io.Reader, filename string, fn csvEntryFunc) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return errEmptyCSV
+	}
+	if filename == "" {
+		filename = "upload." + archiveCSV
+	}
+	return fn(filename, br)
+}
+
+func (w *archiveWalker) walk(r io.Reader, archiveType, prefix string, depth int) error {
+	if archiveType == archiveTarGz {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCorruptGzip, err)
+		}
+		defer gz.Close()
+		// The decompressed tar is spooled, so cap it before it reaches
+		// the disk rather than when its entries are read.
+		limit := int64(cfg.maxUncompressedSize)
+		archive, err := spoolUpload(io.LimitReader(gzipErrorReader{gz}, limit+1))
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		if archive.size > limit {
+			return fmt.Errorf("%w: more than %d bytes uncompressed", errArchiveLimit, cfg.maxUncompressedSize)
+		}
+		return w.walkTar(archive, prefix, depth)
+	}
+
+	archive, ok := r.(*spooledUpload)
+	if !ok {
+		spooled, err := spoolUpload(r)
+		if err != nil {
+			return err
+		}
+		defer spooled.Close()
+		archive = spooled
+	}
+	if archiveType == archiveTar {
+		return w.walkTar(archive, prefix, depth)
+	}
+
+	zipReader, err := zip.NewReader(archive, archive.size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCorruptArchive, err)
+	}
+
+	decrypter := &zipDecrypter{archive: archive, password: w.password}
+	var members []archiveMember
+	for i, file := range zipReader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		open := file.Open
+		if file.Flags&0x1 != 0 {
+			open = func() (io.ReadCloser, error) { return decrypter.open(i, file) }
+		}
+		members = append(members, archiveMember{
+			name:       prefix + file.Name,
+			modTime:    file.Modified,
+			size:       int64(file.UncompressedSize64),
+			compressed: int64(file.CompressedSize64),
+			open:       open,
+		})
+	}
+
+	members = w.supersedeDuplicates(members)
+	sortMembers(members, w.order)
+	for _, m := range members {
+		if err := w.entry(m.name, m.size, m.compressed, depth, m.open); err != nil {
+			return passwordError(err)
+		}
+	}
+	return nil
+}
+
+// walkTar lists the regular files of a spooled tar with the offsets of
+// their content, then reads them in the requested order.
+func (w *archiveWalker) walkTar(archive *spooledUpload, prefix string, depth int) error {
+	section := io.NewSectionReader(archive, 0, archive.size)
+	tarReader := tar.NewReader(section)
+	var members []archiveMember
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCorruptArchive, err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Next leaves the reader at the start of the entry's content.
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		size := header.Size
+		members = append(members, archiveMember{
+			name:    prefix + header.Name,
+			modTime: header.ModTime,
+			size:    size,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(archive, offset, size)), nil
+			},
+		})
+	}
+
+	members = w.supersedeDuplicates(members)
+	sortMembers(members, w.order)
+	for _, m := range members {
+		if err := w.entry(m.name, m.size, m.compressed, depth, m.open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry handles a single archive member: nested archives are walked when
+// recursion allows it, CSV files are passed to fn and the rest is skipped.
+// compressed is the stored size used for the ratio guard, 0 if unknown.
+func (w *archiveWalker) entry(name string, size, compressed int64, depth int, open func() (io.ReadCloser, error)) error {
+	reason := csvEntrySkipReason(name, size)
+	if reason == skipNestedArchive && w.recurse && depth < maxArchiveDepth {
+		reason = ""
+	}
+	if reason != "" {
+		w.skipped = append(w.skipped, skippedFile{Name: name, Reason: reason})
+		return nil
+	}
+
+	w.files++
+	if w.files > cfg.maxArchiveFiles {
+		return fmt.Errorf("%w: more than %d files", errArchiveLimit, cfg.maxArchiveFiles)
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r := &limitedEntryReader{w: w, r: rc, remaining: -1}
+	if compressed > 0 {
+		r.remaining = compressed * int64(cfg.maxCompressionRatio)
+	}
+
+	parts := splitEntryPath(name)
+	archiveType := nestedArchiveType(parts[len(parts)-1])
+	if archiveType == "" {
+		return w.fn(name, r)
+	}
+
+	return w.walk(r, archiveType, name+"!", depth+1)
+}
+
+// limitedEntryReader enforces the total uncompressed size and, for entries
+// with a known compressed size, the compression ratio while they are read,
+// since declared sizes cannot be trusted.
+type limitedEntryReader struct {
+	w         *archiveWalker
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedEntryReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.w.uncompressed += int64(n)
+	if l.w.uncompressed > int64(cfg.maxUncompressedSize) {
+		return n, fmt.Errorf("%w: more than %d bytes uncompressed", errArchiveLimit, cfg.maxUncompressedSize)
+	}
+	if l.remaining >= 0 {
+		l.remaining -= int64(n)
+		if l.remaining < 0 {
+			return n, fmt.Errorf("%w: compression ratio above %d", errArchiveLimit, cfg.maxCompressionRatio)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	uploadAttemptContextKey = "uploadAttempt"
+
+	// attemptInterrupted is the failure_reason of an upload whose process
+	// died before it finished.
+	attemptInterrupted = "interrupted"
+
+	// missedHeartbeats is how many heartbeats an upload may miss before
+	// another instance takes it for interrupted.
+	missedHeartbeats = 3
+)
+
+// inflightUploads are the batch ids of this instance's upload attempts,
+// whose heartbeat it keeps fresh.
+var inflightUploads = struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// beginUploadAttempt records that the upload is being processed, before any
+// of it is parsed, under the batch id its rows will get. tempPath is the
+// spooled archive, if any. If the row cannot be written the upload goes on
+// untracked.
+func beginUploadAttempt(c *gin.Context, filename, tempPath string, opts uploadOptions) {
+	batchID := newUUID()
+	var path interface{}
+	if tempPath != "" {
+		path = tempPath
+	}
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO upload_attempts (batch_id, filename, archive_type, metadata, instance, temp_path) VALUES ($1, $2, $3, $4, $5, $6)",
+		batchID, filename, opts.archiveType, opts.metadata, dbApplicationName(), path)
+	if err != nil {
+		log.Printf("Failed to record upload attempt: %v", err)
+		return
+	}
+	inflightUploads.mu.Lock()
+	inflightUploads.ids[batchID] = true
+	inflightUploads.mu.Unlock()
+	c.Set(uploadAttemptContextKey, batchID)
+}
+
+// finishUploadAttempt forgets the attempt once the client has its answer.
+// A committed upload has already deleted its row, so this only clears
+// attempts that were rejected or rolled back.
+func finishUploadAttempt(c *gin.Context) {
+	v, ok := c.Get(uploadAttemptContextKey)
+	if !ok {
+		return
+	}
+	batchID := v.(string)
+	inflightUploads.mu.Lock()
+	delete(inflightUploads.ids, batchID)
+	inflightUploads.mu.Unlock()
+	if _, err := db.Exec(context.Background(), "DELETE FROM upload_attempts WHERE batch_id = $1", batchID); err != nil {
+		log.Printf("Failed to clear upload attempt %s: %v", batchID, err)
+	}
+}
+
+// uploadBatchID is the batch id of the request's upload attempt, or a fresh
+// one for an untracked upload.
+func uploadBatchID(c *gin.Context) string {
+	if v, ok := c.Get(uploadAttemptContextKey); ok {
+		return v.(string)
+	}
+	return newUUID()
+}
+
+// recoverInterruptedUploads marks attempts whose process is gone as failed:
+// those that missed their heartbeats and, at startup, those of this
+// instance's previous run. Their archives are removed and any session of
+// the dead process still holding advisory locks is terminated.
+func recoverInterruptedUploads(ctx context.Context, startup bool) {
+	rows, err := db.Query(ctx, `
+		UPDATE upload_attempts SET status = 'failed', failure_reason = $1, finished_at = now()
+		WHERE status = 'processing'
+			AND (heartbeat_at < now() - make_interval(secs => $2) OR ($3 AND instance = $4))
+		RETURNING batch_id::text, instance, heartbeat_at, COALESCE(temp_path, '')`,
+		attemptInterrupted, (missedHeartbeats * cfg.uploadHeartbeat).Seconds(), startup, dbApplicationName())
+	if err != nil {
+		log.Printf("Recovering interrupted uploads failed: %v", err)
+		return
+	}
+	type interrupted struct {
+		batchID, instance, tempPath string
+		heartbeatAt                 time.Time
+	}
+	var found []interrupted
+	for rows.Next() {
+		var a interrupted
+		if err := rows.Scan(&a.batchID, &a.instance, &a.heartbeatAt, &a.tempPath); err != nil {
+			rows.Close()
+			log.Printf("Recovering interrupted uploads failed: %v", err)
+			return
+		}
+		found = append(found, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Recovering interrupted uploads failed: %v", err)
+		return
+	}
+
+	for _, a := range found {
+		// Only sessions the dead process opened before its last heartbeat
+		// are its own; a restarted instance reuses the application name.
+		var terminated int
+		err := db.QueryRow(ctx, `
+			SELECT COUNT(*) FILTER (WHERE pg_terminate_backend(pid)) FROM pg_stat_activity
+			WHERE application_name = $1 AND backend_start <= $2 AND pid <> pg_backend_pid()
+				AND pid IN (SELECT pid FROM pg_locks WHERE locktype = 'advisory')`,
+			a.instance, a.heartbeatAt).Scan(&terminated)
+		if err != nil {
+			log.Printf("Releasing the locks of upload %s failed: %v", a.batchID, err)
+		}
+		if a.tempPath != "" {
+			if err := os.Remove(a.tempPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Removing the archive of upload %s failed: %v", a.batchID, err)
+			}
+		}
+		log.Printf("Upload %s on %s was interrupted; marked failed, %d sessions terminated", a.batchID, a.instance, terminated)
+	}
+}
+
+// watchUploadAttempts keeps the heartbeat of this instance's uploads fresh
+// and recovers those of instances that stopped. It runs until ctx is
+// cancelled.
+func watchUploadAttempts(ctx context.Context) {
+	if cfg.uploadHeartbeat <= 0 || dbReadOnly.Load() {
+		return
+	}
+	ticker := time.NewTicker(cfg.uploadHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		inflightUploads.mu.Lock()
+		ids := make([]string, 0, len(inflightUploads.ids))
+		for id := range inflightUploads.ids {
+			ids = append(ids, id)
+		}
+		inflightUploads.mu.Unlock()
+		if len(ids) > 0 {
+			_, err := db.Exec(ctx, "UPDATE upload_attempts SET heartbeat_at = now() WHERE batch_id = ANY($1::uuid[])", ids)
+			if err != nil {
+				log.Printf("Upload heartbeat failed: %v", err)
+			}
+		}
+		recoverInterruptedUploads(ctx, false)
+	}
+}
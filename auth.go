@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKey is a client credential from API_KEYS. A nil categories list means
+// the key may read and write every category.
+type apiKey struct {
+	key        string
+	categories []string
+}
+
+const apiKeyContextKey = "apiKey"
+
+// parseAPIKeys reads API_KEYS entries of the form "key" or
+// "key=category1|category2".
+func parseAPIKeys(entries []string) []apiKey {
+	keys := make([]apiKey, 0, len(entries))
+	for _, entry := range entries {
+		key, cats, restricted := strings.Cut(entry, "=")
+		k := apiKey{key: strings.TrimSpace(key)}
+		if restricted {
+			k.categories = []string{}
+			for _, cat := range strings.Split(cats, "|") {
+				if cat = strings.TrimSpace(cat); cat != "" {
+					k.categories = append(k.categories, cat)
+				}
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// authenticate requires a valid X-API-Key header once API_KEYS is set.
+// Without configured keys the API stays open, as before.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(cfg.apiKeys) == 0 {
+			c.Next()
+			return
+		}
+
+		presented := c.GetHeader("X-API-Key")
+		for _, k := range cfg.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(k.key)) == 1 {
+				c.Set(apiKeyContextKey, k)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing API key"})
+	}
+}
+
+// allowedCategories returns the caller's category restriction, or nil when
+// the caller may access every category.
+func allowedCategories(c *gin.Context) []string {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(apiKey).categories
+	}
+	return nil
+}
+
+// readCategories is the category restriction of a read: the key's, unless
+// an admin lifted it with ?all=true. Every read builds its SQL from it, so
+// forbidden categories reach neither rows nor counts and totals.
+func readCategories(c *gin.Context) []string {
+	if c.GetBool(allCategoriesContextKey) {
+		return nil
+	}
+	return allowedCategories(c)
+}
+
+const allCategoriesContextKey = "allCategories"
+
+// readAllCategories handles ?all=true on reads, which lets the admin token
+// read every category with a restricted key. Without the admin token it is
+// refused rather than ignored, so a client never mistakes a restricted
+// answer for a complete one. Writes keep the key's restriction.
+func readAllCategories() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		// c.Query would cache the query before applyPreset rewrites it on
+		// the route, hiding the preset's parameters from the handler.
+		all, err := parseBoolValue("all", c.Request.URL.Query().Get("all"))
+		if err != nil {
+			respondFilterError(c, err)
+			c.Abort()
+			return
+		}
+		if all {
+			if !isAdmin(c) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "all=true requires the admin token"})
+				return
+			}
+			c.Set(allCategoriesContextKey, true)
+		}
+		c.Next()
+	}
+}
+
+// keyOwner identifies the caller for per-key data such as filter presets
+// without storing the key itself. Without API keys everything is shared.
+func keyOwner(c *gin.Context) string {
+	v, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v.(apiKey).key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkWriteCategories returns an error naming the first category the
+// caller is not allowed to write.
+func checkWriteCategories(c *gin.Context, records []priceRecord) error {
+	allowed := allowedCategories(c)
+	if allowed == nil {
+		return nil
+	}
+	for _, rec := range records {
+		if !slices.Contains(allowed, rec.category) {
+			return fmt.Errorf("category %q is not allowed for this API key", rec.category)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// backupTables are copied in this order by backup and restore. Their
+// columns are read from the catalog, so columns added by later migrations
+// are included without touching this file.
+var backupTables = []string{"uploads", "prices"}
+
+const backupManifestName = "manifest.json"
+
+type backupManifest struct {
+	SchemaVersion int                    `json:"schema_version"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Tables        map[string]backupTable `json:"tables"`
+}
+
+type backupTable struct {
+	File    string   `json:"file"`
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+}
+
+// tableColumns returns the columns of table in their physical order.
+func tableColumns(ctx context.Context, tx pgx.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position`, table)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func schemaVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// copyStatement builds COPY for table in PostgreSQL's CSV format, which
+// keeps NULL (an unquoted empty field) apart from the empty string.
+func copyStatement(table string, columns []string, direction string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return fmt.Sprintf("COPY %s (%s) %s WITH (FORMAT csv, HEADER)",
+		pgx.Identifier{table}.Sanitize(), strings.Join(quoted, ", "), direction)
+}
+
+// getBackup streams a zip with one CSV per table and a manifest, all read
+// from a single snapshot.
+func getBackup(c *gin.Context) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	manifest := backupManifest{CreatedAt: time.Now().UTC(), Tables: make(map[string]backupTable)}
+	if manifest.SchemaVersion, err = schemaVersion(ctx, tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	for _, table := range backupTables {
+		columns, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+			return
+		}
+		manifest.Tables[table] = backupTable{File: table + ".csv", Columns: columns}
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=backup-%s.zip", manifest.CreatedAt.Format("20060102-150405")))
+	zipWriter := zip.NewWriter(c.Writer)
+
+	// Headers are sent with the first byte, so failures from here on can
+	// only cut the archive short.
+	for _, table := range backupTables {
+		entry := manifest.Tables[table]
+		w, err := zipWriter.Create(entry.File)
+		if err != nil {
+			log.Printf("Backup aborted: %v", err)
+			return
+		}
+		tag, err := tx.Conn().PgConn().CopyTo(ctx, w, copyStatement(table, entry.Columns, "TO STDOUT"))
+		if err != nil {
+			log.Printf("Backup aborted: %v", err)
+			return
+		}
+		entry.Rows = tag.RowsAffected()
+		manifest.Tables[table] = entry
+	}
+
+	w, err := zipWriter.Create(backupManifestName)
+	if err == nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if err != nil {
+		log.Printf("Backup aborted: %v", err)
+	}
+}
+
+var errNonEmptyRestore = errors.New("tables are not empty; pass truncate=true to replace their contents")
+
+// postRestore loads a backup made by getBackup. The manifest must match the
+// current schema version and columns; with truncate=true existing rows are
+// replaced, otherwise the tables must be empty. Everything runs in one
+// transaction, so a failed restore leaves the data as it was.
+func postRestore(c *gin.Context) {
+	truncate, err := parseBoolParam(c, "truncate")
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	archive, status, err := readRestoreArchive(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	defer archive.Close()
+
+	zr, err := zip.NewReader(archive, archive.size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "backup is not a zip archive"})
+		return
+	}
+	manifest, err := readBackupManifest(zr)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkBackupSchema(ctx, tx, manifest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := lockChangeFeed(ctx, tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	if truncate {
+		if _, err := tx.Exec(ctx, "TRUNCATE prices, uploads"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to truncate tables"})
+			return
+		}
+	} else {
+		var nonEmpty bool
+		err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM prices) OR EXISTS(SELECT 1 FROM uploads)").Scan(&nonEmpty)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+			return
+		}
+		if nonEmpty {
+			c.JSON(http.StatusConflict, gin.H{"error": errNonEmptyRestore.Error()})
+			return
+		}
+	}
+
+	restored := make(map[string]int64)
+	for _, table := range backupTables {
+		entry := manifest.Tables[table]
+		f, err := zr.Open(entry.File)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("backup has no %s", entry.File)})
+			return
+		}
+		tag, err := tx.Conn().PgConn().CopyFrom(ctx, f, copyStatement(table, entry.Columns, "FROM STDIN"))
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("failed to load %s: %v", entry.File, err)})
+			return
+		}
+		if tag.RowsAffected() != entry.Rows {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("%s has %d rows, the manifest lists %d", entry.File, tag.RowsAffected(), entry.Rows)})
+			return
+		}
+		restored[table] = entry.Rows
+	}
+
+	// Ids are restored as they were; move the sequence past them.
+	_, err = tx.Exec(ctx, "SELECT setval(pg_get_serial_sequence('prices', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM prices")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset id sequence"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+		return
+	}
+	exportArchives.purge()
+
+	c.JSON(http.StatusOK, gin.H{"schema_version": manifest.SchemaVersion, "restored": restored})
+}
+
+// readRestoreArchive spools the file part of the multipart body.
+func readRestoreArchive(c *gin.Context) (*spooledUpload, int, error) {
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("no file uploaded")
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, http.StatusBadRequest, errors.New("no file uploaded")
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("malformed multipart body")
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		archive, err := spoolUpload(part)
+		part.Close()
+		if errors.Is(err, errTempBudgetExceeded) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.New("unable to read file")
+		}
+		return archive, 0, nil
+	}
+}
+
+func readBackupManifest(zr *zip.Reader) (backupManifest, error) {
+	var manifest backupManifest
+	f, err := zr.Open(backupManifestName)
+	if err != nil {
+		return manifest, errors.New("backup has no manifest.json")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return manifest, errors.New("manifest.json is not valid JSON")
+	}
+	return manifest, nil
+}
+
+// checkBackupSchema requires the backup to come from the same schema
+// version, with exactly the current columns of every table.
+func checkBackupSchema(ctx context.Context, tx pgx.Tx, manifest backupManifest) error {
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if manifest.SchemaVersion != version {
+		return fmt.Errorf("backup has schema version %d, the database has %d", manifest.SchemaVersion, version)
+	}
+
+	for _, table := range backupTables {
+		entry, ok := manifest.Tables[table]
+		if !ok {
+			return fmt.Errorf("manifest does not list table %s", table)
+		}
+		columns, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		backed := slices.Sorted(slices.Values(entry.Columns))
+		if !slices.Equal(backed, slices.Sorted(slices.Values(columns))) {
+			return fmt.Errorf("columns of %s do not match the current schema", table)
+		}
+	}
+	return nil
+}
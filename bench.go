@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	benchUpload = "upload"
+	benchExport = "export"
+)
+
+type benchOptions struct {
+	url         string
+	inProcess   bool
+	databaseURL string
+	apiKey      string
+	workload    string
+	requests    int
+	concurrency int
+	rows        int
+	categories  int
+	files       int
+	archiveType string
+	exportQuery string
+	seed        uint64
+	json        bool
+}
+
+// benchReport is the result of a run; with -json it is printed as is, so
+// its fields are a format that CI may compare across runs.
+type benchReport struct {
+	Workload       string         `json:"workload"`
+	Target         string         `json:"target"`
+	Requests       int            `json:"requests"`
+	Concurrency    int            `json:"concurrency"`
+	RowsPerArchive int            `json:"rows_per_archive,omitempty"`
+	Seed           uint64         `json:"seed"`
+	Errors         int            `json:"errors"`
+	StatusCodes    map[string]int `json:"status_codes"`
+	DurationSec    float64        `json:"duration_seconds"`
+	RequestsPerSec float64        `json:"requests_per_second"`
+	RowsPerSec     float64        `json:"rows_per_second,omitempty"`
+	BytesSent      int64          `json:"bytes_sent"`
+	BytesReceived  int64          `json:"bytes_received"`
+	LatencyMs      benchLatency   `json:"latency_ms"`
+	// PeakRSSBytes is the peak resident set of the bench process, which
+	// includes the server only with -in-process.
+	PeakRSSBytes int64 `json:"peak_rss_bytes"`
+	// DBTransactions and DBStatements are deltas over the run, read from
+	// pg_stat_database and pg_stat_statements when a database URL is known.
+	// The statistics are flushed asynchronously, so they are approximate.
+	DBTransactions *int64 `json:"db_transactions"`
+	DBStatements   *int64 `json:"db_statements"`
+}
+
+type benchLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// benchBody is a prepared multipart upload.
+type benchBody struct {
+	contentType string
+	data        []byte
+}
+
+type benchResult struct {
+	status   int
+	err      error
+	latency  time.Duration
+	sent     int64
+	received int64
+}
+
+// runBench implements the bench subcommand: it drives uploads or exports
+// against a running server, or against the handlers in this process, and
+// reports throughput, latency percentiles and resource usage.
+func runBench(args []string) error {
+	opts, err := parseBenchFlags(args)
+	if err != nil {
+		return err
+	}
+
+	target := opts.url
+	if opts.inProcess {
+		srv, err := startBenchServer()
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		defer closeDB()
+		target = srv.URL
+		if opts.databaseURL == "" {
+			opts.databaseURL = os.Getenv("DATABASE_URL")
+		}
+	}
+
+	bodies, err := benchBodies(opts)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	before, beforeErr := readDBCounters(ctx, opts.databaseURL)
+
+	results := make([]benchResult, opts.requests)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	client := &http.Client{}
+	started := time.Now()
+	for w := 0; w < opts.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = benchRequest(client, target, opts, bodies, i)
+			}
+		}()
+	}
+	for i := 0; i < opts.requests; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	report := summarizeBench(opts, target, results, elapsed)
+	report.PeakRSSBytes = peakRSS()
+	if beforeErr == nil {
+		if after, err := readDBCounters(ctx, opts.databaseURL); err == nil {
+			transactions := after.transactions - before.transactions
+			report.DBTransactions = &transactions
+			if before.statements != nil && after.statements != nil {
+				statements := *after.statements - *before.statements
+				report.DBStatements = &statements
+			}
+		}
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printBenchReport(report)
+	return nil
+}
+
+func parseBenchFlags(args []string) (benchOptions, error) {
+	var opts benchOptions
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&opts.url, "url", "http://localhost:8080", "base URL of a running server")
+	fs.BoolVar(&opts.inProcess, "in-process", false, "serve the handlers from this process, connected to DATABASE_URL, instead of using -url")
+	fs.StringVar(&opts.databaseURL, "database-url", "", "database to read statement counts from (default DATABASE_URL with -in-process)")
+	fs.StringVar(&opts.apiKey, "api-key", os.Getenv("BENCH_API_KEY"), "X-API-Key header to send")
+	fs.StringVar(&opts.workload, "workload", benchUpload, "upload or export")
+	fs.IntVar(&opts.requests, "requests", 20, "number of requests")
+	fs.IntVar(&opts.concurrency, "concurrency", 4, "requests in flight at once")
+	fs.IntVar(&opts.rows, "rows", 10000, "rows per generated archive")
+	fs.IntVar(&opts.categories, "categories", 20, "distinct categories in generated rows")
+	fs.IntVar(&opts.files, "files", 1, "CSV files per generated archive")
+	fs.StringVar(&opts.archiveType, "type", archiveZip, "archive type to upload: zip or tar")
+	fs.StringVar(&opts.exportQuery, "export-query", "", "query string for export requests, e.g. min=100&max=500")
+	fs.Uint64Var(&opts.seed, "seed", 1, "seed of the generated data")
+	fs.BoolVar(&opts.json, "json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	switch {
+	case opts.workload != benchUpload && opts.workload != benchExport:
+		return opts, fmt.Errorf("-workload must be upload or export")
+	case opts.archiveType != archiveZip && opts.archiveType != archiveTar:
+		return opts, fmt.Errorf("-type must be zip or tar")
+	case opts.requests < 1 || opts.concurrency < 1:
+		return opts, fmt.Errorf("-requests and -concurrency must be positive")
+	case opts.rows < 1 || opts.categories < 1 || opts.files < 1:
+		return opts, fmt.Errorf("-rows, -categories and -files must be positive")
+	}
+	return opts, nil
+}
+
+// startBenchServer brings the service up the way run does, but behind an
+// httptest server on a free port.
+func startBenchServer() (*httptest.Server, error) {
+	loadConfig()
+	connectDB()
+	if err := initDB(); err != nil {
+		closeDB()
+		return nil, err
+	}
+	r, err := newRouter()
+	if err != nil {
+		closeDB()
+		return nil, err
+	}
+	return httptest.NewServer(r), nil
+}
+
+// benchBodies generates the upload archives up front, so generation is not
+// timed. Request i uploads the archive of seed+i: every upload inserts new
+// rows instead of only finding duplicates.
+func benchBodies(opts benchOptions) ([]benchBody, error) {
+	if opts.workload != benchUpload {
+		return nil, nil
+	}
+	bodies := make([]benchBody, opts.requests)
+	for i := range bodies {
+		data := syntheticData{seed: opts.seed + uint64(i), rows: opts.rows, categories: opts.categories, files: opts.files}
+		archive, err := data.archive(opts.archiveType)
+		if err != nil {
+			return nil, err
+		}
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, err := mw.CreateFormFile("file", "bench."+opts.archiveType)
+		if err != nil {
+			return nil, err
+		}
+		part.Write(archive)
+		mw.Close()
+		bodies[i] = benchBody{contentType: mw.FormDataContentType(), data: body.Bytes()}
+	}
+	return bodies, nil
+}
+
+// benchRequest sends request i and reads the whole response. The base path
+// comes from BASE_PATH in-process; for a remote server it belongs in -url.
+func benchRequest(client *http.Client, target string, opts benchOptions, bodies []benchBody, i int) benchResult {
+	var req *http.Request
+	var err error
+	if opts.workload == benchUpload {
+		req, err = http.NewRequest(http.MethodPost, target+cfg.basePath+"/api/v0/prices?type="+opts.archiveType, bytes.NewReader(bodies[i].data))
+		if err == nil {
+			req.Header.Set("Content-Type", bodies[i].contentType)
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, target+cfg.basePath+"/api/v0/prices?"+opts.exportQuery, nil)
+	}
+	if err != nil {
+		return benchResult{err: err}
+	}
+	if opts.apiKey != "" {
+		req.Header.Set("X-API-Key", opts.apiKey)
+	}
+
+	var result benchResult
+	if bodies != nil {
+		result.sent = int64(len(bodies[i].data))
+	}
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.err = err
+		result.latency = time.Since(started)
+		return result
+	}
+	result.received, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.latency = time.Since(started)
+	result.status = resp.StatusCode
+	result.err = err
+	return result
+}
+
+func summarizeBench(opts benchOptions, target string, results []benchResult, elapsed time.Duration) benchReport {
+	report := benchReport{
+		Workload:    opts.workload,
+		Target:      target,
+		Requests:    opts.requests,
+		Concurrency: opts.concurrency,
+		Seed:        opts.seed,
+		StatusCodes: make(map[string]int),
+		DurationSec: elapsed.Seconds(),
+	}
+	if opts.inProcess {
+		report.Target = "in-process"
+	}
+
+	latencies := make([]time.Duration, 0, len(results))
+	succeeded := 0
+	for _, r := range results {
+		latencies = append(latencies, r.latency)
+		report.BytesSent += r.sent
+		report.BytesReceived += r.received
+		switch {
+		case r.err != nil:
+			report.Errors++
+			report.StatusCodes["error"]++
+		default:
+			report.StatusCodes[fmt.Sprint(r.status)]++
+			if r.status >= 400 {
+				report.Errors++
+			} else {
+				succeeded++
+			}
+		}
+	}
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		i := int(p*float64(len(latencies))+0.5) - 1
+		i = max(0, min(i, len(latencies)-1))
+		return float64(latencies[i].Microseconds()) / 1000
+	}
+	report.LatencyMs = benchLatency{P50: percentile(0.5), P90: percentile(0.9), P99: percentile(0.99), Max: percentile(1)}
+
+	if elapsed > 0 {
+		report.RequestsPerSec = float64(opts.requests) / elapsed.Seconds()
+		if opts.workload == benchUpload {
+			report.RowsPerArchive = opts.rows
+			report.RowsPerSec = float64(succeeded*opts.rows) / elapsed.Seconds()
+		}
+	}
+	return report
+}
+
+type dbCounters struct {
+	transactions int64
+	statements   *int64
+}
+
+// readDBCounters reads the committed and rolled back transactions of the
+// database and, if pg_stat_statements is installed, its statement calls.
+func readDBCounters(ctx context.Context, databaseURL string) (dbCounters, error) {
+	var counters dbCounters
+	if databaseURL == "" {
+		return counters, errors.New("no database URL")
+	}
+	conn, err := pgx.Connect(ctx, databaseURL)
+	if err != nil {
+		return counters, err
+	}
+	defer conn.Close(ctx)
+
+	err = conn.QueryRow(ctx,
+		"SELECT xact_commit + xact_rollback FROM pg_stat_database WHERE datname = current_database()").Scan(&counters.transactions)
+	if err != nil {
+		return counters, err
+	}
+	var statements int64
+	err = conn.QueryRow(ctx,
+		`SELECT COALESCE(SUM(calls), 0)::bigint FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())`).Scan(&statements)
+	if err == nil {
+		counters.statements = &statements
+	}
+	return counters, nil
+}
+
+func printBenchReport(r benchReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "workload\t%s (%s)\n", r.Workload, r.Target)
+	fmt.Fprintf(w, "requests\t%d, concurrency %d, errors %d\n", r.Requests, r.Concurrency, r.Errors)
+	fmt.Fprintf(w, "status codes\t%v\n", r.StatusCodes)
+	fmt.Fprintf(w, "duration\t%.2fs\n", r.DurationSec)
+	fmt.Fprintf(w, "throughput\t%.2f req/s", r.RequestsPerSec)
+	if r.RowsPerSec > 0 {
+		fmt.Fprintf(w, ", %.0f rows/s", r.RowsPerSec)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "latency\tp50 %.1fms, p90 %.1fms, p99 %.1fms, max %.1fms\n", r.LatencyMs.P50, r.LatencyMs.P90, r.LatencyMs.P99, r.LatencyMs.Max)
+	fmt.Fprintf(w, "transferred\t%d bytes sent, %d bytes received\n", r.BytesSent, r.BytesReceived)
+	fmt.Fprintf(w, "peak RSS\t%.1f MiB\n", float64(r.PeakRSSBytes)/(1<<20))
+	if r.DBTransactions != nil {
+		fmt.Fprintf(w, "db transactions\t%d\n", *r.DBTransactions)
+	}
+	if r.DBStatements != nil {
+		fmt.Fprintf(w, "db statements\t%d\n", *r.DBStatements)
+	}
+	w.Flush()
+}
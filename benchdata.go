@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// syntheticData describes a generated price list. The same seed always
+// yields the same rows, so benchmark runs are comparable.
+type syntheticData struct {
+	seed       uint64
+	rows       int
+	categories int
+	files      int
+}
+
+var syntheticEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// csv returns the rows of one file in the upload format: a header row, then
+// id, name, category, price and create_date. Names include the seed, so
+// archives generated with different seeds do not duplicate each other.
+func (d syntheticData) csv(file int) []byte {
+	rng := rand.New(rand.NewPCG(d.seed, uint64(file)))
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "name", "category", "price", "create_date"})
+
+	perFile := d.rows / d.files
+	if file < d.rows%d.files {
+		perFile++
+	}
+	for i := 0; i < perFile; i++ {
+		cents := 100 + rng.IntN(1_000_000)
+		w.Write([]string{
+			strconv.Itoa(i + 1),
+			fmt.Sprintf("item-%d-%d-%d", d.seed, file, i),
+			fmt.Sprintf("category-%03d", rng.IntN(d.categories)),
+			fmt.Sprintf("%d.%02d", cents/100, cents%100),
+			syntheticEpoch.AddDate(0, 0, rng.IntN(366)).Format("2006-01-02"),
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// archive packs the files into a zip or tar archive.
+func (d syntheticData) archive(archiveType string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch archiveType {
+	case archiveZip:
+		zw := zip.NewWriter(&buf)
+		for f := 0; f < d.files; f++ {
+			w, err := zw.Create(fmt.Sprintf("data-%03d.csv", f))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(d.csv(f)); err != nil {
+				return nil, err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case archiveTar:
+		tw := tar.NewWriter(&buf)
+		for f := 0; f < d.files; f++ {
+			content := d.csv(f)
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     fmt.Sprintf("data-%03d.csv", f),
+				Mode:     0o644,
+				Size:     int64(len(content)),
+				ModTime:  syntheticEpoch,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write(content); err != nil {
+				return nil, err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported archive type %q", archiveType)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxBundleNameLength bounds the file name derived from a category.
+const maxBundleNameLength = 100
+
+// bundleEntryName turns a category into a file name safe for any archive
+// tool: letters, digits, '.', '-' and '_' are kept, anything else becomes
+// '_', and leading dots and dashes are dropped. Names taken by an earlier
+// category, ignoring case, get a numeric suffix.
+func bundleEntryName(category string, taken map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, category)
+	name = strings.TrimLeft(name, ".-")
+	if len(name) > maxBundleNameLength {
+		name = strings.ToValidUTF8(name[:maxBundleNameLength], "")
+	}
+	if name == "" {
+		name = "_"
+	}
+
+	unique := name
+	for i := 2; taken[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique + ".zip"
+}
+
+// writeTarBundle answers with a tar holding one zip per category, each
+// with the data.csv a plain export of that category would have. priceRows
+// must be ordered by category.
+func writeTarBundle(c *gin.Context, priceRows []priceRow, opts exportOptions) {
+	if len(priceRows) == 0 && opts.emptyNoContent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	var groups [][]priceRow
+	for i, row := range priceRows {
+		if i == 0 || row.category != priceRows[i-1].category {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], row)
+	}
+	if len(groups) > cfg.exportMaxCategories {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("export spans %d categories, more than the limit of %d", len(groups), cfg.exportMaxCategories)})
+		return
+	}
+
+	var tarBuffer bytes.Buffer
+	tarWriter := tar.NewWriter(&tarBuffer)
+	taken := make(map[string]bool)
+	now := time.Now()
+	for _, group := range groups {
+		archive, err := buildZipExport(group, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build zip archive"})
+			return
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:    bundleEntryName(group[0].category, taken),
+			Mode:    0o644,
+			Size:    int64(len(archive)),
+			ModTime: now,
+		})
+		if err == nil {
+			_, err = tarWriter.Write(archive)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build tar bundle"})
+			return
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build tar bundle"})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-tar", tarBuffer.Bytes())
+}
+
+// exportStats is the stats.json of a bundle=full export, totals of the
+// rows in its data.csv.
+type exportStats struct {
+	TotalItems      int64   `json:"total_items"`
+	TotalCategories int64   `json:"total_categories"`
+	TotalPrice      float64 `json:"total_price"`
+}
+
+// exportManifest is the manifest.json of a bundle=full export. SnapshotAt
+// is the start of the transaction every file was read in, and ChangeSeq
+// the last change of the change feed it includes.
+type exportManifest struct {
+	SnapshotAt time.Time  `json:"snapshot_at"`
+	ChangeSeq  int64      `json:"change_seq"`
+	Query      url.Values `json:"query"`
+	Rows       int64      `json:"rows"`
+	Files      []string   `json:"files"`
+}
+
+// streamFullBundle answers bundle=full with a zip holding data.csv,
+// stats.json, categories.json and manifest.json. data.csv is streamed from
+// the cursor as in streamZipExport; the other files are then read in the
+// same repeatable-read transaction, so all four describe one snapshot and
+// apply the same filters. As with streamZipExport, a failure after the
+// first byte is only logged and the archive is cut short.
+func streamFullBundle(c *gin.Context, tx pgx.Tx, rows pgx.Rows, filter *priceFilter, opts exportOptions) {
+	defer rows.Close()
+
+	hasRow := rows.Next()
+	if !hasRow && rows.Err() == nil && opts.emptyNoContent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	zipWriter := zip.NewWriter(c.Writer)
+	csvFile, err := zipWriter.Create("data.csv")
+	if err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+	manifest := exportManifest{
+		Query: c.Request.URL.Query(),
+		Files: []string{"data.csv", "stats.json", "categories.json", "manifest.json"},
+	}
+	csvWriter := opts.newCSVWriter(csvFile)
+	for ; hasRow; hasRow = rows.Next() {
+		row, err := opts.scanRow(rows)
+		if err != nil {
+			log.Printf("Bundle export aborted: %v", err)
+			return
+		}
+		csvWriter.Write(row.toCSV(opts))
+		manifest.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+	// The connection is free for the next queries only once the cursor is
+	// closed.
+	rows.Close()
+
+	ctx := c.Request.Context()
+	var stats exportStats
+	err = tx.QueryRow(ctx, "SELECT COUNT(*), COUNT(DISTINCT category), COALESCE(SUM("+priceColumn()+"), 0) FROM prices WHERE 1=1"+filter.sql(),
+		filter.args...).Scan(&stats.TotalItems, &stats.TotalCategories, &stats.TotalPrice)
+	if err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+	stats.TotalPrice = roundMoney(stats.TotalPrice, opts.rounding)
+	categoryRows, err := tx.Query(ctx, categoriesQuery(filter), filter.args...)
+	if err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+	categories, err := collectCategories(categoryRows, opts.rounding)
+	if err == nil {
+		err = tx.QueryRow(ctx, "SELECT now()").Scan(&manifest.SnapshotAt)
+	}
+	if err == nil {
+		manifest.SnapshotAt = manifest.SnapshotAt.UTC()
+		manifest.ChangeSeq, err = currentChangeSeq(ctx, tx)
+	}
+	if err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+		return
+	}
+
+	for _, file := range []struct {
+		name  string
+		value interface{}
+	}{{"stats.json", stats}, {"categories.json", categories}, {"manifest.json", manifest}} {
+		w, err := zipWriter.Create(file.name)
+		if err == nil {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(file.value)
+		}
+		if err != nil {
+			log.Printf("Bundle export aborted: %v", err)
+			return
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		log.Printf("Bundle export aborted: %v", err)
+	}
+}
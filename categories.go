@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type categorySummary struct {
+	Category   string  `json:"category"`
+	Rows       int64   `json:"rows"`
+	TotalPrice float64 `json:"total_price"`
+}
+
+// getCategories lists the categories among the rows matching the usual
+// filters, with their row counts and price totals. A restricted key sees
+// only its own categories; ?all=true with the admin token lists them all.
+func getCategories(c *gin.Context) {
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	rows, err := queryWithRetry(c.Request.Context(), "categories", categoriesQuery(filter), filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	categories, err := collectCategories(rows, rounding)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+		return
+	}
+	c.JSON(http.StatusOK, categories)
+}
+
+func categoriesQuery(filter *priceFilter) string {
+	return "SELECT category, COUNT(*), SUM(" + priceColumn() + ") FROM prices WHERE 1=1" +
+		filter.sql() + " GROUP BY category ORDER BY category"
+}
+
+// collectCategories reads the rows of categoriesQuery, never returning nil
+// so an empty listing is encoded as [].
+func collectCategories(rows pgx.Rows, rounding roundingMode) ([]categorySummary, error) {
+	categories, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (categorySummary, error) {
+		var s categorySummary
+		err := row.Scan(&s.Category, &s.Rows, &s.TotalPrice)
+		s.TotalPrice = roundMoney(s.TotalPrice, rounding)
+		return s, err
+	})
+	if categories == nil {
+		categories = []categorySummary{}
+	}
+	return categories, err
+}
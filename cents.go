@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+)
+
+const (
+	priceStorageDecimal = "decimal"
+	priceStorageCents   = "cents"
+)
+
+// envPriceStorage reads PRICE_STORAGE. Both columns are always written;
+// the setting picks which one is read, filtered and aggregated.
+func envPriceStorage() bool {
+	switch value := os.Getenv("PRICE_STORAGE"); value {
+	case "", priceStorageDecimal:
+		return false
+	case priceStorageCents:
+		return true
+	default:
+		log.Printf("Invalid PRICE_STORAGE=%q, using default %s", value, priceStorageDecimal)
+		return false
+	}
+}
+
+// priceColumn is the SQL expression prices are read from: the DECIMAL
+// column, or the exact integer cents converted back at the boundary.
+func priceColumn() string {
+	if cfg.priceCents {
+		return "(price_cents / 100.0)"
+	}
+	return "price"
+}
+
+// toCents converts a parsed price to whole cents, rounding half up on its
+// decimal representation.
+func toCents(price float64) int64 {
+	return int64(math.Round(roundMoney(price, roundHalfUp) * 100))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+// priceChange is one entry of the change feed. Data is the full row after an
+// insert or update and before a delete; a truncate has none.
+type priceChange struct {
+	Seq       int64           `json:"seq"`
+	Op        string          `json:"op"`
+	ID        *int64          `json:"id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+// getPriceChanges returns the changes after ?since= in sequence order. The
+// seq of the last change is the cursor for the next call; replaying from 0
+// rebuilds the table unless older changes have been pruned, in which case
+// the client gets 410 and must start over from a full export.
+func getPriceChanges(c *gin.Context) {
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		respondFilterError(c, &filterError{param: "since", message: "must be a non-negative integer"})
+		return
+	}
+	limit := defaultChangesLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxChangesLimit {
+			respondFilterError(c, &filterError{param: "limit", message: fmt.Sprintf("must be an integer between 1 and %d", maxChangesLimit)})
+			return
+		}
+		limit = n
+	}
+	format := c.DefaultQuery("format", formatJSON)
+	if format != formatJSON && format != "jsonl" {
+		respondFilterError(c, &filterError{param: "format", message: "must be one of json, jsonl"})
+		return
+	}
+
+	var horizon int64
+	err = withRetry(c.Request.Context(), "changes", func() error {
+		return db.QueryRow(context.Background(), "SELECT seq FROM price_changes_horizon").Scan(&horizon)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	if since < horizon {
+		c.JSON(http.StatusGone, gin.H{
+			"error":        "changes before this cursor have been pruned; resync from a full export",
+			"oldest_since": horizon,
+		})
+		return
+	}
+
+	// Restricted keys see changes to their categories only; truncates carry
+	// no row and are visible to everyone.
+	filter := &priceFilter{}
+	if allowed := readCategories(c); allowed != nil {
+		filter.add("(data IS NULL OR data->>'category' = ANY(%s))", allowed)
+	}
+	query := "SELECT seq, op, price_id, data, changed_at FROM price_changes WHERE seq > " + filter.arg(since) +
+		filter.sql() + " ORDER BY seq LIMIT " + filter.arg(limit)
+
+	rows, err := queryWithRetry(c.Request.Context(), "changes", query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	changes := []priceChange{}
+	for rows.Next() {
+		var ch priceChange
+		if err := rows.Scan(&ch.Seq, &ch.Op, &ch.ID, &ch.Data, &ch.ChangedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		changes = append(changes, ch)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	if format == "jsonl" {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("X-Next-Cursor", strconv.FormatInt(next, 10))
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		for _, ch := range changes {
+			enc.Encode(ch)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes, "next_cursor": next})
+}
+
+// pruneChanges drops change records older than CHANGES_RETENTION once an
+// hour and moves the horizon past them. It runs until ctx is cancelled.
+func pruneChanges(ctx context.Context) {
+	if cfg.changesRetention <= 0 || dbReadOnly.Load() {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var pruned int64
+		err := db.QueryRow(context.Background(), `
+			WITH deleted AS (
+				DELETE FROM price_changes WHERE changed_at < now() - make_interval(secs => $1) RETURNING seq
+			)
+			UPDATE price_changes_horizon SET seq = GREATEST(seq, (SELECT COALESCE(MAX(seq), 0) FROM deleted))
+			RETURNING (SELECT COUNT(*) FROM deleted)`,
+			cfg.changesRetention.Seconds()).Scan(&pruned)
+		if err != nil {
+			log.Printf("Pruning the change feed failed: %v", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d change feed records older than %s", pruned, cfg.changesRetention)
+		}
+	}
+}
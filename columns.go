@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	headerPositional = "positional"
+	headerNames      = "names"
+)
+
+// columnMap holds the CSV column index of each field an upload reads. The
+// id column is only read when the upload keeps the file's ids. id,
+// validFrom, validTo and externalID are optional; a row may end before
+// them, and -1 means the file has no such column. externalID is only found
+// by header name.
+type columnMap struct {
+	id, name, category, price, createDate int
+	validFrom, validTo, externalID        int
+}
+
+// positionalColumns is the fixed id,name,category,price,create_date layout.
+// Columns after create_date are read as valid_from,valid_to only when the
+// header row names them so; see positionalHeader.
+var positionalColumns = columnMap{id: 0, name: 1, category: 2, price: 3, createDate: 4, validFrom: -1, validTo: -1, externalID: -1}
+
+// positionalHeader is the positional layout of a file with this header row:
+// the sixth and seventh columns hold valid_from and valid_to if the header
+// names them that way, and are ignored otherwise, so a file carrying other
+// data after create_date does not have it read as dates.
+func positionalHeader(header []string) columnMap {
+	m := positionalColumns
+	for i, name := range []string{"valid_from", "valid_to"} {
+		col := m.createDate + 1 + i
+		if col < len(header) && strings.EqualFold(strings.TrimSpace(header[col]), name) {
+			*m.field(name) = col
+		}
+	}
+	return m
+}
+
+// field returns the index of the csv column of pricesColumns named name.
+func (m *columnMap) field(name string) *int {
+	switch name {
+	case "id":
+		return &m.id
+	case "name":
+		return &m.name
+	case "category":
+		return &m.category
+	case "price":
+		return &m.price
+	case "create_date":
+		return &m.createDate
+	case "valid_from":
+		return &m.validFrom
+	case "valid_to":
+		return &m.validTo
+	case "external_id":
+		return &m.externalID
+	}
+	panic("columnMap has no field " + name)
+}
+
+// width is the number of columns a row needs to cover every required
+// column of pricesColumns where this mapping puts it. Optional columns
+// never count: a row may end before them.
+func (m columnMap) width() int {
+	width := 0
+	for _, col := range pricesColumns {
+		if col.required {
+			width = max(width, *m.field(col.name)+1)
+		}
+	}
+	return width
+}
+
+// headerError reports required columns missing from a CSV header.
+type headerError struct {
+	file    string
+	missing []string
+}
+
+func (e *headerError) Error() string {
+	return fmt.Sprintf("csv file %s has no column %s", e.file, strings.Join(e.missing, ", "))
+}
+
+// mapHeader finds the csv columns of pricesColumns by header name,
+// case-insensitively. With fallback, a missing column is taken from its
+// position in the fixed layout, provided no named column already sits
+// there; the fields mapped that way are returned.
+func mapHeader(file string, header []string, fallback bool) (columnMap, []string, error) {
+	index := make(map[string]int, len(header))
+	for i, cell := range header {
+		cell = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(cell, "\ufeff")))
+		if _, ok := index[cell]; !ok {
+			index[cell] = i
+		}
+	}
+
+	// Optional columns count as absent unless named; required ones keep
+	// their position for the fallback.
+	m := positionalColumns
+	m.id, m.validFrom, m.validTo = -1, -1, -1
+
+	taken := make(map[int]bool)
+	var missing []string
+	for _, col := range pricesColumns {
+		if !col.csv {
+			continue
+		}
+		i, ok := index[col.name]
+		switch {
+		case ok:
+			*m.field(col.name) = i
+			if col.required {
+				taken[i] = true
+			}
+		case col.required:
+			missing = append(missing, col.name)
+		}
+	}
+
+	if len(missing) == 0 {
+		return m, nil, nil
+	}
+	if !fallback {
+		return m, nil, &headerError{file: file, missing: missing}
+	}
+	for _, name := range missing {
+		if taken[*m.field(name)] {
+			return m, nil, &headerError{file: file, missing: missing}
+		}
+	}
+	return m, missing, nil
+}
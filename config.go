@@ -0,0 +1,273 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type config struct {
+	addr                string
+	adminToken          string
+	apiKeys             []apiKey
+	trustedProxies      []string
+	maxFieldSize        int
+	aggregateMaxGroups  int
+	basePath            string
+	uploadTempBudget    int
+	applicationName     string
+	minPrice            float64
+	maxArchiveFiles     int
+	maxUncompressedSize int
+	maxCompressionRatio int
+	priceCents          bool
+	uploadSessionTTL    time.Duration
+	dbRetries           int
+	dbRetryDelay        time.Duration
+	logSQL              string
+	exportMaxCategories int
+	uploadIdleTxTimeout time.Duration
+	filterMaxLength     int
+	filterExprMaxLength int
+	filterMaxClauses    int
+	exportBufferRows    int
+	changesRetention    time.Duration
+	streamMaxRows       int
+	anomalyFutureDays   int
+	exportCacheSize     int
+	exportCacheTTL      time.Duration
+	datePivotYear       int
+	qualityTimeout      time.Duration
+	qualitySampleRows   int
+	memoryGuardBytes    int
+	uploadHeartbeat     time.Duration
+	usageFlushInterval  time.Duration
+	janitorInterval     time.Duration
+	tempFileRetention   time.Duration
+	attemptRetention    time.Duration
+	redactKey           []byte
+	timezone            *time.Location
+	quarantineRejection float64
+	quarantinePriceChg  float64
+	quarantineWebhook   string
+	v0Deprecation       time.Time
+	v0Sunset            time.Time
+	v0DeprecationWarn   bool
+	base64UploadMax     int
+	uploadCopy          bool
+	parallelInsertMax   int
+	reconcileMaxDays    int
+	revalidateBatchSize int
+	drainReadWindow     time.Duration
+	drainWriteTimeout   time.Duration
+}
+
+var cfg config
+
+func loadConfig() {
+	cfg = config{
+		addr:                ":" + envString("PORT", "8080"),
+		adminToken:          os.Getenv("ADMIN_TOKEN"),
+		apiKeys:             parseAPIKeys(envList("API_KEYS")),
+		trustedProxies:      envList("TRUSTED_PROXIES"),
+		maxFieldSize:        envInt("MAX_FIELD_SIZE", 64*1024),
+		aggregateMaxGroups:  envInt("AGGREGATE_MAX_GROUPS", 10000),
+		basePath:            normalizeBasePath(os.Getenv("BASE_PATH")),
+		uploadTempBudget:    envInt("UPLOAD_TEMP_BUDGET", 8<<30),
+		applicationName:     applicationName(),
+		minPrice:            envFloat("MIN_PRICE", 0.01),
+		maxArchiveFiles:     envInt("MAX_ARCHIVE_FILES", 10000),
+		maxUncompressedSize: envInt("MAX_UNCOMPRESSED_SIZE", 16<<30),
+		maxCompressionRatio: envInt("MAX_COMPRESSION_RATIO", 200),
+		priceCents:          envPriceStorage(),
+		uploadSessionTTL:    envDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		dbRetries:           envInt(envRenamed("DB_RETRIES", "DB_READ_RETRIES"), 2),
+		dbRetryDelay:        envDuration(envRenamed("DB_RETRY_DELAY", "DB_READ_RETRY_DELAY"), 100*time.Millisecond),
+		logSQL:              envLogSQL(),
+		exportMaxCategories: envInt("EXPORT_MAX_CATEGORIES", 1000),
+		uploadIdleTxTimeout: envDuration("UPLOAD_IDLE_TX_TIMEOUT", time.Minute),
+		filterMaxLength:     envInt("FILTER_MAX_LENGTH", 256),
+		filterExprMaxLength: envInt("FILTER_EXPR_MAX_LENGTH", 2048),
+		filterMaxClauses:    envInt("FILTER_MAX_CLAUSES", 25),
+		exportBufferRows:    envInt("EXPORT_BUFFER_ROWS", 10000),
+		changesRetention:    envDuration("CHANGES_RETENTION", 30*24*time.Hour),
+		streamMaxRows:       envInt("STREAM_MAX_ROWS", 1000),
+		anomalyFutureDays:   envInt("ANOMALY_FUTURE_DAYS", 0),
+		exportCacheSize:     envInt("EXPORT_CACHE_SIZE", 0),
+		exportCacheTTL:      envDuration("EXPORT_CACHE_TTL", time.Minute),
+		datePivotYear:       envInt("DATE_PIVOT_YEAR", 1969),
+		qualityTimeout:      envDuration("QUALITY_TIMEOUT", 10*time.Second),
+		qualitySampleRows:   envInt("QUALITY_SAMPLE_ROWS", 1000000),
+		memoryGuardBytes:    envInt("MEMORY_GUARD_BYTES", 0),
+		uploadHeartbeat:     envDuration("UPLOAD_HEARTBEAT", 30*time.Second),
+		usageFlushInterval:  envDuration("USAGE_FLUSH_INTERVAL", time.Minute),
+		janitorInterval:     envDuration("JANITOR_INTERVAL", 10*time.Minute),
+		tempFileRetention:   envDuration("TEMP_FILE_RETENTION", 24*time.Hour),
+		attemptRetention:    envDuration("UPLOAD_ATTEMPT_RETENTION", 30*24*time.Hour),
+		redactKey:           redactKey(),
+		timezone:            envLocation(),
+		quarantineRejection: envFloat("QUARANTINE_REJECTION_RATE", 0),
+		quarantinePriceChg:  envFloat("QUARANTINE_PRICE_CHANGE", 0),
+		quarantineWebhook:   os.Getenv("QUARANTINE_WEBHOOK"),
+		v0Deprecation:       envDate("V0_DEPRECATION_DATE"),
+		v0Sunset:            envDate("V0_SUNSET_DATE"),
+		v0DeprecationWarn:   envBool("V0_DEPRECATION_WARNINGS", false),
+		base64UploadMax:     envInt("BASE64_UPLOAD_MAX_SIZE", 64<<20),
+		uploadCopy:          envBool("UPLOAD_COPY", true),
+		parallelInsertMax:   envInt("PARALLEL_INSERT_MAX", 4),
+		reconcileMaxDays:    envInt("RECONCILE_MAX_DAYS", 31),
+		revalidateBatchSize: envInt("REVALIDATE_BATCH_SIZE", 1000),
+		drainReadWindow:     envDuration("DRAIN_READ_WINDOW", 30*time.Second),
+		drainWriteTimeout:   envDuration("DRAIN_WRITE_TIMEOUT", 15*time.Minute),
+	}
+	loadFeatures()
+}
+
+// applicationName identifies this instance in pg_stat_activity: the
+// DB_APPLICATION_NAME prefix plus INSTANCE_ID, or the hostname when unset.
+func applicationName() string {
+	instance := os.Getenv("INSTANCE_ID")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	name := envString("DB_APPLICATION_NAME", "prices-service")
+	if instance != "" {
+		name += "-" + instance
+	}
+	return name
+}
+
+// normalizeBasePath turns "pricing/", "/pricing/" and "/pricing" into
+// "/pricing"; an empty or "/" prefix means routes live at the root.
+func normalizeBasePath(raw string) string {
+	trimmed := strings.Trim(raw, "/")
+	if trimmed == "" {
+		return ""
+	}
+	return "/" + trimmed
+}
+
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envRenamed is the variable to read a setting from: key, or the name it
+// had before, old, when only that one is set, with a deprecation warning.
+func envRenamed(key, old string) string {
+	if os.Getenv(key) == "" && os.Getenv(old) != "" {
+		log.Printf("%s is deprecated, use %s", old, key)
+		return old
+	}
+	return key
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// envList splits a comma-separated variable, dropping empty items.
+func envList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+// splitList splits a comma-separated list, as in an env var or a query
+// parameter, dropping blanks around and between the items.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envLocation is the time zone of APP_TIMEZONE, or of TZ when that is
+// unset, as an IANA name such as Europe/Moscow; UTC by default.
+func envLocation() *time.Location {
+	key := "APP_TIMEZONE"
+	value := os.Getenv(key)
+	if value == "" {
+		key, value = "TZ", os.Getenv("TZ")
+	}
+	if value == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using UTC", key, value)
+		return time.UTC
+	}
+	return loc
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// envDate reads a YYYY-MM-DD date, midnight UTC, or an RFC 3339 time; the
+// zero time when unset or invalid.
+func envDate(key string) time.Time {
+	value := os.Getenv(key)
+	if value == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(isoDateLayout, value); err == nil {
+		return t
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, ignoring it", key, value)
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// copyColumns are the columns copyRecords writes; the rest keep their
+// defaults, id from the sequence.
+var copyColumns = []string{"name", "category", "price", "create_date", "batch_id", "name_norm", "price_cents", "valid_from", "valid_to"}
+
+// copyEligible reports whether insertRecords may write the records with
+// COPY. COPY cannot skip a row on a conflict, so the rows must not carry
+// anything that can conflict: no external ids, and no file ids unless they
+// are reassigned anyway.
+func copyEligible(records []priceRecord, opts uploadOptions) bool {
+	if opts.onDuplicate == dupUpsertExternal {
+		return false
+	}
+	for _, rec := range records {
+		if rec.externalID != "" || (rec.id != nil && opts.idConflict != idReassign) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyKey is the identity and price two rows of an upload are compared by
+// in copyRecords.
+type copyKey struct {
+	name, category string
+	cents          int64
+}
+
+// copyRecords writes the records with one COPY instead of an INSERT each.
+// The duplicate check the per-row path makes for every row is made for all
+// of them by one query against the table, and repeats within the upload,
+// which the per-row path finds among the rows it already inserted, are
+// found in memory under the same rules. stored ends up with the same
+// counts either way.
+func copyRecords(tx pgx.Tx, batchID string, records []priceRecord, opts uploadOptions, knownCategories map[string]bool, stored *storedUpload) error {
+	ctx := context.Background()
+
+	pending := records[:0:0]
+	for _, rec := range records {
+		if knownCategories[rec.category] {
+			stored.skippedKnownCategories++
+			continue
+		}
+		pending = append(pending, rec)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// COPY sends binary values, and pgx encodes a uuid only from its bytes.
+	var batch pgtype.UUID
+	if err := batch.Scan(batchID); err != nil {
+		return &storeError{"failed to insert records", err}
+	}
+
+	checkTable := opts.dedupScope != dedupUpload
+	var inTable map[int64]bool
+	if checkTable {
+		// beginUploadTx took the change feed lock, so no other upload
+		// commits a matching row between the check and the COPY.
+		var err error
+		if inTable, err = duplicatesInTable(ctx, tx, pending, opts); err != nil {
+			return err
+		}
+	}
+
+	caseInsensitive := opts.dedupe == dedupeCI
+	inserted := make(map[copyKey][]time.Time)
+	rows := make([][]interface{}, 0, len(pending))
+	for i, rec := range pending {
+		key := copyKey{rec.name, rec.category, toCents(rec.price)}
+		if caseInsensitive {
+			key.name, key.category = strings.ToLower(key.name), strings.ToLower(key.category)
+		}
+		if checkTable {
+			// Rows are stored rounded to cents; in DECIMAL storage a price
+			// with more decimals equals no stored one.
+			comparable := cfg.priceCents || float64(key.cents)/100 == rec.price
+			if inTable[int64(i+1)] || (comparable && repeatsInserted(inserted[key], rec, opts.dateToleranceDays)) {
+				stored.addDuplicate(rec)
+				continue
+			}
+			inserted[key] = append(inserted[key], rec.createDate)
+		}
+		rows = append(rows, []interface{}{rec.name, rec.category, rec.price, rec.createDate, batch,
+			normalizeName(rec.name), key.cents, rec.validFrom, rec.validTo})
+		stored.addInserted(rec)
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"prices"}, copyColumns, pgx.CopyFromRows(rows)); err != nil {
+		return &storeError{"failed to insert records", err}
+	}
+	return nil
+}
+
+// duplicatesInTable returns the 1-based positions of the records that
+// match a stored row, by the same identity, price and date window as the
+// per-row check.
+func duplicatesInTable(ctx context.Context, tx pgx.Tx, records []priceRecord, opts uploadOptions) (map[int64]bool, error) {
+	names := make([]string, len(records))
+	categories := make([]string, len(records))
+	lows := make([]time.Time, len(records))
+	highs := make([]time.Time, len(records))
+	prices := make([]float64, len(records))
+	cents := make([]int64, len(records))
+	for i, rec := range records {
+		names[i], categories[i], prices[i], cents[i] = rec.name, rec.category, rec.price, toCents(rec.price)
+		lows[i] = rec.createDate.AddDate(0, 0, -opts.dateToleranceDays)
+		highs[i] = rec.createDate.AddDate(0, 0, opts.dateToleranceDays)
+	}
+
+	priceMatch, priceArg := "p.price = u.price", interface{}(prices)
+	priceType := "numeric[]"
+	if cfg.priceCents {
+		priceMatch, priceArg, priceType = "p.price_cents = u.price", cents, "bigint[]"
+	}
+	identityMatch := "p.name = u.name AND p.category = u.category"
+	if opts.dedupe == dedupeCI {
+		identityMatch = "lower(p.name) = lower(u.name) AND lower(p.category) = lower(u.category)"
+	}
+	query := "SELECT u.ord FROM unnest($1::text[], $2::text[], $3::" + priceType + ", $4::timestamp[], $5::timestamp[])" +
+		" WITH ORDINALITY u(name, category, price, low, high, ord)" +
+		" WHERE EXISTS (SELECT 1 FROM prices p WHERE " + identityMatch + " AND " + priceMatch +
+		" AND p.create_date BETWEEN u.low AND u.high)"
+	rows, err := tx.Query(ctx, query, names, categories, priceArg, lows, highs)
+	if err != nil {
+		return nil, &storeError{"database error", err}
+	}
+	ords, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, &storeError{"database error", err}
+	}
+	found := make(map[int64]bool, len(ords))
+	for _, ord := range ords {
+		found[ord] = true
+	}
+	return found, nil
+}
+
+// repeatsInserted reports whether rec falls within the date tolerance of
+// one of the dates of the rows already copied under its key.
+func repeatsInserted(dates []time.Time, rec priceRecord, toleranceDays int) bool {
+	low, high := rec.createDate.AddDate(0, 0, -toleranceDays), rec.createDate.AddDate(0, 0, toleranceDays)
+	for _, d := range dates {
+		if !d.Before(low) && !d.After(high) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,25 +2,62 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var db *pgx.Conn
+var db *pgxpool.Pool
 
-func connectDB() {
+// dbConfig parses DATABASE_URL with the session settings every connection
+// gets.
+func dbConfig() (*pgxpool.Config, error) {
 	connStr := os.Getenv("DATABASE_URL")
 	if connStr == "" {
-		log.Fatalf("DATABASE_URL is not set")
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse DATABASE_URL: %w", err)
+	}
+	// The session time zone decides what current_date and localtimestamp
+	// are, so "today" follows APP_TIMEZONE. create_date is a TIMESTAMP
+	// without time zone holding a calendar date, which the session time
+	// zone never converts.
+	poolConfig.ConnConfig.RuntimeParams["timezone"] = cfg.timezone.String()
+	// An application_name given in DATABASE_URL takes precedence.
+	if _, ok := poolConfig.ConnConfig.RuntimeParams["application_name"]; !ok {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = cfg.applicationName
+	}
+	return poolConfig, nil
+}
+
+// dbApplicationName is the application_name the pool's sessions show in
+// pg_stat_activity: cfg.applicationName, unless DATABASE_URL sets its own.
+func dbApplicationName() string {
+	return db.Config().ConnConfig.RuntimeParams["application_name"]
+}
+
+func connectDB() {
+	poolConfig, err := dbConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		log.Fatalf("Unable to create connection pool: %v", err)
 	}
 
-	var err error
 	maxRetries := 10
 	for i := 0; i < maxRetries; i++ {
-		db, err = pgx.Connect(context.Background(), connStr)
+		err = db.Ping(context.Background())
 		if err == nil {
 			log.Printf("Successfully connected to database")
 			break
@@ -35,8 +72,10 @@ func connectDB() {
 	}
 }
 
-func initDB() error {
-	query := `
+// migrations are applied in order; the index of each entry plus one is its
+// schema version. Never edit an entry that has shipped, append a new one.
+var migrations = []string{
+	`
 	CREATE TABLE IF NOT EXISTS prices (
 		id SERIAL PRIMARY KEY,
 		name VARCHAR(255) NOT NULL,
@@ -44,11 +83,323 @@ func initDB() error {
 		price DECIMAL(10, 2) NOT NULL,
 		create_date TIMESTAMP NOT NULL
 	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS uploads (
+		batch_id UUID PRIMARY KEY,
+		filename TEXT NOT NULL,
+		archive_type VARCHAR(16) NOT NULL,
+		total_count INTEGER NOT NULL,
+		inserted_count INTEGER NOT NULL,
+		duplicates_count INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS batch_id UUID;
+	CREATE INDEX IF NOT EXISTS prices_batch_id_idx ON prices (batch_id);
+	`,
+	`
+	ALTER TABLE uploads ADD COLUMN IF NOT EXISTS rolled_back_at TIMESTAMPTZ;
+	`,
+	// name_norm is filled by normalizeName on insert; existing rows are
+	// backfilled with a plain lower() which is close enough for prefix search.
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS name_norm TEXT;
+	UPDATE prices SET name_norm = lower(name) WHERE name_norm IS NULL;
+	CREATE INDEX IF NOT EXISTS prices_name_norm_idx ON prices (name_norm text_pattern_ops);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS filter_presets (
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		params JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (owner, name)
+	);
+	`,
+	// price_cents is written on every insert and read with
+	// PRICE_STORAGE=cents.
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS price_cents BIGINT;
+	UPDATE prices SET price_cents = round(price * 100) WHERE price_cents IS NULL;
+	`,
+	`
+	ALTER TABLE uploads ADD COLUMN IF NOT EXISTS metadata JSONB;
+	`,
+	// Serves the ?dedupe=ci existence check.
+	`
+	CREATE INDEX IF NOT EXISTS prices_identity_ci_idx ON prices (lower(name), lower(category));
+	`,
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS valid_from DATE;
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS valid_to DATE;
+	`,
+	// Every change to prices is logged by trigger for the change feed. The
+	// advisory lock makes writing transactions take their sequence numbers
+	// in commit order, so a reader never sees a later seq before an earlier
+	// one commits. Existing rows are logged as inserts so replaying from 0
+	// rebuilds the table.
+	`
+	CREATE TABLE IF NOT EXISTS price_changes (
+		seq BIGSERIAL PRIMARY KEY,
+		op VARCHAR(8) NOT NULL,
+		price_id INTEGER,
+		data JSONB,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS price_changes_changed_at_idx ON price_changes (changed_at);
+	CREATE TABLE IF NOT EXISTS price_changes_horizon (
+		id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+		seq BIGINT NOT NULL
+	);
+	INSERT INTO price_changes_horizon (seq) VALUES (0) ON CONFLICT DO NOTHING;
+
+	CREATE OR REPLACE FUNCTION record_price_change() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_advisory_xact_lock(hashtext('price_changes'));
+		IF TG_OP = 'TRUNCATE' THEN
+			INSERT INTO price_changes (op) VALUES ('truncate');
+		ELSIF TG_OP = 'DELETE' THEN
+			INSERT INTO price_changes (op, price_id, data) VALUES ('delete', OLD.id, to_jsonb(OLD));
+		ELSE
+			INSERT INTO price_changes (op, price_id, data) VALUES (lower(TG_OP), NEW.id, to_jsonb(NEW));
+		END IF;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS prices_change_log ON prices;
+	CREATE TRIGGER prices_change_log AFTER INSERT OR UPDATE OR DELETE ON prices
+		FOR EACH ROW EXECUTE FUNCTION record_price_change();
+	DROP TRIGGER IF EXISTS prices_change_log_truncate ON prices;
+	CREATE TRIGGER prices_change_log_truncate AFTER TRUNCATE ON prices
+		FOR EACH STATEMENT EXECUTE FUNCTION record_price_change();
+
+	INSERT INTO price_changes (op, price_id, data)
+		SELECT 'insert', p.id, to_jsonb(p) FROM prices p ORDER BY p.id;
+	`,
+	// Budget alerts; last_fired_period is the start of the period whose
+	// crossing was last reported, so a crossing fires once per period.
+	`
+	CREATE TABLE IF NOT EXISTS alerts (
+		id BIGSERIAL PRIMARY KEY,
+		category VARCHAR(255) NOT NULL,
+		period VARCHAR(8) NOT NULL,
+		threshold DECIMAL(14, 2) NOT NULL,
+		target TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_fired_period DATE,
+		last_fired_at TIMESTAMPTZ,
+		last_total DECIMAL(14, 2)
+	);
+	CREATE INDEX IF NOT EXISTS alerts_category_idx ON alerts (category);
+	`,
+	// supplier is set by reconcile, which scopes a snapshot to it. Rows a
+	// reconcile removes are kept in removed_prices with its batch id.
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS supplier TEXT;
+	CREATE INDEX IF NOT EXISTS prices_supplier_idx ON prices (supplier, create_date);
+	CREATE TABLE IF NOT EXISTS removed_prices (
+		id INTEGER NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		category VARCHAR(255) NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		create_date TIMESTAMP NOT NULL,
+		batch_id UUID,
+		supplier TEXT,
+		valid_from DATE,
+		valid_to DATE,
+		removed_by UUID NOT NULL,
+		removed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS removed_prices_removed_by_idx ON removed_prices (removed_by);
+	`,
+	// Serves the date windows of the quality report and the start/end
+	// filters.
+	`
+	CREATE INDEX IF NOT EXISTS prices_create_date_idx ON prices (create_date);
+	CREATE INDEX IF NOT EXISTS uploads_created_at_idx ON uploads (created_at);
+	`,
+	// An upload in progress, committed before its transaction starts so a
+	// crash leaves it behind; the transaction that writes the uploads row
+	// deletes it.
+	`
+	CREATE TABLE IF NOT EXISTS upload_attempts (
+		batch_id UUID PRIMARY KEY,
+		filename TEXT NOT NULL,
+		archive_type VARCHAR(16) NOT NULL,
+		metadata JSONB,
+		instance TEXT NOT NULL,
+		temp_path TEXT,
+		status VARCHAR(16) NOT NULL DEFAULT 'processing',
+		failure_reason TEXT,
+		started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		finished_at TIMESTAMPTZ
+	);
+	`,
+	// Per-category price bounds checked on upload; an advisory rule only
+	// warns.
+	`
+	CREATE TABLE IF NOT EXISTS price_rules (
+		id BIGSERIAL PRIMARY KEY,
+		category_pattern VARCHAR(255) NOT NULL,
+		min_price DECIMAL(10, 2),
+		max_price DECIMAL(10, 2),
+		advisory BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`,
+	// Usage per API key and month, added to by every instance's flushes.
+	`
+	CREATE TABLE IF NOT EXISTS usage (
+		key_id TEXT NOT NULL,
+		period DATE NOT NULL,
+		requests BIGINT NOT NULL DEFAULT 0,
+		uploaded_bytes BIGINT NOT NULL DEFAULT 0,
+		exported_bytes BIGINT NOT NULL DEFAULT 0,
+		rows_inserted BIGINT NOT NULL DEFAULT 0,
+		rows_exported BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_id, period)
+	);
+	`,
+	// The client's own identifier of a row, unique per supplier; rows of
+	// plain uploads have no supplier.
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS external_id VARCHAR(255);
+	ALTER TABLE removed_prices ADD COLUMN IF NOT EXISTS external_id VARCHAR(255);
+	CREATE UNIQUE INDEX IF NOT EXISTS prices_external_id_idx ON prices (COALESCE(supplier, ''), external_id)
+		WHERE external_id IS NOT NULL;
+	`,
+	// Free-form labels applied to rows in bulk.
+	`
+	ALTER TABLE prices ADD COLUMN IF NOT EXISTS labels TEXT[] NOT NULL DEFAULT '{}';
+	CREATE INDEX IF NOT EXISTS prices_labels_idx ON prices USING GIN (labels);
+	`,
+	// Uploads held for review and their rows, outside prices until an
+	// admin approves them; per-supplier thresholds override the
+	// QUARANTINE_* defaults.
+	`
+	CREATE TABLE IF NOT EXISTS quarantine_thresholds (
+		supplier TEXT PRIMARY KEY,
+		rejection_rate DOUBLE PRECISION,
+		price_change DOUBLE PRECISION,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS quarantined_uploads (
+		batch_id UUID PRIMARY KEY,
+		filename TEXT NOT NULL,
+		archive_type VARCHAR(16) NOT NULL,
+		supplier TEXT,
+		total_count INTEGER NOT NULL,
+		duplicates_count INTEGER NOT NULL,
+		metadata JSONB,
+		options JSONB NOT NULL,
+		reasons JSONB NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'quarantined',
+		result JSONB,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		decided_at TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS quarantined_prices (
+		batch_id UUID NOT NULL REFERENCES quarantined_uploads ON DELETE CASCADE,
+		ord INTEGER NOT NULL,
+		id INTEGER,
+		name VARCHAR(255) NOT NULL,
+		category VARCHAR(255) NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		create_date TIMESTAMP NOT NULL,
+		valid_from DATE,
+		valid_to DATE,
+		external_id VARCHAR(255),
+		file TEXT NOT NULL,
+		PRIMARY KEY (batch_id, ord)
+	);
+	`,
+	// Updates log the row as it was as well, so a diff knows the version
+	// an update replaced without searching the feed before the span.
+	`
+	ALTER TABLE price_changes ADD COLUMN IF NOT EXISTS old_data JSONB;
+	CREATE OR REPLACE FUNCTION record_price_change() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_advisory_xact_lock(hashtext('price_changes'));
+		IF TG_OP = 'TRUNCATE' THEN
+			INSERT INTO price_changes (op) VALUES ('truncate');
+		ELSIF TG_OP = 'DELETE' THEN
+			INSERT INTO price_changes (op, price_id, data) VALUES ('delete', OLD.id, to_jsonb(OLD));
+		ELSIF TG_OP = 'UPDATE' THEN
+			INSERT INTO price_changes (op, price_id, data, old_data) VALUES ('update', NEW.id, to_jsonb(NEW), to_jsonb(OLD));
+		ELSE
+			INSERT INTO price_changes (op, price_id, data) VALUES ('insert', NEW.id, to_jsonb(NEW));
+		END IF;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+	`,
+	// Rows moved out by reconcile keep their labels.
 	`
-	_, err := db.Exec(context.Background(), query)
+	ALTER TABLE removed_prices ADD COLUMN IF NOT EXISTS labels TEXT[] NOT NULL DEFAULT '{}';
+	`,
+}
+
+func initDB() error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize concurrent instances starting against the same database.
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('prices_schema_migrations'))"); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		if _, err := tx.Exec(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", i+1); err != nil {
+			return err
+		}
+		log.Printf("Applied schema migration %d", i+1)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// lockChangeFeed takes the lock the change log trigger takes on every
+// change to prices. A writing transaction takes it first, before any row
+// or table lock on prices, so the trigger finds it already held and no two
+// writers wait on each other's locks in opposite orders.
+func lockChangeFeed(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('price_changes'))")
+	return err
+}
+
+// lockPrices locks the prices rows matching where, in id order, after the
+// change feed lock. Bulk writers lock overlapping rows in the same order
+// before changing them, so they queue behind each other instead of
+// deadlocking.
+func lockPrices(ctx context.Context, tx pgx.Tx, where string, args ...interface{}) error {
+	if err := lockChangeFeed(ctx, tx); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "SELECT COUNT(*) FROM (SELECT 1 FROM prices p WHERE "+where+" ORDER BY p.id FOR UPDATE) locked", args...)
 	return err
 }
 
 func closeDB() {
-	db.Close(context.Background())
+	db.Close()
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const isoDateLayout = "2006-01-02"
+
+// dateFormats maps the names accepted by ?date_format= to Go layouts.
+var dateFormats = map[string]string{
+	"YYYY-MM-DD": isoDateLayout,
+	"YYYY/MM/DD": "2006/01/02",
+	"DD.MM.YYYY": "02.01.2006",
+	"DD/MM/YYYY": "02/01/2006",
+	"MM/DD/YYYY": "01/02/2006",
+	"DD-MM-YY":   "02-01-06",
+	"DD.MM.YY":   "02.01.06",
+	"DD/MM/YY":   "02/01/06",
+	"MM/DD/YY":   "01/02/06",
+}
+
+// autoDateLayouts is the order layouts are tried in with date_format=auto.
+// Day-first wins over month-first for ambiguous dates like 01/02/2024.
+// Two-digit years are never guessed and need an explicit date_format.
+var autoDateLayouts = []string{isoDateLayout, "2006/01/02", "02.01.2006", "02/01/2006", "01/02/2006"}
+
+func parseDateFormat(raw string) ([]string, error) {
+	switch raw {
+	case "":
+		return []string{isoDateLayout}, nil
+	case "auto":
+		return autoDateLayouts, nil
+	}
+	layout, ok := dateFormats[strings.ToUpper(raw)]
+	if !ok {
+		return nil, &filterError{param: "date_format", message: "must be auto or one of YYYY-MM-DD, YYYY/MM/DD, DD.MM.YYYY, DD/MM/YYYY, MM/DD/YYYY, DD-MM-YY, DD.MM.YY, DD/MM/YY, MM/DD/YY"}
+	}
+	return []string{layout}, nil
+}
+
+// parseDate tries each layout in turn and reports which one matched. Dates
+// are midnight UTC whatever the server's TZ or APP_TIMEZONE, as time.Parse
+// gives a time without a zone, and pgx writes a TIMESTAMP from its wall
+// clock, so the stored create_date is the calendar date from the file.
+func parseDate(value string, layouts []string) (time.Time, string, bool) {
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if isTwoDigitYear(layout) {
+			var ok bool
+			if t, ok = pivotYear(t, cfg.datePivotYear); !ok {
+				continue
+			}
+		}
+		return t, layout, true
+	}
+	return time.Time{}, "", false
+}
+
+func isTwoDigitYear(layout string) bool {
+	return strings.Contains(layout, "06") && !strings.Contains(layout, "2006")
+}
+
+// pivotYear moves a date parsed with a two-digit year into the hundred
+// years starting at DATE_PIVOT_YEAR: with 1950, 49 is 2049 and 50 is 1950.
+// A 29 February that the new year does not have is rejected.
+func pivotYear(t time.Time, pivot int) (time.Time, bool) {
+	year := pivot - pivot%100 + t.Year()%100
+	if year < pivot {
+		year += 100
+	}
+	moved := time.Date(year, t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return moved, moved.Month() == t.Month()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// testDBTimeout bounds the whole -test-db check.
+const testDBTimeout = 10 * time.Second
+
+// runTestDB connects to DATABASE_URL once, without the retries of
+// connectDB, pings it and runs a trivial query, and prints the server
+// version and how long each step took. It touches no table, so it is safe
+// against any database.
+func runTestDB() error {
+	loadConfig()
+	poolConfig, err := dbConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testDBTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := pgx.ConnectConfig(ctx, poolConfig.ConnConfig)
+	if err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	defer conn.Close(context.Background())
+	connected := time.Since(start)
+
+	start = time.Now()
+	if err := conn.Ping(ctx); err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	pinged := time.Since(start)
+
+	var one int
+	var version string
+	start = time.Now()
+	if err := conn.QueryRow(ctx, "SELECT 1, current_setting('server_version')").Scan(&one, &version); err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	queried := time.Since(start)
+
+	cc := poolConfig.ConnConfig
+	fmt.Printf("database:       %s@%s:%d/%s\n", cc.User, cc.Host, cc.Port, cc.Database)
+	fmt.Printf("server version: %s\n", version)
+	fmt.Printf("connect:        %s\n", connected.Round(time.Microsecond))
+	fmt.Printf("ping:           %s\n", pinged.Round(time.Microsecond))
+	fmt.Printf("query:          %s\n", queried.Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Duplicate detection scopes for ?dedup_scope=.
+const (
+	dedupTable  = "table"
+	dedupUpload = "upload"
+	dedupBoth   = "both"
+)
+
+// Duplicate identity modes for ?dedupe=: exact compares name and category
+// as stored, ci ignores their case.
+const (
+	dedupeExact = "exact"
+	dedupeCI    = "ci"
+)
+
+// recordKey is the identity of a row for duplicate detection. Rows with
+// different external ids are different entries even with equal content.
+type recordKey struct {
+	name       string
+	category   string
+	price      float64
+	createDate int64
+	externalID string
+}
+
+func (rec priceRecord) key(caseInsensitive bool) recordKey {
+	k := recordKey{rec.name, rec.category, rec.price, rec.createDate.Unix(), rec.externalID}
+	if caseInsensitive {
+		k.name, k.category = strings.ToLower(k.name), strings.ToLower(k.category)
+	}
+	return k
+}
+
+// dedupeWithinUpload drops repeated rows inside one upload without touching
+// the database, keeping the first occurrence and so its casing.
+func dedupeWithinUpload(records []priceRecord, caseInsensitive bool) ([]priceRecord, int) {
+	seen := make(map[recordKey]bool, len(records))
+	unique := records[:0:0]
+	for _, rec := range records {
+		k := rec.key(caseInsensitive)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		unique = append(unique, rec)
+	}
+	return unique, len(records) - len(unique)
+}
+
+// maxConflictingIDs caps the ids listed when an upload is rejected for
+// reusing them.
+const maxConflictingIDs = 100
+
+// conflictingID is a file id given to rows with different content, with
+// where each of those rows is.
+type conflictingID struct {
+	ID   int64         `json:"id"`
+	Rows []rowPosition `json:"rows"`
+}
+
+type rowPosition struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// sameContent reports whether two rows sharing an id describe the same
+// entry, so that the second is only a repeat of the first.
+func sameContent(a, b priceRecord) bool {
+	return a.key(false) == b.key(false) && sameDate(a.validFrom, b.validFrom) && sameDate(a.validTo, b.validTo)
+}
+
+func sameDate(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// dropConflictingIDs finds file ids reused for rows with different
+// content, across every file of the upload, and keeps only the first row
+// of each. Rows repeating the first row of their id exactly stay, for
+// duplicate detection to handle. The conflicts are listed in the order
+// their ids first appear.
+func dropConflictingIDs(records []priceRecord) ([]priceRecord, []conflictingID) {
+	first := make(map[int64]int)
+	index := make(map[int64]int)
+	var conflicts []conflictingID
+	kept := records[:0:0]
+	for i, rec := range records {
+		if rec.id == nil {
+			kept = append(kept, rec)
+			continue
+		}
+		j, seen := first[*rec.id]
+		if !seen {
+			first[*rec.id] = i
+			kept = append(kept, rec)
+			continue
+		}
+		if sameContent(records[j], rec) {
+			kept = append(kept, rec)
+			continue
+		}
+		k, listed := index[*rec.id]
+		if !listed {
+			k = len(conflicts)
+			index[*rec.id] = k
+			conflicts = append(conflicts, conflictingID{ID: *rec.id, Rows: []rowPosition{{records[j].file, records[j].line}}})
+		}
+		conflicts[k].Rows = append(conflicts[k].Rows, rowPosition{rec.file, rec.line})
+	}
+	return kept, conflicts
+}
+
+// categoryBreakdown is how many rows of one category an upload inserted
+// and skipped as duplicates, for ?category_breakdown=true.
+type categoryBreakdown struct {
+	Inserted   int `json:"inserted"`
+	Duplicates int `json:"duplicates"`
+}
+
+// breakdownByCategory combines the rows stored inserted and skipped with
+// the repeats dropped within the upload, by category. A category whose
+// rows were all duplicates is listed with no inserts.
+func breakdownByCategory(stored storedUpload, uploadDuplicates map[string]int) map[string]categoryBreakdown {
+	breakdown := make(map[string]categoryBreakdown)
+	add := func(counts map[string]int, duplicates bool) {
+		for category, n := range counts {
+			b := breakdown[category]
+			if duplicates {
+				b.Duplicates += n
+			} else {
+				b.Inserted += n
+			}
+			breakdown[category] = b
+		}
+	}
+	add(stored.categories, false)
+	add(stored.categoryDuplicates, true)
+	add(uploadDuplicates, true)
+	return breakdown
+}
+
+// countByCategory counts the records of each category.
+func countByCategory(records []priceRecord) map[string]int {
+	counts := make(map[string]int)
+	for _, rec := range records {
+		counts[rec.category]++
+	}
+	return counts
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Optional integrations must never fail the core upload and export flows.
+// When one of them errors, the caller falls back (uncached query, skipped
+// notification) and records the subsystem here so /readyz can report it as
+// degraded while the instance stays ready.
+type degradation struct {
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+	Failures int64     `json:"failures"`
+}
+
+// The optional subsystems reported as degraded.
+const (
+	subsystemExportCache       = "export_cache"
+	subsystemAlerts            = "alerts"
+	subsystemAlertWebhook      = "alert_webhook"
+	subsystemQuarantineWebhook = "quarantine_webhook"
+)
+
+var (
+	degradedMu sync.Mutex
+	degraded   = make(map[string]degradation)
+)
+
+// markDegraded records a failure of subsystem; the first one since it last
+// worked is logged.
+func markDegraded(subsystem string, err error) {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+
+	d, ok := degraded[subsystem]
+	if !ok {
+		d.Since = time.Now().UTC()
+		log.Printf("Subsystem %s degraded: %v", subsystem, err)
+	}
+	d.Reason = err.Error()
+	d.Failures++
+	degraded[subsystem] = d
+}
+
+// markRecovered records that subsystem worked again.
+func markRecovered(subsystem string) {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+
+	if _, ok := degraded[subsystem]; ok {
+		delete(degraded, subsystem)
+		log.Printf("Subsystem %s recovered", subsystem)
+	}
+}
+
+func degradedSubsystems() map[string]degradation {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+	return maps.Clone(degraded)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// noWarningsContextKey marks a response whose top-level JSON object is
+// data, such as a grouped export keyed by category, so no warnings key is
+// mixed into it.
+const noWarningsContextKey = "no_deprecation_warnings"
+
+// deprecatedKeyUsage is how one API key used the deprecated v0 API since
+// the process started, by route.
+type deprecatedKeyUsage struct {
+	Requests int64            `json:"requests"`
+	LastSeen time.Time        `json:"last_seen"`
+	Routes   map[string]int64 `json:"routes"`
+}
+
+// deprecatedUsage counts v0 requests by the key owner of keyOwner, "" for
+// requests without an API key, for the admin metrics.
+var deprecatedUsage = struct {
+	mu   sync.Mutex
+	keys map[string]*deprecatedKeyUsage
+}{keys: make(map[string]*deprecatedKeyUsage)}
+
+func recordDeprecatedUsage(keyID, route string, at time.Time) {
+	deprecatedUsage.mu.Lock()
+	defer deprecatedUsage.mu.Unlock()
+	u, ok := deprecatedUsage.keys[keyID]
+	if !ok {
+		u = &deprecatedKeyUsage{Routes: make(map[string]int64)}
+		deprecatedUsage.keys[keyID] = u
+	}
+	u.Requests++
+	u.LastSeen = at.UTC()
+	u.Routes[route]++
+}
+
+func deprecatedUsageSnapshot() map[string]deprecatedKeyUsage {
+	deprecatedUsage.mu.Lock()
+	defer deprecatedUsage.mu.Unlock()
+	snapshot := make(map[string]deprecatedKeyUsage, len(deprecatedUsage.keys))
+	for key, u := range deprecatedUsage.keys {
+		routes := make(map[string]int64, len(u.Routes))
+		for route, n := range u.Routes {
+			routes[route] = n
+		}
+		snapshot[key] = deprecatedKeyUsage{Requests: u.Requests, LastSeen: u.LastSeen, Routes: routes}
+	}
+	return snapshot
+}
+
+// deprecateV0 announces the deprecation of the v0 API once
+// V0_DEPRECATION_DATE is set: every response gets a Deprecation header
+// (RFC 9745), a Sunset header (RFC 8594) when V0_SUNSET_DATE is set, and a
+// Link to the same path under /api/v1. Each request is counted against its
+// API key, and with V0_DEPRECATION_WARNINGS JSON object responses also
+// carry a warnings array. Unset, it does nothing.
+func deprecateV0() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.v0Deprecation.IsZero() {
+			c.Next()
+			return
+		}
+		c.Header("Deprecation", fmt.Sprintf("@%d", cfg.v0Deprecation.Unix()))
+		if !cfg.v0Sunset.IsZero() {
+			c.Header("Sunset", cfg.v0Sunset.UTC().Format(http.TimeFormat))
+		}
+		successor := strings.Replace(c.Request.URL.Path, "/api/v0", "/api/v1", 1)
+		if c.Request.URL.RawQuery != "" {
+			successor += "?" + c.Request.URL.RawQuery
+		}
+		c.Header("Link", "<"+successor+`>; rel="successor-version"`)
+		if cfg.v0DeprecationWarn {
+			c.Writer = &warningWriter{ResponseWriter: c.Writer, c: c, warnings: deprecationWarnings()}
+		}
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		recordDeprecatedUsage(keyOwner(c), c.Request.Method+" "+route, time.Now())
+	}
+}
+
+func deprecationWarnings() []byte {
+	warning := "API v0 is deprecated since " + cfg.v0Deprecation.UTC().Format(isoDateLayout)
+	if !cfg.v0Sunset.IsZero() {
+		warning += " and will be removed on " + cfg.v0Sunset.UTC().Format(isoDateLayout)
+	}
+	warnings, _ := json.Marshal([]string{warning + "; use /api/v1"})
+	return warnings
+}
+
+// States of a warningWriter.
+const (
+	warningsPending = iota // nothing written yet
+	warningsOpen           // the opening brace is held back
+	warningsDone           // the rest passes through
+)
+
+// warningWriter adds a warnings key to a JSON object response as it is
+// written, so streamed responses stay streamed: the opening brace is held
+// back until the first token after it shows whether the object is empty.
+// Other responses pass through untouched.
+type warningWriter struct {
+	gin.ResponseWriter
+	c        *gin.Context
+	warnings []byte
+	state    int
+}
+
+func (w *warningWriter) injectable() bool {
+	status := w.ResponseWriter.Status()
+	return status != http.StatusNoContent && status != http.StatusNotModified &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") &&
+		!w.c.GetBool(noWarningsContextKey)
+}
+
+func (w *warningWriter) Write(p []byte) (int, error) {
+	if w.state == warningsPending && !w.injectable() {
+		w.state = warningsDone
+	}
+	consumed := 0
+	for consumed < len(p) && w.state != warningsDone {
+		b := p[consumed]
+		switch {
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			consumed++
+		case w.state == warningsPending && b == '{':
+			w.state = warningsOpen
+			consumed++
+		case w.state == warningsPending:
+			w.state = warningsDone
+		default:
+			prefix := `{"warnings":` + string(w.warnings)
+			if b != '}' {
+				prefix += ","
+			}
+			w.state = warningsDone
+			if _, err := w.ResponseWriter.WriteString(prefix); err != nil {
+				return consumed, err
+			}
+		}
+	}
+	if consumed == len(p) {
+		return consumed, nil
+	}
+	n, err := w.ResponseWriter.Write(p[consumed:])
+	return consumed + n, err
+}
+
+func (w *warningWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
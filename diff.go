@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const diffManifestName = "manifest.json"
+
+// errDiffPruned and errNoPosition are the two ways a diff endpoint cannot
+// be placed in the change feed.
+var (
+	errDiffPruned = errors.New("changes of this span have been pruned; resync from a full export")
+	errNoPosition = errors.New("upload changed no rows")
+)
+
+// diffManifest describes a diff archive.
+type diffManifest struct {
+	FromSeq     int64     `json:"from_seq"`
+	ToSeq       int64     `json:"to_seq"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Added       int       `json:"added"`
+	Removed     int       `json:"removed"`
+	Categories  []string  `json:"categories,omitempty"`
+	Min         *float64  `json:"min,omitempty"`
+	Max         *float64  `json:"max,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// changeRow is a prices row as the change trigger stores it.
+type changeRow struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	PriceCents *int64  `json:"price_cents"`
+	CreateDate string  `json:"create_date"`
+}
+
+func (r changeRow) priceRow() (priceRow, error) {
+	createDate, err := time.ParseInLocation("2006-01-02T15:04:05", r.CreateDate, time.UTC)
+	if err != nil {
+		return priceRow{}, err
+	}
+	price := r.Price
+	if cfg.priceCents && r.PriceCents != nil {
+		price = float64(*r.PriceCents) / 100
+	}
+	return priceRow{id: r.ID, name: r.Name, category: r.Category, price: price, createDate: createDate}, nil
+}
+
+// diffPosition resolves ?<end>_upload= or ?<end>= to the seq of the change
+// feed the state is taken at. An upload's position is its last insert; a
+// time's is the last change whose transaction started by then. An empty
+// parameter is the current state when current is set.
+func diffPosition(ctx context.Context, c *gin.Context, end string, current bool) (int64, string, error) {
+	batchID, raw := c.Query(end+"_upload"), c.Query(end)
+	switch {
+	case batchID != "" && raw != "":
+		return 0, "", &filterError{param: end, message: "cannot be combined with " + end + "_upload"}
+	case batchID != "":
+		if !isUUID(batchID) {
+			return 0, "", &filterError{param: end + "_upload", message: "must be an upload batch_id"}
+		}
+		seq, err := uploadPosition(ctx, batchID)
+		return seq, "upload " + batchID, err
+	case raw != "":
+		at, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			if at, err = time.ParseInLocation(isoDateLayout, raw, cfg.timezone); err != nil {
+				return 0, "", &filterError{param: end, message: "must be an RFC 3339 time or a YYYY-MM-DD date"}
+			}
+		}
+		seq, err := timePosition(ctx, at)
+		return seq, at.UTC().Format(time.RFC3339), err
+	case current:
+		var seq int64
+		err := db.QueryRow(ctx, "SELECT GREATEST((SELECT COALESCE(MAX(seq), 0) FROM price_changes), seq) FROM price_changes_horizon").Scan(&seq)
+		return seq, "now", err
+	}
+	return 0, "", &filterError{param: end, message: "either " + end + " or " + end + "_upload is required"}
+}
+
+// uploadPosition finds the upload's inserts by its transaction time, which
+// the change records share with the uploads row, and its batch id.
+func uploadPosition(ctx context.Context, batchID string) (int64, error) {
+	var createdAt time.Time
+	err := db.QueryRow(ctx, "SELECT created_at FROM uploads WHERE batch_id = $1", batchID).Scan(&createdAt)
+	if err != nil {
+		return 0, err
+	}
+	var seq *int64
+	var oldest *time.Time
+	var horizon int64
+	err = db.QueryRow(ctx,
+		`SELECT (SELECT MAX(seq) FROM price_changes WHERE changed_at = $1 AND op = 'insert' AND data->>'batch_id' = $2),
+			(SELECT MIN(changed_at) FROM price_changes), (SELECT seq FROM price_changes_horizon)`,
+		createdAt, batchID).Scan(&seq, &oldest, &horizon)
+	switch {
+	case err != nil:
+		return 0, err
+	case seq != nil:
+		return *seq, nil
+	case horizon > 0 && (oldest == nil || createdAt.Before(*oldest)):
+		return 0, errDiffPruned
+	}
+	return 0, errNoPosition
+}
+
+func timePosition(ctx context.Context, at time.Time) (int64, error) {
+	var seq *int64
+	var horizon int64
+	err := db.QueryRow(ctx,
+		"SELECT (SELECT MAX(seq) FROM price_changes WHERE changed_at <= $1), (SELECT seq FROM price_changes_horizon)",
+		at).Scan(&seq, &horizon)
+	switch {
+	case err != nil:
+		return 0, err
+	case seq != nil:
+		return *seq, nil
+	case horizon > 0:
+		return 0, errDiffPruned
+	}
+	return 0, nil
+}
+
+// getPriceDiff returns a zip with the rows added and the rows removed
+// between two points of the change feed, each named by an upload
+// (from_upload, to_upload) or a time (from, to); without either, to is the
+// current state. category, min and max narrow the diff like an export.
+func getPriceDiff(c *gin.Context) {
+	ctx := c.Request.Context()
+	categories := streamCategories(c)
+	var bounds [2]*float64
+	for i, name := range []string{"min", "max"} {
+		if raw := c.Query(name); raw != "" {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				respondFilterError(c, &filterError{param: name, message: "must be a number"})
+				return
+			}
+			bounds[i] = &v
+		}
+	}
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	opts := exportOptions{format: formatZip, rounding: rounding, locale: machineLocale}
+
+	manifest := diffManifest{
+		Categories:  slices.Sorted(maps.Keys(categories)),
+		Min:         bounds[0],
+		Max:         bounds[1],
+		GeneratedAt: time.Now().UTC(),
+	}
+	var errs [2]error
+	manifest.FromSeq, manifest.From, errs[0] = diffPosition(ctx, c, "from", false)
+	if errs[0] == nil {
+		manifest.ToSeq, manifest.To, errs[1] = diffPosition(ctx, c, "to", true)
+	}
+	for _, err := range errs {
+		var fe *filterError
+		switch {
+		case err == nil:
+		case errors.As(err, &fe):
+			respondFilterError(c, err)
+			return
+		case errors.Is(err, pgx.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+			return
+		case errors.Is(err, errDiffPruned):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errNoPosition):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error() + "; name another upload or a time"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+			return
+		}
+	}
+	if manifest.ToSeq < manifest.FromSeq {
+		respondFilterError(c, &filterError{param: "to", message: "must not be before from"})
+		return
+	}
+
+	var horizon int64
+	var truncated bool
+	err = db.QueryRow(ctx,
+		`SELECT (SELECT seq FROM price_changes_horizon),
+			EXISTS (SELECT 1 FROM price_changes WHERE seq > $1 AND seq <= $2 AND op = 'truncate')`,
+		manifest.FromSeq, manifest.ToSeq).Scan(&horizon, &truncated)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	if manifest.FromSeq < horizon {
+		c.JSON(http.StatusGone, gin.H{"error": errDiffPruned.Error(), "oldest_from_seq": horizon})
+		return
+	}
+	// A truncate removes rows the feed never lists, so the span cannot be
+	// diffed from it.
+	if truncated {
+		c.JSON(http.StatusGone, gin.H{"error": "the table was replaced within this span; resync from a full export"})
+		return
+	}
+
+	// The categories are applied in the query as well, so rows of other
+	// categories are never read; an empty set reads none.
+	var allowed []string
+	if categories != nil {
+		allowed = append([]string{}, manifest.Categories...)
+	}
+	added, removed, err := diffRows(ctx, manifest.FromSeq, manifest.ToSeq, allowed, func(r priceRow) bool {
+		return (categories == nil || categories[r.category]) &&
+			(bounds[0] == nil || r.price >= *bounds[0]) && (bounds[1] == nil || r.price <= *bounds[1])
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	manifest.Added, manifest.Removed = len(added), len(removed)
+
+	archive, err := buildDiffArchive(added, removed, manifest, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build zip archive"})
+		return
+	}
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// diffRows nets out the changes of each row in (from, to]: a row that did
+// not exist at from and does at to is added, one that did and no longer
+// does is removed, and one replaced by a different version is both. Only
+// rows that were in one of categories at some point of the span are read;
+// nil reads every row.
+func diffRows(ctx context.Context, from, to int64, categories []string, keep func(priceRow) bool) ([]priceRow, []priceRow, error) {
+	rows, err := queryWithRetry(ctx, "diff",
+		`WITH span AS (
+			SELECT seq, op, price_id, data, old_data FROM price_changes WHERE seq > $1 AND seq <= $2 AND price_id IS NOT NULL
+				AND ($3::text[] IS NULL OR price_id IN (
+					SELECT price_id FROM price_changes WHERE seq > $1 AND seq <= $2
+						AND (data->>'category' = ANY($3) OR old_data->>'category' = ANY($3))))
+		)
+		SELECT f.price_id, f.op, f.data, f.old_data, p.op, p.data, l.op, l.data
+		FROM (SELECT DISTINCT ON (price_id) * FROM span ORDER BY price_id, seq) f
+		JOIN (SELECT DISTINCT ON (price_id) * FROM span ORDER BY price_id, seq DESC) l USING (price_id)
+		LEFT JOIN LATERAL (
+			SELECT op, data FROM price_changes
+			WHERE price_id = f.price_id AND seq <= $1 AND f.op = 'update' AND f.old_data IS NULL
+			ORDER BY seq DESC LIMIT 1
+		) p ON true
+		ORDER BY f.price_id`,
+		from, to, categories)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var added, removed []priceRow
+	for rows.Next() {
+		var id int64
+		var firstOp, lastOp string
+		var priorOp *string
+		var firstData, oldData, priorData, lastData []byte
+		if err := rows.Scan(&id, &firstOp, &firstData, &oldData, &priorOp, &priorData, &lastOp, &lastData); err != nil {
+			return nil, nil, err
+		}
+		// The row as it was at from: a delete logs it, an update logs it
+		// as old_data, or, when logged before old_data was, it is the last
+		// change up to from. A first insert means there was none.
+		beforeData := firstData
+		switch {
+		case firstOp == "insert":
+			beforeData = nil
+		case firstOp == "update" && oldData != nil:
+			beforeData = oldData
+		case firstOp == "update":
+			beforeData = nil
+			if priorOp != nil && *priorOp != "delete" {
+				beforeData = priorData
+			}
+		}
+		var before, after *priceRow
+		if beforeData != nil {
+			if before, err = decodeChangeRow(beforeData); err != nil {
+				return nil, nil, err
+			}
+		}
+		if lastOp != "delete" {
+			if after, err = decodeChangeRow(lastData); err != nil {
+				return nil, nil, err
+			}
+		}
+		if before != nil && after != nil && before.equal(*after) {
+			continue
+		}
+		if before != nil && keep(*before) {
+			removed = append(removed, *before)
+		}
+		if after != nil && keep(*after) {
+			added = append(added, *after)
+		}
+	}
+	return added, removed, rows.Err()
+}
+
+func decodeChangeRow(data []byte) (*priceRow, error) {
+	var r changeRow
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	row, err := r.priceRow()
+	return &row, err
+}
+
+// buildDiffArchive writes added.csv and removed.csv in the export's CSV
+// layout, and the manifest.
+func buildDiffArchive(added, removed []priceRow, manifest diffManifest, opts exportOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, file := range []struct {
+		name string
+		rows []priceRow
+	}{{"added.csv", added}, {"removed.csv", removed}} {
+		w, err := zipWriter.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write(exportCSVHeader)
+		for _, row := range file.rows {
+			csvWriter.Write(row.toCSV(opts))
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := zipWriter.Create(diffManifestName)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
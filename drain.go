@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type drainPhase int32
+
+const (
+	phaseServing drainPhase = iota
+	phaseRejectingWrites
+	phaseRejectingAll
+	phaseStopped
+)
+
+func (p drainPhase) String() string {
+	switch p {
+	case phaseServing:
+		return "serving"
+	case phaseRejectingWrites:
+		return "rejecting_writes"
+	case phaseRejectingAll:
+		return "rejecting_all"
+	default:
+		return "stopped"
+	}
+}
+
+// drainer tracks in-flight requests so shutdown can let long uploads and
+// exports finish instead of cutting them off at a fixed timeout.
+type drainer struct {
+	phase    atomic.Int32
+	inflight atomic.Int64
+}
+
+var drain drainer
+
+func (d *drainer) current() drainPhase {
+	return drainPhase(d.phase.Load())
+}
+
+func (d *drainer) setPhase(p drainPhase) {
+	d.phase.Store(int32(p))
+	log.Printf("Drain phase: %s (in-flight requests: %d)", p, d.inflight.Load())
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func drainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		phase := drain.current()
+		if phase >= phaseRejectingAll || (phase >= phaseRejectingWrites && isMutating(c.Request.Method)) {
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
+
+		drain.inflight.Add(1)
+		defer drain.inflight.Add(-1)
+		c.Next()
+	}
+}
+
+func readyz(c *gin.Context) {
+	phase := drain.current()
+	if phase != phaseServing {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": phase.String()})
+		return
+	}
+
+	if subsystems := degradedSubsystems(); len(subsystems) > 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "degraded", "degraded": subsystems})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": phase.String()})
+}
+
+// shutdown runs the two-phase drain: new writes are refused immediately,
+// reads keep working for cfg.drainReadWindow, and in-flight requests get up
+// to cfg.drainWriteTimeout to complete before the listener is closed.
+func (d *drainer) shutdown(srv *http.Server) error {
+	start := time.Now()
+	d.setPhase(phaseRejectingWrites)
+
+	readDeadline := start.Add(cfg.drainReadWindow)
+	writeDeadline := start.Add(cfg.drainWriteTimeout)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		if d.current() == phaseRejectingWrites && !now.Before(readDeadline) {
+			d.setPhase(phaseRejectingAll)
+		}
+		if d.current() == phaseRejectingAll && d.inflight.Load() == 0 {
+			break
+		}
+		if !now.Before(writeDeadline) {
+			log.Printf("Drain deadline exceeded with %d requests still in flight", d.inflight.Load())
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	d.setPhase(phaseStopped)
+	return err
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	formatZip  = "zip"
+	formatJSON = "json"
+	formatCSV  = "csv"
+	bundleTar  = "tar"
+	bundleFull = "full"
+)
+
+// exportMediaTypes are the Accept header types an export can answer with.
+// zip comes first, so */* and a request without Accept keep getting it.
+var exportMediaTypes = []string{"application/zip", "application/json", "text/csv", avroContentType}
+
+type priceRow struct {
+	id         int
+	name       string
+	category   string
+	price      float64
+	createDate time.Time
+	// externalID is only read when the export asks for it.
+	externalID *string
+}
+
+// equal compares two rows by value, external ids included.
+func (r priceRow) equal(o priceRow) bool {
+	if (r.externalID == nil) != (o.externalID == nil) || (r.externalID != nil && *r.externalID != *o.externalID) {
+		return false
+	}
+	return r.id == o.id && r.name == o.name && r.category == o.category && r.price == o.price && r.createDate.Equal(o.createDate)
+}
+
+// exportOptions are the query parameters that shape an export without
+// affecting which rows it contains.
+type exportOptions struct {
+	format   string
+	groupBy  string
+	rounding roundingMode
+	locale   exportLocale
+	// emptyNoContent answers 204 instead of an empty body when no rows match.
+	emptyNoContent bool
+	// bundle=tar splits a zip export into one zip per category inside a tar;
+	// bundle=full adds stats, categories and a manifest of the same
+	// snapshot to the zip.
+	bundle string
+	// externalID adds the external_id column, requested with
+	// fields=external_id.
+	externalID bool
+	// orderBy is the ORDER BY list of ?sort= and ?nulls=, ending in id.
+	orderBy string
+	// bom starts the CSV with a UTF-8 byte-order mark, without which Excel
+	// reads Cyrillic as another encoding.
+	bom bool
+	// redact hides the values of some columns, for sharing the export.
+	redact redaction
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// sortColumns are the fields ?sort= accepts, with whether they are
+// nullable.
+var sortColumns = map[string]bool{
+	"id": false, "name": false, "category": false, "price": false, "create_date": false,
+	"valid_from": true, "valid_to": true, "external_id": true,
+}
+
+// parseExportSort builds the ORDER BY list from ?sort=, fields separated by
+// commas and prefixed with - for descending order, and ?nulls=. Nullable
+// fields always get an explicit NULLS FIRST or LAST, last by default in
+// both directions, where PostgreSQL would put them first when descending;
+// ?nulls= without a nullable field to sort by is an error. id breaks ties so the order is total.
+func parseExportSort(c *gin.Context) (string, error) {
+	nulls := "LAST"
+	switch c.Query("nulls") {
+	case "", "last":
+	case "first":
+		nulls = "FIRST"
+	default:
+		return "", &filterError{param: "nulls", message: "must be one of first, last"}
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	sortsNullable := false
+	for _, field := range splitList(c.Query("sort")) {
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		nullable, ok := sortColumns[field]
+		if !ok {
+			return "", &filterError{param: "sort", message: fmt.Sprintf("unknown field %q", field)}
+		}
+		if seen[field] {
+			return "", &filterError{param: "sort", message: fmt.Sprintf("field %q is repeated", field)}
+		}
+		seen[field] = true
+
+		key := field
+		if field == "price" {
+			key = priceColumn()
+		}
+		if desc {
+			key += " DESC"
+		}
+		if nullable {
+			key += " NULLS " + nulls
+			sortsNullable = true
+		}
+		keys = append(keys, key)
+	}
+	if c.Query("nulls") != "" && !sortsNullable {
+		return "", &filterError{param: "nulls", message: "requires sorting by valid_from, valid_to or external_id"}
+	}
+	if !seen["id"] {
+		keys = append(keys, "id")
+	}
+	return strings.Join(keys, ", "), nil
+}
+
+// exportColumns is the select list of an export, in the order scanRow
+// reads it.
+func (opts exportOptions) exportColumns() string {
+	columns := "id, name, category, " + priceColumn() + ", create_date"
+	if opts.externalID {
+		columns += ", external_id"
+	}
+	return columns
+}
+
+func (opts exportOptions) scanRow(rows pgx.Rows) (priceRow, error) {
+	var row priceRow
+	dest := []interface{}{&row.id, &row.name, &row.category, &row.price, &row.createDate}
+	if opts.externalID {
+		dest = append(dest, &row.externalID)
+	}
+	err := rows.Scan(dest...)
+	opts.redact.apply(&row)
+	return row, err
+}
+
+func parseExportOptions(c *gin.Context) (exportOptions, error) {
+	var opts exportOptions
+
+	opts.format = c.Query("format")
+	if opts.format == "" {
+		opts.format = negotiateExportFormat(c)
+	}
+	if opts.format != formatZip && opts.format != formatJSON && opts.format != formatCSV && opts.format != formatAvro {
+		return opts, &filterError{param: "format", message: "must be one of zip, json, csv, avro"}
+	}
+
+	opts.groupBy = c.Query("group_by")
+	if opts.groupBy != "" {
+		if opts.groupBy != "category" {
+			return opts, &filterError{param: "group_by", message: "only category is supported"}
+		}
+		if opts.format != formatJSON {
+			return opts, &filterError{param: "group_by", message: "requires format=json"}
+		}
+	}
+
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		return opts, err
+	}
+	opts.rounding = rounding
+
+	opts.locale, err = parseExportLocale(c.Query("locale"))
+	if err != nil {
+		return opts, err
+	}
+	if c.Query("locale") != "" && !opts.csv() {
+		return opts, &filterError{param: "locale", message: "applies only to CSV exports"}
+	}
+
+	switch opts.bundle = c.Query("bundle"); opts.bundle {
+	case "":
+	case bundleTar, bundleFull:
+		if opts.format != formatZip {
+			return opts, &filterError{param: "bundle", message: "requires format=zip"}
+		}
+	default:
+		return opts, &filterError{param: "bundle", message: "must be one of tar, full"}
+	}
+
+	for _, field := range splitList(c.Query("fields")) {
+		if field != "external_id" {
+			return opts, &filterError{param: "fields", message: fmt.Sprintf("unknown field %q; only external_id can be added", field)}
+		}
+		if opts.format == formatAvro {
+			return opts, &filterError{param: "fields", message: "applies only to zip and json exports"}
+		}
+		opts.externalID = true
+	}
+
+	if opts.redact, err = parseRedaction(c.Query("redact"), c.Query("redact_with")); err != nil {
+		return opts, err
+	}
+	// Ordering by a hidden column would give its values away.
+	for _, field := range splitList(c.Query("sort")) {
+		if opts.redact.column(strings.TrimPrefix(field, "-")) {
+			return opts, &filterError{param: "sort", message: fmt.Sprintf("cannot sort by redacted field %q", strings.TrimPrefix(field, "-"))}
+		}
+	}
+	// So would filtering on one, a request per guess.
+	for _, column := range []string{"name", "external_id"} {
+		if !opts.redact.column(column) {
+			continue
+		}
+		if c.Query(column) != "" {
+			return opts, &filterError{param: column, message: fmt.Sprintf("cannot filter by redacted field %q", column)}
+		}
+		if q := c.Query("q"); q != "" {
+			if expr, err := parseFilterExpr(q); err == nil && expr.uses(column) {
+				return opts, &filterError{param: "q", message: fmt.Sprintf("cannot filter by redacted field %q", column)}
+			}
+		}
+	}
+	if opts.orderBy, err = parseExportSort(c); err != nil {
+		return opts, err
+	}
+
+	if opts.bom, err = parseBoolParam(c, "bom"); err != nil {
+		return opts, err
+	}
+	if opts.bom && !opts.csv() {
+		return opts, &filterError{param: "bom", message: "applies only to CSV exports"}
+	}
+
+	switch empty := c.Query("empty"); empty {
+	case "", opts.format:
+	case "204":
+		opts.emptyNoContent = true
+	default:
+		return opts, &filterError{param: "empty", message: "must be 204 or " + opts.format}
+	}
+
+	return opts, nil
+}
+
+// negotiateExportFormat picks the format of an export without ?format=
+// from the Accept header: the first listed type it can answer with, zip
+// when none is listed, so an export never fails on Accept alone.
+func negotiateExportFormat(c *gin.Context) string {
+	c.Header("Vary", "Accept")
+	switch c.NegotiateFormat(exportMediaTypes...) {
+	case "application/json":
+		return formatJSON
+	case "text/csv":
+		return formatCSV
+	case avroContentType:
+		return formatAvro
+	default:
+		return formatZip
+	}
+}
+
+// csv reports whether the export is written as CSV, bare or zipped.
+func (opts exportOptions) csv() bool {
+	return opts.format == formatZip || opts.format == formatCSV
+}
+
+type jsonPriceRow struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+	ExternalID *string `json:"external_id,omitempty"`
+}
+
+func (row priceRow) toJSON(rounding roundingMode) jsonPriceRow {
+	return jsonPriceRow{
+		ID:         row.id,
+		Name:       row.name,
+		Category:   row.category,
+		Price:      roundMoney(row.price, rounding),
+		CreateDate: row.createDate.Format("2006-01-02"),
+		ExternalID: row.externalID,
+	}
+}
+
+// jsonFlushEvery is how many rows are written between flushes of a
+// streamed JSON export.
+const jsonFlushEvery = 1000
+
+// streamJSONExport writes rows straight from the cursor so memory stays
+// bounded however large the export is. Grouped output relies on the rows
+// being ordered by category. Once the first byte is sent the status cannot
+// change, so a failure midway is only logged and the body is cut short.
+func streamJSONExport(c *gin.Context, rows pgx.Rows, opts exportOptions) {
+	defer rows.Close()
+
+	// The first row is fetched before anything is written so an empty
+	// result can still be answered with 204.
+	hasRow := rows.Next()
+	if !hasRow && rows.Err() == nil && opts.emptyNoContent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	grouped := opts.groupBy == "category"
+	if grouped {
+		c.Set(noWarningsContextKey, true)
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	if grouped {
+		c.Writer.WriteString("{")
+	} else {
+		c.Writer.WriteString("[")
+	}
+
+	count := 0
+	currentCategory := ""
+	for ; hasRow; hasRow = rows.Next() {
+		row, err := opts.scanRow(rows)
+		if err != nil {
+			log.Printf("JSON export aborted: %v", err)
+			return
+		}
+
+		switch {
+		case grouped && (count == 0 || row.category != currentCategory):
+			if count > 0 {
+				c.Writer.WriteString("],")
+			}
+			key, _ := json.Marshal(row.category)
+			c.Writer.Write(key)
+			c.Writer.WriteString(":[")
+			currentCategory = row.category
+		case count > 0:
+			c.Writer.WriteString(",")
+		}
+
+		if err := enc.Encode(row.toJSON(opts.rounding)); err != nil {
+			log.Printf("JSON export aborted: %v", err)
+			return
+		}
+
+		count++
+		if count%jsonFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("JSON export aborted: %v", err)
+		return
+	}
+
+	switch {
+	case grouped && count > 0:
+		c.Writer.WriteString("]}")
+	case grouped:
+		c.Writer.WriteString("}")
+	default:
+		c.Writer.WriteString("]")
+	}
+}
+
+// writeZipExport sends the rows as one zip and, given a cache key, keeps
+// the archive for repeat requests.
+func writeZipExport(c *gin.Context, priceRows []priceRow, opts exportOptions, cacheKey string) {
+	if len(priceRows) == 0 && opts.emptyNoContent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	archive, err := buildZipExport(priceRows, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build zip archive"})
+		return
+	}
+	if cacheKey != "" {
+		exportArchives.put(cacheKey, archive, len(priceRows))
+	}
+
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+var exportCSVHeader = []string{"id", "name", "category", "price", "create_date"}
+
+// csvHeader is exportCSVHeader with the columns the export added.
+func (opts exportOptions) csvHeader() []string {
+	if opts.externalID {
+		return append(slices.Clip(exportCSVHeader), "external_id")
+	}
+	return exportCSVHeader
+}
+
+func (row priceRow) toCSV(opts exportOptions) []string {
+	record := []string{
+		strconv.Itoa(row.id),
+		row.name,
+		row.category,
+		opts.locale.formatMoney(row.price, opts.rounding),
+		opts.locale.formatDate(row.createDate),
+	}
+	if opts.externalID {
+		externalID := ""
+		if row.externalID != nil {
+			externalID = *row.externalID
+		}
+		record = append(record, externalID)
+	}
+	return record
+}
+
+// newCSVWriter starts the data.csv of an export: the byte-order mark if
+// asked for, then the header.
+func (opts exportOptions) newCSVWriter(w io.Writer) *csv.Writer {
+	if opts.bom {
+		w.Write(utf8BOM)
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Comma = opts.locale.comma
+	csvWriter.Write(opts.csvHeader())
+	return csvWriter
+}
+
+// streamCSVExport writes format=csv exports, the data.csv of a zip export
+// without the archive, straight from the cursor like streamJSONExport.
+func streamCSVExport(c *gin.Context, rows pgx.Rows, opts exportOptions) {
+	defer rows.Close()
+
+	hasRow := rows.Next()
+	if !hasRow && rows.Err() == nil && opts.emptyNoContent {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	csvWriter := opts.newCSVWriter(c.Writer)
+	count := 0
+	for ; hasRow; hasRow = rows.Next() {
+		row, err := opts.scanRow(rows)
+		if err != nil {
+			log.Printf("CSV export aborted: %v", err)
+			return
+		}
+		csvWriter.Write(row.toCSV(opts))
+		if count++; count%jsonFlushEvery == 0 {
+			csvWriter.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("CSV export aborted: %v", err)
+		return
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Printf("CSV export aborted: %v", err)
+	}
+}
+
+// streamZipExport writes the rows read so far and the rest of the cursor
+// into a zip sent with chunked encoding, so memory stays bounded. As with
+// streamJSONExport, a failure midway is only logged and the archive is cut
+// short.
+func streamZipExport(c *gin.Context, buffered []priceRow, rows pgx.Rows, opts exportOptions) {
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	zipWriter := zip.NewWriter(c.Writer)
+	csvFile, err := zipWriter.Create("data.csv")
+	if err != nil {
+		log.Printf("Zip export aborted: %v", err)
+		return
+	}
+	csvWriter := opts.newCSVWriter(csvFile)
+	for _, row := range buffered {
+		csvWriter.Write(row.toCSV(opts))
+	}
+
+	for rows.Next() {
+		row, err := opts.scanRow(rows)
+		if err != nil {
+			log.Printf("Zip export aborted: %v", err)
+			return
+		}
+		csvWriter.Write(row.toCSV(opts))
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Zip export aborted: %v", err)
+		return
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Printf("Zip export aborted: %v", err)
+		return
+	}
+	if err := zipWriter.Close(); err != nil {
+		log.Printf("Zip export aborted: %v", err)
+	}
+}
+
+// buildZipExport returns a zip archive holding the rows as data.csv.
+func buildZipExport(priceRows []priceRow, opts exportOptions) ([]byte, error) {
+	var zipBuffer bytes.Buffer
+	zipWriter := zip.NewWriter(&zipBuffer)
+
+	csvFile, err := zipWriter.Create("data.csv")
+	if err != nil {
+		return nil, err
+	}
+
+	csvWriter := opts.newCSVWriter(csvFile)
+	for _, row := range priceRows {
+		csvWriter.Write(row.toCSV(opts))
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, err
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return zipBuffer.Bytes(), nil
+}
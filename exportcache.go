@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// exportCache keeps built zip exports in memory, least recently used first
+// out, up to EXPORT_CACHE_SIZE bytes; each entry expires after
+// EXPORT_CACHE_TTL. Keys include the change-log position, so a write made
+// through another instance also turns the entries into misses.
+type exportCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+}
+
+type exportCacheEntry struct {
+	key     string
+	data    []byte
+	rows    int
+	expires time.Time
+}
+
+var exportArchives = &exportCache{entries: make(map[string]*list.Element), order: list.New()}
+
+func exportCacheEnabled() bool {
+	return cfg.exportCacheSize > 0 && cfg.exportCacheTTL > 0
+}
+
+// exportCacheKey identifies an export by its query and arguments, which
+// carry the filters and the API key's categories, by the options that shape
+// the archive, and by the last change sequence number at query time.
+func exportCacheKey(query string, args []interface{}, opts exportOptions, seq int64) (string, error) {
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d\x00%s\x00%s\x00%#v", seq, query, encodedArgs, opts), nil
+}
+
+// currentChangeSeq returns the sequence number of the last change to the
+// prices table in the snapshot of tx, which the purge of old changes keeps
+// in the horizon.
+func currentChangeSeq(ctx context.Context, tx pgx.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(ctx,
+		"SELECT GREATEST((SELECT COALESCE(MAX(seq), 0) FROM price_changes), seq) FROM price_changes_horizon").Scan(&seq)
+	return seq, err
+}
+
+// get returns the archive and the number of rows in it.
+func (ec *exportCache) get(key string) ([]byte, int, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	el, ok := ec.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := el.Value.(*exportCacheEntry)
+	if time.Now().After(entry.expires) {
+		ec.remove(el)
+		return nil, 0, false
+	}
+	ec.order.MoveToFront(el)
+	return entry.data, entry.rows, true
+}
+
+// put stores the archive unless it alone is larger than the cache, evicting
+// the least recently used entries to make room.
+func (ec *exportCache) put(key string, data []byte, rows int) {
+	if len(data) > cfg.exportCacheSize {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if el, ok := ec.entries[key]; ok {
+		ec.remove(el)
+	}
+	for ec.size+len(data) > cfg.exportCacheSize {
+		ec.remove(ec.order.Back())
+	}
+	ec.entries[key] = ec.order.PushFront(&exportCacheEntry{key: key, data: data, rows: rows, expires: time.Now().Add(cfg.exportCacheTTL)})
+	ec.size += len(data)
+}
+
+func (ec *exportCache) remove(el *list.Element) {
+	entry := ec.order.Remove(el).(*exportCacheEntry)
+	delete(ec.entries, entry.key)
+	ec.size -= len(entry.data)
+}
+
+// purgeExpired drops the entries past their TTL and returns how many bytes
+// they held. A download being served keeps its own reference to the
+// archive, so dropping the entry never cuts it short.
+func (ec *exportCache) purgeExpired(now time.Time) (int, int64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	var n int
+	var freed int64
+	for el := ec.order.Back(); el != nil; {
+		prev := el.Prev()
+		if entry := el.Value.(*exportCacheEntry); now.After(entry.expires) {
+			freed += int64(len(entry.data))
+			n++
+			ec.remove(el)
+		}
+		el = prev
+	}
+	return n, freed
+}
+
+// purge drops every entry. Writes through this instance call it so the
+// memory is freed at once rather than when the entries age out.
+func (ec *exportCache) purge() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.entries = make(map[string]*list.Element)
+	ec.order.Init()
+	ec.size = 0
+}
+
+// serveCachedExport answers a zip export from the cache when it holds one
+// for the request. It returns the key to store a freshly built archive
+// under, or "" when the cache is off or the change position is unknown.
+func serveCachedExport(c *gin.Context, tx pgx.Tx, query string, args []interface{}, opts exportOptions) (string, bool) {
+	if !exportCacheEnabled() || opts.format != formatZip || opts.bundle != "" {
+		return "", false
+	}
+	var key string
+	seq, err := currentChangeSeq(c.Request.Context(), tx)
+	if err == nil {
+		key, err = exportCacheKey(query, args, opts, seq)
+	}
+	if err != nil {
+		log.Printf("Export cache bypassed: %v", err)
+		markDegraded(subsystemExportCache, err)
+		return "", false
+	}
+	markRecovered(subsystemExportCache)
+	if archive, rows, ok := exportArchives.get(key); ok {
+		usageFor(c).rowsExported += int64(rows)
+		c.Header("X-Export-Cache", "hit")
+		c.Data(http.StatusOK, "application/zip", archive)
+		return key, true
+	}
+	c.Header("X-Export-Cache", "miss")
+	return key, false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type extremePrice struct {
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+type categoryExtremes struct {
+	Category      string       `json:"category"`
+	Cheapest      extremePrice `json:"cheapest"`
+	MostExpensive extremePrice `json:"most_expensive"`
+}
+
+// getPriceExtremes returns the cheapest and the most expensive product of
+// every category among the rows matching the usual filters. Ties go to the
+// row inserted first.
+func getPriceExtremes(c *gin.Context) {
+	if by := c.DefaultQuery("by", "category"); by != "category" {
+		respondFilterError(c, &filterError{param: "by", message: "only category is supported"})
+		return
+	}
+
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	extreme := func(order string) string {
+		return "SELECT DISTINCT ON (category) category, name, " + priceColumn() + " AS price FROM prices WHERE 1=1" +
+			filter.sql() + " ORDER BY category, " + priceColumn() + " " + order + ", id"
+	}
+	query := "SELECT lo.category, lo.name, lo.price, hi.name, hi.price FROM (" + extreme("ASC") + ") lo JOIN (" +
+		extreme("DESC") + ") hi USING (category) ORDER BY lo.category"
+
+	rows, err := queryWithRetry(c.Request.Context(), "extremes", query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	result := []categoryExtremes{}
+	for rows.Next() {
+		var e categoryExtremes
+		if err := rows.Scan(&e.Category, &e.Cheapest.Name, &e.Cheapest.Price, &e.MostExpensive.Name, &e.MostExpensive.Price); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		e.Cheapest.Price = roundMoney(e.Cheapest.Price, rounding)
+		e.MostExpensive.Price = roundMoney(e.MostExpensive.Price, rounding)
+		result = append(result, e)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
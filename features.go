@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// featureAsyncUpload gates the resumable upload session routes. They
+// shipped before the flag, so it is on unless FEATURES turns it off.
+const featureAsyncUpload = "async_upload"
+
+// defaultFeatures are the flags FEATURES is applied on top of.
+var defaultFeatures = map[string]bool{featureAsyncUpload: true}
+
+// features holds an immutable snapshot of feature flags. Readers load the
+// pointer without locking; updates swap in a fresh copy.
+var features atomic.Pointer[map[string]bool]
+
+// loadFeatures parses FEATURES, a comma-separated list of name=bool pairs,
+// e.g. "async_upload=true,copy_export=false".
+func loadFeatures() {
+	flags := maps.Clone(defaultFeatures)
+	for _, pair := range strings.Split(envString("FEATURES", ""), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		enabled := true
+		if found {
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				log.Printf("Invalid value for feature %q: %q, treating as disabled", name, value)
+			}
+			enabled = b
+		}
+		flags[strings.TrimSpace(name)] = enabled
+	}
+	features.Store(&flags)
+}
+
+func featureEnabled(name string) bool {
+	return (*features.Load())[name]
+}
+
+func featureSnapshot() map[string]bool {
+	return maps.Clone(*features.Load())
+}
+
+func updateFeatures(overrides map[string]bool) map[string]bool {
+	for {
+		current := features.Load()
+		next := maps.Clone(*current)
+		maps.Copy(next, overrides)
+		if features.CompareAndSwap(current, &next) {
+			return maps.Clone(next)
+		}
+	}
+}
+
+// requireFeature hides a route behind a flag. Disabled routes answer exactly
+// like routes that were never registered, so it must come before any
+// middleware that could answer first.
+func requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !featureEnabled(name) {
+			notFound(c)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func notFound(c *gin.Context) {
+	c.String(http.StatusNotFound, "404 page not found")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The ?q= filter language:
+//
+//	expr       = and { "or" and }
+//	and        = term { "and" term }
+//	term       = "(" expr ")" | comparison
+//	comparison = field op value
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">="
+//	value      = number | 'quoted string' | "quoted string"
+//
+// Keywords are case-insensitive and fields are limited to filterExprFields.
+const (
+	maxFilterExprDepth   = 8
+	maxFilterExprClauses = 20
+)
+
+// filterExprFields lists the columns accepted in expressions together with
+// the parser for their literal values.
+var filterExprFields = map[string]func(string) (interface{}, error){
+	"id": func(s string) (interface{}, error) {
+		return strconv.ParseInt(s, 10, 64)
+	},
+	"name":     func(s string) (interface{}, error) { return s, nil },
+	"category": func(s string) (interface{}, error) { return s, nil },
+	"price": func(s string) (interface{}, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+	"create_date": func(s string) (interface{}, error) {
+		return time.Parse("2006-01-02", s)
+	},
+	"batch_id": func(s string) (interface{}, error) {
+		if !isUUID(s) {
+			return nil, fmt.Errorf("not a UUID")
+		}
+		return s, nil
+	},
+}
+
+type filterExpr interface {
+	compile(f *priceFilter) (string, error)
+	// uses reports whether a comparison in the expression reads field.
+	uses(field string) bool
+}
+
+type logicalExpr struct {
+	op          string
+	left, right filterExpr
+}
+
+func (e *logicalExpr) compile(f *priceFilter) (string, error) {
+	left, err := e.left.compile(f)
+	if err != nil {
+		return "", err
+	}
+	right, err := e.right.compile(f)
+	if err != nil {
+		return "", err
+	}
+	return "(" + left + " " + e.op + " " + right + ")", nil
+}
+
+func (e *logicalExpr) uses(field string) bool {
+	return e.left.uses(field) || e.right.uses(field)
+}
+
+type comparisonExpr struct {
+	field    string
+	op       string
+	value    string
+	position int
+}
+
+func (e *comparisonExpr) compile(f *priceFilter) (string, error) {
+	value, err := filterExprFields[e.field](e.value)
+	if err != nil {
+		return "", &filterError{param: "q", message: fmt.Sprintf("bad value %q for %s", e.value, e.field), position: e.position}
+	}
+	column := e.field
+	if column == "price" {
+		column = priceColumn()
+	}
+	return column + " " + e.op + " " + f.arg(value), nil
+}
+
+func (e *comparisonExpr) uses(field string) bool {
+	return e.field == field
+}
+
+type filterToken struct {
+	kind string // "ident", "op", "value", "(", ")", "eof"
+	text string
+	pos  int
+}
+
+func tokenizeFilterExpr(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filterToken{kind: string(r), text: string(r), pos: i})
+			i++
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, &filterError{param: "q", message: "expected != operator", position: start}
+			}
+			tokens = append(tokens, filterToken{kind: "op", text: op, pos: start})
+		case r == '\'' || r == '"':
+			start := i
+			i++
+			var sb strings.Builder
+			closed := false
+			for i < len(runes) {
+				if runes[i] == r {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &filterError{param: "q", message: "unterminated string", position: start}
+			}
+			tokens = append(tokens, filterToken{kind: "value", text: sb.String(), pos: start})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()=!<>'\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "ident", text: string(runes[start:i]), pos: start})
+		}
+	}
+	tokens = append(tokens, filterToken{kind: "eof", pos: len(runes)})
+	return tokens, nil
+}
+
+type filterExprParser struct {
+	tokens  []filterToken
+	pos     int
+	clauses int
+}
+
+func parseFilterExpr(input string) (filterExpr, error) {
+	tokens, err := tokenizeFilterExpr(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterExprParser{tokens: tokens}
+	expr, err := p.parseOr(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return expr, nil
+}
+
+func (p *filterExprParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterExprParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterExprParser) errorf(tok filterToken, format string, args ...interface{}) error {
+	return &filterError{param: "q", message: fmt.Sprintf(format, args...), position: tok.pos}
+}
+
+func (p *filterExprParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == "ident" && strings.EqualFold(tok.text, word)
+}
+
+func (p *filterExprParser) parseOr(depth int) (filterExpr, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterExprParser) parseAnd(depth int) (filterExpr, error) {
+	left, err := p.parseTerm(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseTerm(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterExprParser) parseTerm(depth int) (filterExpr, error) {
+	tok := p.peek()
+	if tok.kind == "(" {
+		if depth >= maxFilterExprDepth {
+			return nil, p.errorf(tok, "expression nested deeper than %d levels", maxFilterExprDepth)
+		}
+		p.next()
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, p.errorf(closing, "expected )")
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterExprParser) parseComparison() (filterExpr, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != "ident" {
+		return nil, p.errorf(fieldTok, "expected field name")
+	}
+	field := strings.ToLower(fieldTok.text)
+	if _, ok := filterExprFields[field]; !ok {
+		return nil, p.errorf(fieldTok, "unknown field %q", fieldTok.text)
+	}
+
+	opTok := p.next()
+	if opTok.kind != "op" {
+		return nil, p.errorf(opTok, "expected comparison operator")
+	}
+
+	valueTok := p.next()
+	if valueTok.kind != "value" && valueTok.kind != "ident" {
+		return nil, p.errorf(valueTok, "expected value")
+	}
+
+	p.clauses++
+	if p.clauses > maxFilterExprClauses {
+		return nil, p.errorf(fieldTok, "more than %d comparisons", maxFilterExprClauses)
+	}
+
+	op := opTok.text
+	if op == "!=" {
+		op = "<>"
+	}
+	return &comparisonExpr{field: field, op: op, value: valueTok.text, position: valueTok.pos}, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// priceFilter accumulates parameterized WHERE clauses over the prices table.
+// Every endpoint that selects rows builds its conditions here so values are
+// always passed as arguments and never interpolated into the SQL text.
+type priceFilter struct {
+	clauses []string
+	args    []interface{}
+}
+
+// arg registers a value and returns its positional placeholder.
+func (f *priceFilter) arg(value interface{}) string {
+	f.args = append(f.args, value)
+	return fmt.Sprintf("$%d", len(f.args))
+}
+
+// add appends a clause; each %s in format is replaced by a placeholder for
+// the matching value.
+func (f *priceFilter) add(format string, values ...interface{}) {
+	placeholders := make([]interface{}, len(values))
+	for i, value := range values {
+		placeholders[i] = f.arg(value)
+	}
+	f.clauses = append(f.clauses, fmt.Sprintf(format, placeholders...))
+}
+
+// clone returns a copy that clauses can be added to without changing f.
+func (f *priceFilter) clone() *priceFilter {
+	return &priceFilter{clauses: append([]string{}, f.clauses...), args: append([]interface{}{}, f.args...)}
+}
+
+// sql returns the accumulated clauses prefixed with AND, to follow a
+// "WHERE 1=1" base condition.
+func (f *priceFilter) sql() string {
+	var sb strings.Builder
+	for _, clause := range f.clauses {
+		sb.WriteString(" AND ")
+		sb.WriteString(clause)
+	}
+	return sb.String()
+}
+
+type filterError struct {
+	param    string
+	message  string
+	position int
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.param, e.message)
+}
+
+func respondFilterError(c *gin.Context, err error) {
+	fe, ok := err.(*filterError)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := gin.H{"error": fe.Error(), "param": fe.param}
+	if fe.param == "q" || fe.param == "transform" {
+		body["position"] = fe.position
+	}
+	c.JSON(http.StatusBadRequest, body)
+}
+
+// newPriceFilter starts a filter for the caller. Category restrictions of
+// the caller's API key are always applied, unless an admin lifts them on a
+// read with ?all=true, so other conditions can only narrow the result
+// further.
+func newPriceFilter(c *gin.Context) *priceFilter {
+	f := &priceFilter{}
+	if allowed := readCategories(c); allowed != nil {
+		f.add("category = ANY(%s)", allowed)
+	}
+	return f
+}
+
+// filterParam reads a filter query parameter, rejecting values longer than
+// limit bytes or containing control characters before they reach a parser
+// or the SQL.
+func filterParam(c *gin.Context, name string, limit int) (string, error) {
+	value := c.Query(name)
+	if len(value) > limit {
+		return "", &filterError{param: name, message: fmt.Sprintf("must be at most %d bytes", limit)}
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return "", &filterError{param: name, message: "must not contain control characters"}
+	}
+	return value, nil
+}
+
+// parsePriceFilter builds the row filter from the common query parameters.
+// At most FILTER_MAX_CLAUSES conditions are accepted, counting each
+// comparison in q; the category restriction of the API key is not counted.
+func parsePriceFilter(c *gin.Context) (*priceFilter, error) {
+	f := newPriceFilter(c)
+	restricted := len(f.args)
+
+	params := make(map[string]string)
+	for _, name := range []string{"start", "end", "min", "max", "batch_id", "valid_on", "external_id", "label", "q"} {
+		limit := cfg.filterMaxLength
+		if name == "q" {
+			limit = cfg.filterExprMaxLength
+		}
+		value, err := filterParam(c, name, limit)
+		if err != nil {
+			return nil, err
+		}
+		params[name] = value
+	}
+
+	if startDate := params["start"]; startDate != "" {
+		f.add("create_date >= %s", startDate)
+	}
+
+	if endDate := params["end"]; endDate != "" {
+		f.add("create_date <= %s", endDate)
+	}
+
+	if minPrice := params["min"]; minPrice != "" {
+		f.add(priceColumn()+" >= %s", minPrice)
+	}
+
+	if maxPrice := params["max"]; maxPrice != "" {
+		f.add(priceColumn()+" <= %s", maxPrice)
+	}
+
+	if batchID := params["batch_id"]; batchID != "" {
+		if !isUUID(batchID) {
+			return nil, &filterError{param: "batch_id", message: "must be a UUID"}
+		}
+		f.add("batch_id = %s", batchID)
+	}
+
+	if externalID := params["external_id"]; externalID != "" {
+		f.add("external_id = %s", externalID)
+	}
+
+	if label := params["label"]; label != "" {
+		f.add("labels @> ARRAY[%s]::text[]", label)
+	}
+
+	// Prices without a bound are valid from, or until, any date.
+	if validOn := params["valid_on"]; validOn != "" {
+		date, err := time.Parse(isoDateLayout, validOn)
+		if err != nil {
+			return nil, &filterError{param: "valid_on", message: "must be a date in YYYY-MM-DD format"}
+		}
+		p := f.arg(date)
+		f.clauses = append(f.clauses, fmt.Sprintf("(valid_from IS NULL OR valid_from <= %s) AND (valid_to IS NULL OR valid_to >= %s)", p, p))
+	}
+
+	if q := params["q"]; q != "" {
+		expr, err := parseFilterExpr(q)
+		if err != nil {
+			return nil, err
+		}
+		clause, err := expr.compile(f)
+		if err != nil {
+			return nil, err
+		}
+		f.clauses = append(f.clauses, clause)
+	}
+
+	// Every condition binds exactly one argument.
+	if active := len(f.args) - restricted; active > cfg.filterMaxClauses {
+		return nil, &filterError{param: "q", message: fmt.Sprintf("filter has %d conditions, more than the limit of %d", active, cfg.filterMaxClauses)}
+	}
+
+	return f, nil
+}
@@ -1,337 +1,859 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"net/http"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type priceRecord struct {
+	// id is the file's own id, kept with id_conflict=skip or error.
+	id         *int64
 	name       string
 	category   string
 	price      float64
 	createDate time.Time
+	dateLayout string
+	// validFrom and validTo bound the dates the price applies to; nil is
+	// open-ended.
+	validFrom, validTo *time.Time
+	// externalID is the client's own identifier of the row, "" if none.
+	externalID string
+	// file is the archive entry the row came from, and line its line there.
+	file string
+	line int
 }
 
 func uploadPrices(c *gin.Context) {
-	archiveType := c.Query("type")
-	if archiveType == "" {
-		archiveType = "zip"
-	}
-
-	fileHeader, err := c.FormFile("file")
+	opts, err := parseUploadOptions(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
+		respondUploadOptionsError(c, err)
 		return
 	}
 
-	file, err := fileHeader.Open()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unable to open uploaded file"})
-		return
+	streamUpload(c, opts, storeUpload)
+}
+
+// parsedUpload is what the CSV files of an upload yielded.
+type parsedUpload struct {
+	records        []priceRecord
+	rejected       map[string]int
+	skippedFiles   []skippedFile
+	headerFallback map[string][]string
+	// ruleRejections counts the rows each price rule rejected; warnings
+	// are the first rows advisory rules flagged, out of warningsCount.
+	ruleRejections map[int64]int
+	warnings       []priceWarning
+	warningsCount  int
+}
+
+// Codes of a 422 for an upload without a single CSV file.
+const (
+	codeEmptyArchive = "empty_archive"
+	codeNoCSVFound   = "no_csv_found"
+)
+
+// noCSVError rejects an upload in which no CSV file was parsed, so a caller
+// cannot mistake it for one that merely had no new rows. skipped lists the
+// entries there were, if any, with why each was not parsed.
+type noCSVError struct {
+	skipped []skippedFile
+}
+
+func (e *noCSVError) code() string {
+	if len(e.skipped) == 0 {
+		return codeEmptyArchive
 	}
-	defer file.Close()
+	return codeNoCSVFound
+}
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read file"})
-		return
+func (e *noCSVError) Error() string {
+	if len(e.skipped) == 0 {
+		return "archive has no entries"
 	}
+	return "archive has no CSV files"
+}
 
-	csvFiles := extractCSVFiles(data, archiveType)
-	if csvFiles == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read archive"})
+// processUpload parses, validates and inserts the CSV files of a spooled
+// archive and writes the upload summary.
+func processUpload(c *gin.Context, archive *spooledUpload, filename string, opts uploadOptions) {
+	parsed, err := parseUpload(archive, filename, opts)
+	if err != nil {
+		respondParseError(c, err)
 		return
 	}
+	storeUpload(c, parsed, filename, opts)
+}
 
-	var validRecords []priceRecord
-	for _, csvFile := range csvFiles {
-		csvReader := csv.NewReader(bytes.NewReader(csvFile.content))
-		csvRecords, err := csvReader.ReadAll()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to read csv file %s: %v", csvFile.name, err)})
-			return
-		}
-
-		if len(csvRecords) == 0 {
-			continue
-		}
+// parseUpload reads and validates every CSV row of the archive, or of the
+// upload itself with type=csv.
+func parseUpload(archive io.Reader, filename string, opts uploadOptions) (*parsedUpload, error) {
+	parsed := &parsedUpload{
+		rejected:       make(map[string]int),
+		headerFallback: make(map[string][]string),
+		ruleRejections: make(map[int64]int),
+		warnings:       []priceWarning{},
+	}
+	rules := validationRules{dateLayouts: opts.dateLayouts, columns: positionalColumns, transforms: opts.transforms, rounding: opts.rounding,
+		ids: opts.idConflict != idReassign}
+	detectedLayout := ""
+	csvFiles := 0
+	var err error
+	parsed.skippedFiles, err = walkCSVEntries(archive, filename, opts, func(name string, r io.Reader) error {
+		csvFiles++
+		csvReader := csv.NewReader(r)
+		// Rows may end before the optional columns; validateRecord checks
+		// each against the width of the mapping.
+		csvReader.FieldsPerRecord = -1
+		for i := 0; ; i++ {
+			record, err := csvReader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return &csvEntryError{name: name, err: err}
+			}
 
-		for i, record := range csvRecords {
 			if i == 0 {
+				if opts.header != headerNames {
+					rules.columns = positionalHeader(record)
+					continue
+				}
+				columns, fallback, err := mapHeader(name, record, opts.headerFallback)
+				if err != nil {
+					return err
+				}
+				rules.columns = columns
+				if len(fallback) > 0 {
+					parsed.headerFallback[name] = fallback
+				}
 				continue
 			}
 
-			if len(record) < 5 {
-				continue
+			rec, reason := validateRecord(record, rules)
+			rec.line, _ = csvReader.FieldPos(0)
+			if reason == rejectInvalidDate && detectedLayout != "" {
+				if _, _, ok := parseDate(strings.TrimSpace(record[rules.columns.createDate]), opts.dateLayouts); ok {
+					reason = rejectInconsistentDate
+				}
 			}
-
-			name := strings.TrimSpace(record[1])
-			category := strings.TrimSpace(record[2])
-			if name == "" || category == "" {
-				continue
+			if reason == "" && opts.consistentDates && detectedLayout == "" {
+				// The first valid row fixes the layout for the rest of the upload.
+				detectedLayout = rec.dateLayout
+				rules.dateLayouts = []string{detectedLayout}
 			}
-
-			price, err := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
-			if err != nil || price <= 0 {
-				continue
+			if reason == "" {
+				fired, advisories := opts.priceRules.check(rec.category, rec.price)
+				if fired != nil {
+					reason = rejectPriceOutOfBounds
+					parsed.ruleRejections[fired.ID]++
+				}
+				for _, rule := range advisories {
+					if parsed.warningsCount++; parsed.warningsCount <= maxPriceWarnings {
+						parsed.warnings = append(parsed.warnings, priceWarning{
+							File: name, Line: rec.line, RuleID: rule.ID, Name: rec.name, Category: rec.category, Price: rec.price,
+						})
+					}
+				}
 			}
-
-			createDate, err := time.Parse("2006-01-02", strings.TrimSpace(record[4]))
-			if err != nil {
+			if reason != "" {
+				parsed.rejected[reason]++
 				continue
 			}
-
-			validRecords = append(validRecords, priceRecord{
-				name:       name,
-				category:   category,
-				price:      price,
-				createDate: createDate,
-			})
+			rec.file = name
+			parsed.records = append(parsed.records, rec)
 		}
+	})
+	if err == nil && csvFiles == 0 && !opts.allowEmpty {
+		return nil, &noCSVError{skipped: parsed.skippedFiles}
 	}
+	return parsed, err
+}
 
-	tx, err := db.Begin(context.Background())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction"})
+func respondParseError(c *gin.Context, err error) {
+	var entryErr *csvEntryError
+	var headerErr *headerError
+	var noCSV *noCSVError
+	switch {
+	case errors.As(err, &noCSV):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": noCSV.Error(), "code": noCSV.code(), "skipped_files": noCSV.skipped})
+	case errors.As(err, &headerErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": headerErr.Error(), "missing_columns": headerErr.missing})
+	case errors.Is(err, errArchiveLimit) || errors.Is(err, errTempBudgetExceeded):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, errCorruptGzip), errors.Is(err, errCorruptArchive), errors.Is(err, errEmptyCSV):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errArchivePasswordRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errBadArchivePassword):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "bad_archive_password"})
+	case errors.As(err, &entryErr):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": entryErr.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read archive"})
+	}
+}
+
+// storeFunc writes the rows parsed from an upload and the response.
+type storeFunc func(c *gin.Context, parsed *parsedUpload, filename string, opts uploadOptions)
+
+// storeUpload inserts the parsed rows in one transaction and writes the
+// upload summary.
+func storeUpload(c *gin.Context, parsed *parsedUpload, filename string, opts uploadOptions) {
+	validRecords := parsed.records
+	rejected := parsed.rejected
+
+	if opts.strict && rejected[rejectInconsistentDate] > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":              "upload mixes date formats",
+			"inconsistent_dates": rejected[rejectInconsistentDate],
+		})
 		return
 	}
-	defer tx.Rollback(context.Background())
 
-	duplicatesCount := 0
-	insertedCount := 0
-	categories := make(map[string]bool)
-	var totalPrice float64
+	if err := checkWriteCategories(c, validRecords); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 
-	for _, rec := range validRecords {
-		var exists bool
-		err = tx.QueryRow(context.Background(),
-			"SELECT EXISTS(SELECT 1 FROM prices WHERE name = $1 AND category = $2 AND price = $3 AND create_date = $4)",
-			rec.name, rec.category, rec.price, rec.createDate).Scan(&exists)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+	totalCount := len(validRecords)
+	var conflictingIDs int
+	if opts.idConflict != idReassign {
+		var conflicts []conflictingID
+		before := len(validRecords)
+		validRecords, conflicts = dropConflictingIDs(validRecords)
+		conflictingIDs = before - len(validRecords)
+		if len(conflicts) > 0 && (opts.strict || opts.idConflict == idError) {
+			body := gin.H{"error": "ids are reused for rows with different content", "conflicting_ids_count": len(conflicts)}
+			body["conflicting_ids"] = conflicts[:min(len(conflicts), maxConflictingIDs)]
+			c.JSON(http.StatusUnprocessableEntity, body)
 			return
 		}
-
-		if exists {
-			duplicatesCount++
-			continue
+	}
+	duplicatesByScope := make(map[string]int)
+	var uploadDuplicates map[string]int
+	if opts.dedupScope != dedupTable {
+		before := validRecords
+		validRecords, duplicatesByScope[dedupUpload] = dedupeWithinUpload(validRecords, opts.dedupe == dedupeCI)
+		if opts.categoryBreakdown && duplicatesByScope[dedupUpload] > 0 {
+			uploadDuplicates = countByCategory(before)
+			for category, n := range countByCategory(validRecords) {
+				uploadDuplicates[category] -= n
+				if uploadDuplicates[category] == 0 {
+					delete(uploadDuplicates, category)
+				}
+			}
 		}
+	}
 
-		_, err = tx.Exec(context.Background(),
-			"INSERT INTO prices (name, category, price, create_date) VALUES ($1, $2, $3, $4)",
-			rec.name, rec.category, rec.price, rec.createDate)
+	batchID := uploadBatchID(c)
+
+	// The transaction is the retry unit: a failed attempt has rolled back
+	// everything it wrote, so it can start over from the same records.
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+
+	// An upload past its quarantine thresholds is staged for an admin to
+	// approve or reject instead; replace_all is already an admin's call.
+	if opts.mode == modeAppend {
+		reasons, err := checkQuarantine(ctx, opts.supplier, parsed, validRecords)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert record"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quarantine thresholds"})
+			return
+		}
+		if len(reasons) > 0 {
+			err := quarantineUpload(ctx, batchID, filename, opts, validRecords, totalCount, duplicatesByScope[dedupUpload], reasons)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to quarantine upload"})
+				return
+			}
+			var supplier interface{}
+			if opts.supplier != "" {
+				supplier = opts.supplier
+			}
+			summary := gin.H{
+				"batch_id":              batchID,
+				"supplier":              supplier,
+				"total_count":           totalCount,
+				"quarantined_count":     len(validRecords),
+				"duplicates_by_scope":   duplicatesByScope,
+				"rejected":              rejected,
+				"skipped_files":         parsed.skippedFiles,
+				"header_fallback":       parsed.headerFallback,
+				"price_rule_rejections": parsed.ruleRejections,
+				"warnings":              parsed.warnings,
+				"warnings_count":        parsed.warningsCount,
+				"metadata":              opts.metadata,
+			}
+			if opts.idConflict != idReassign {
+				summary["conflicting_ids"] = conflictingIDs
+			}
+			if opts.profile {
+				summary["profile"] = profileRecords(parsed.records, opts.rounding)
+			}
+			respondQuarantined(c, summary, reasons)
 			return
 		}
-
-		insertedCount++
-		categories[rec.category] = true
-		totalPrice += rec.price
 	}
 
-	if err = tx.Commit(context.Background()); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+	var stored storedUpload
+	var failedFiles []failedFile
+	var err error
+	if opts.parallelInsert > 0 {
+		stored, failedFiles, err = insertUploadParallel(ctx, batchID, validRecords, filename, opts, totalCount, duplicatesByScope[dedupUpload])
+	} else {
+		err = withRetry(ctx, "upload", func() error {
+			var err error
+			stored, err = insertUpload(batchID, validRecords, filename, opts, totalCount, duplicatesByScope[dedupUpload])
+			return err
+		})
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "25P03" {
+		log.Printf("Upload %s aborted by idle_in_transaction_session_timeout (%s)", batchID, cfg.uploadIdleTxTimeout)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "upload transaction was idle for too long and was aborted"})
+		return
+	}
+	var ice *idConflictError
+	if errors.As(err, &ice) {
+		body := gin.H{"error": ice.Error()}
+		if ice.externalID != "" {
+			body["external_id"] = ice.externalID
+		} else {
+			body["id"] = ice.id
+		}
+		c.JSON(http.StatusUnprocessableEntity, body)
+		return
+	}
+	var se *storeError
+	if errors.As(err, &se) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": se.message})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"total_count":      len(validRecords),
-		"duplicates_count": duplicatesCount,
-		"total_items":      insertedCount,
-		"total_categories": len(categories),
-		"total_price":      totalPrice,
-	})
-}
+	if stored.tableDuplicates > 0 {
+		duplicatesByScope[dedupTable] = stored.tableDuplicates
+	}
+	duplicatesCount := duplicatesByScope[dedupUpload] + stored.tableDuplicates
+	totalPrice := stored.totalPrice
+	if cfg.priceCents {
+		totalPrice = float64(stored.totalCents) / 100
+	}
 
-func getPrices(c *gin.Context) {
-	startDate := c.Query("start")
-	endDate := c.Query("end")
-	minPrice := c.Query("min")
-	maxPrice := c.Query("max")
+	usageFor(c).rowsInserted += int64(stored.insertedCount)
+	if stored.insertedCount > 0 {
+		categories := slices.Sorted(maps.Keys(stored.categories))
+		priceEvents.publish(batchEvent{
+			BatchID:       batchID,
+			InsertedCount: stored.insertedCount,
+			Categories:    categories,
+			Rows:          stored.rows,
+			RowsOmitted:   stored.rowsOmitted,
+			categoryRows:  stored.categories,
+		})
+		evaluateAlertsAsync(batchID, categories)
+	}
+	exportArchives.purge()
+
+	summary := gin.H{
+		"batch_id":                 batchID,
+		"status":                   "committed",
+		"total_count":              totalCount,
+		"duplicates_count":         duplicatesCount,
+		"duplicates_by_scope":      duplicatesByScope,
+		"total_items":              stored.insertedCount,
+		"total_categories":         len(stored.categories),
+		"total_price":              roundMoney(totalPrice, opts.rounding),
+		"rejected":                 rejected,
+		"skipped_files":            parsed.skippedFiles,
+		"skipped_known_categories": stored.skippedKnownCategories,
+		"header_fallback":          parsed.headerFallback,
+		"price_rule_rejections":    parsed.ruleRejections,
+		"warnings":                 parsed.warnings,
+		"warnings_count":           parsed.warningsCount,
+		"metadata":                 opts.metadata,
+		"conflict_retries":         conflictRetries.Load(),
+	}
+	if opts.mode == modeReplaceAll {
+		summary["deleted_count"] = stored.deletedCount
+		summary["inserted_count"] = stored.insertedCount
+	}
+	if opts.idConflict == idSkip || stored.idConflicts > 0 {
+		summary["id_conflicts"] = stored.idConflicts
+	}
+	if opts.idConflict != idReassign {
+		summary["conflicting_ids"] = conflictingIDs
+	}
+	if opts.onDuplicate == dupUpsertExternal {
+		summary["updated_count"] = stored.updatedCount
+	}
+	if opts.profile {
+		summary["profile"] = profileRecords(parsed.records, opts.rounding)
+	}
+	if opts.categoryBreakdown {
+		summary["by_category"] = breakdownByCategory(stored, uploadDuplicates)
+	}
+	if opts.parallelInsert > 0 {
+		summary["failed_files"] = failedFiles
+		if len(failedFiles) > 0 {
+			summary["status"] = "partial"
+			c.JSON(http.StatusMultiStatus, summary)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, summary)
+}
 
-	query := "SELECT id, name, category, price, create_date FROM prices WHERE 1=1"
-	args := []interface{}{}
-	argIndex := 1
+// storedUpload is what insertUpload wrote.
+type storedUpload struct {
+	deletedCount           int64
+	insertedCount          int
+	skippedKnownCategories int
+	tableDuplicates        int
+	// categories counts the inserted rows of each category, and
+	// categoryDuplicates the rows of each skipped as a duplicate of a
+	// stored one.
+	categories         map[string]int
+	categoryDuplicates map[string]int
+	totalPrice         float64
+	totalCents         int64
+	// rows are the inserted records for the live stream, kept only while
+	// there are at most STREAM_MAX_ROWS of them.
+	rows        []streamRow
+	rowsOmitted bool
+	// idConflicts counts rows skipped for a taken id or external id; maxID
+	// is the largest file id inserted.
+	idConflicts int
+	// updatedCount is the rows updated by external id.
+	updatedCount int
+	maxID        int64
+}
 
-	if startDate != "" {
-		query += fmt.Sprintf(" AND create_date >= $%d", argIndex)
-		args = append(args, startDate)
-		argIndex++
+// addInserted counts rec as inserted, in the totals of the summary and the
+// rows of the live stream.
+func (s *storedUpload) addInserted(rec priceRecord) {
+	s.insertedCount++
+	if s.insertedCount <= cfg.streamMaxRows {
+		s.rows = append(s.rows, streamRow{rec.name, rec.category, rec.price, rec.createDate.Format(isoDateLayout)})
+	} else {
+		s.rows, s.rowsOmitted = nil, true
 	}
+	s.categories[rec.category]++
+	s.totalPrice += rec.price
+	s.totalCents += toCents(rec.price)
+}
 
-	if endDate != "" {
-		query += fmt.Sprintf(" AND create_date <= $%d", argIndex)
-		args = append(args, endDate)
-		argIndex++
-	}
+// addDuplicate counts rec as skipped for a row already in the table.
+func (s *storedUpload) addDuplicate(rec priceRecord) {
+	s.tableDuplicates++
+	s.categoryDuplicates[rec.category]++
+}
 
-	if minPrice != "" {
-		query += fmt.Sprintf(" AND price >= $%d", argIndex)
-		args = append(args, minPrice)
-		argIndex++
-	}
+// storeError is a failure inside the upload transaction, carrying the
+// message for the client.
+type storeError struct {
+	message string
+	err     error
+}
 
-	if maxPrice != "" {
-		query += fmt.Sprintf(" AND price <= $%d", argIndex)
-		args = append(args, maxPrice)
-		argIndex++
-	}
+func (e *storeError) Error() string { return e.message + ": " + e.err.Error() }
+func (e *storeError) Unwrap() error { return e.err }
+
+// idConflictError fails an upload with id_conflict=error, on an id or,
+// when set, an external id.
+type idConflictError struct {
+	id         int64
+	externalID string
+}
 
-	query += " ORDER BY id"
+func (e *idConflictError) Error() string {
+	if e.externalID != "" {
+		return fmt.Sprintf("external_id %q is already in use", e.externalID)
+	}
+	return fmt.Sprintf("id %d is already in use", e.id)
+}
 
-	rows, err := db.Query(context.Background(), query, args...)
+// upsertExternal updates the row of a plain upload carrying rec's external
+// id to rec's content. found is false when no such row exists; updated is
+// false when it already had that content. The row keeps its batch id, so
+// rolling back this upload does not undo the update.
+func upsertExternal(tx pgx.Tx, rec priceRecord) (found, updated bool, err error) {
+	ctx := context.Background()
+	tag, err := tx.Exec(ctx,
+		`UPDATE prices SET name = $2, category = $3, price = $4, create_date = $5, name_norm = $6, price_cents = $7,
+			valid_from = $8, valid_to = $9
+		WHERE COALESCE(supplier, '') = '' AND external_id = $1
+			AND (name, category, price_cents, create_date, valid_from, valid_to) IS DISTINCT FROM ($2, $3, $7, $5, $8, $9)`,
+		rec.externalID, rec.name, rec.category, rec.price, rec.createDate, normalizeName(rec.name), toCents(rec.price), rec.validFrom, rec.validTo)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
-		return
+		return false, false, err
+	}
+	if tag.RowsAffected() > 0 {
+		return true, true, nil
 	}
+	err = tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM prices WHERE COALESCE(supplier, '') = '' AND external_id = $1)", rec.externalID).Scan(&found)
+	return found, false, err
+}
+
+// insertUpload writes the records and the uploads row in one transaction.
+// It either commits or rolls back before returning.
+func insertUpload(batchID string, records []priceRecord, filename string, opts uploadOptions, totalCount, uploadDuplicates int) (storedUpload, error) {
+	stored := storedUpload{categories: make(map[string]int), categoryDuplicates: make(map[string]int)}
 
-	type priceRow struct {
-		id         int
-		name       string
-		category   string
-		price      float64
-		createDate time.Time
+	tx, err := beginUploadTx()
+	if err != nil {
+		return stored, err
 	}
+	defer tx.Rollback(context.Background())
 
-	var priceRows []priceRow
-	for rows.Next() {
-		var row priceRow
-		err := rows.Scan(&row.id, &row.name, &row.category, &row.price, &row.createDate)
+	if opts.mode == modeReplaceAll {
+		err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM prices").Scan(&stored.deletedCount)
+		if err == nil {
+			_, err = tx.Exec(context.Background(), "TRUNCATE prices")
+		}
 		if err != nil {
-			rows.Close()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
-			return
+			return stored, &storeError{"failed to clear prices", err}
 		}
-		priceRows = append(priceRows, row)
 	}
-	rows.Close()
 
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
-		return
+	if err = insertRecords(tx, batchID, records, opts, &stored); err != nil {
+		return stored, err
 	}
-
-	var csvData [][]string
-	csvData = append(csvData, []string{"id", "name", "category", "price", "create_date"})
-	for _, row := range priceRows {
-		csvData = append(csvData, []string{
-			strconv.Itoa(row.id),
-			row.name,
-			row.category,
-			strconv.FormatFloat(row.price, 'f', 2, 64),
-			row.createDate.Format("2006-01-02"),
-		})
+	if err = recordUpload(tx, batchID, filename, opts, totalCount, stored.insertedCount, uploadDuplicates+stored.tableDuplicates); err != nil {
+		return stored, err
 	}
 
-	var zipBuffer bytes.Buffer
-	zipWriter := zip.NewWriter(&zipBuffer)
+	// A commit that lost its connection may have gone through, so it is
+	// never retried.
+	if err = tx.Commit(context.Background()); err != nil {
+		return stored, &permanentError{&storeError{"failed to commit transaction", err}}
+	}
+	return stored, nil
+}
 
-	csvFile, err := zipWriter.Create("data.csv")
+// beginUploadTx starts a transaction that writes upload rows. It is read
+// committed, so the duplicate checks see rows other uploads commit
+// meanwhile and concurrent uploads do not fail each other with
+// serialization errors; exports read their own snapshot and never wait on
+// it.
+func beginUploadTx() (pgx.Tx, error) {
+	tx, err := db.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create csv file in zip"})
-		return
+		return nil, &storeError{"failed to start transaction", err}
 	}
 
-	csvWriter := csv.NewWriter(csvFile)
-	for _, record := range csvData {
-		if err := csvWriter.Write(record); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to write csv data"})
-			return
+	// A handler stuck between statements must not hold the upload's locks
+	// forever: PostgreSQL ends the session once it idles this long.
+	if cfg.uploadIdleTxTimeout > 0 {
+		_, err = tx.Exec(context.Background(), "SELECT set_config('idle_in_transaction_session_timeout', $1, true)",
+			strconv.FormatInt(cfg.uploadIdleTxTimeout.Milliseconds(), 10))
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, &storeError{"database error", err}
 		}
 	}
-	csvWriter.Flush()
-
-	if err := zipWriter.Close(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to close zip writer"})
-		return
+	// Uploads update rows by external id and may truncate the table, so
+	// the change feed lock comes first, as in every writer.
+	if err = lockChangeFeed(context.Background(), tx); err != nil {
+		tx.Rollback(context.Background())
+		return nil, &storeError{"database error", err}
 	}
-
-	c.Data(http.StatusOK, "application/zip", zipBuffer.Bytes())
+	return tx, nil
 }
 
-type csvFileData struct {
-	name    string
-	content []byte
-}
+// insertRecords inserts the records in tx, adding what it wrote to stored.
+func insertRecords(tx pgx.Tx, batchID string, records []priceRecord, opts uploadOptions, stored *storedUpload) error {
+	var err error
+
+	// Categories are looked up once before inserting, so rows of a new
+	// category are not skipped after its first row goes in.
+	knownCategories := make(map[string]bool)
+	if opts.onlyNewCategories {
+		knownCategories, err = existingCategories(tx, records)
+		if err != nil {
+			return &storeError{"database error", err}
+		}
+	}
 
-func extractCSVFiles(data []byte, archiveType string) []csvFileData {
-	var csvFiles []csvFileData
+	if cfg.uploadCopy && copyEligible(records, opts) {
+		return copyRecords(tx, batchID, records, opts, knownCategories, stored)
+	}
 
-	if archiveType == "tar" {
-		tarReader := tar.NewReader(bytes.NewReader(data))
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
+	// With upsert_external, a second row of this upload for an external id
+	// is a conflict, not an update of the first.
+	seenExternal := make(map[string]bool)
+	for _, rec := range records {
+		if knownCategories[rec.category] {
+			stored.skippedKnownCategories++
+			continue
+		}
+
+		if rec.externalID != "" && opts.onDuplicate == dupUpsertExternal {
+			if seenExternal[rec.externalID] {
+				if opts.idConflict == idError {
+					return &idConflictError{externalID: rec.externalID}
+				}
+				stored.idConflicts++
+				continue
 			}
+			seenExternal[rec.externalID] = true
+
+			found, updated, err := upsertExternal(tx, rec)
 			if err != nil {
-				return nil
+				return &storeError{"failed to update record", err}
 			}
-
-			if header.Typeflag != tar.TypeReg {
+			if updated {
+				stored.updatedCount++
 				continue
 			}
-
-			fileName := filepath.Base(header.Name)
-			if strings.HasPrefix(fileName, "._") {
+			if found {
+				stored.addDuplicate(rec)
 				continue
 			}
+		} else if opts.dedupScope != dedupUpload && rec.externalID == "" {
+			priceMatch, priceArg := "price = $3", interface{}(rec.price)
+			if cfg.priceCents {
+				priceMatch, priceArg = "price_cents = $3", toCents(rec.price)
+			}
 
-			if !strings.HasSuffix(strings.ToLower(header.Name), ".csv") {
-				continue
+			// Rows inserted earlier in this transaction are visible here, so
+			// the check also catches repeats within the upload.
+			identityMatch := "name = $1 AND category = $2"
+			if opts.dedupe == dedupeCI {
+				identityMatch = "lower(name) = lower($1) AND lower(category) = lower($2)"
 			}
 
-			limitedReader := io.LimitReader(tarReader, header.Size)
-			content, err := io.ReadAll(limitedReader)
+			var exists bool
+			err = tx.QueryRow(context.Background(),
+				"SELECT EXISTS(SELECT 1 FROM prices WHERE "+identityMatch+" AND "+priceMatch+" AND create_date BETWEEN $4 AND $5)",
+				rec.name, rec.category, priceArg,
+				rec.createDate.AddDate(0, 0, -opts.dateToleranceDays),
+				rec.createDate.AddDate(0, 0, opts.dateToleranceDays)).Scan(&exists)
 			if err != nil {
-				return nil
+				return &storeError{"database error", err}
+			}
+
+			if exists {
+				stored.addDuplicate(rec)
+				continue
 			}
+		}
 
-			csvFiles = append(csvFiles, csvFileData{name: header.Name, content: content})
+		// The file's id is kept unless the policy is reassign; ids and
+		// external ids of rows inserted earlier in this transaction count
+		// as taken.
+		var id, externalID interface{}
+		if rec.id != nil && opts.idConflict != idReassign {
+			id = *rec.id
+		}
+		if rec.externalID != "" {
+			externalID = rec.externalID
+		}
+		insert := "INSERT INTO prices (name, category, price, create_date, batch_id, name_norm, price_cents, valid_from, valid_to, id, external_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE($10, nextval(pg_get_serial_sequence('prices', 'id'))), $11)"
+		if opts.idConflict != idError && (id != nil || externalID != nil) {
+			insert += " ON CONFLICT DO NOTHING"
+		}
+		tag, err := tx.Exec(context.Background(), insert,
+			rec.name, rec.category, rec.price, rec.createDate, batchID, normalizeName(rec.name), toCents(rec.price), rec.validFrom, rec.validTo, id, externalID)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			switch pgErr.ConstraintName {
+			case "prices_pkey":
+				return &idConflictError{id: *rec.id}
+			case "prices_external_id_idx":
+				return &idConflictError{externalID: rec.externalID}
+			}
 		}
-	} else {
-		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 		if err != nil {
-			return nil
+			return &storeError{"failed to insert record", err}
+		}
+		if tag.RowsAffected() == 0 {
+			stored.idConflicts++
+			continue
+		}
+		if id != nil {
+			stored.maxID = max(stored.maxID, *rec.id)
 		}
 
-		for _, file := range zipReader.File {
-			fileName := filepath.Base(file.Name)
-			if strings.HasPrefix(fileName, "._") {
-				continue
-			}
+		stored.addInserted(rec)
+	}
 
-			if !strings.HasSuffix(strings.ToLower(file.Name), ".csv") {
-				continue
-			}
+	// Rows the database numbers later must not run into the kept ids.
+	if stored.maxID > 0 {
+		_, err = tx.Exec(context.Background(),
+			"SELECT setval(s, $1) FROM pg_get_serial_sequence('prices', 'id') s WHERE $1 > COALESCE(pg_sequence_last_value(s::regclass), 0)",
+			stored.maxID)
+		if err != nil {
+			return &storeError{"database error", err}
+		}
+	}
 
-			rc, err := file.Open()
-			if err != nil {
-				return nil
-			}
+	return nil
+}
 
-			content, err := io.ReadAll(rc)
-			rc.Close()
-			if err != nil {
-				return nil
-			}
+// recordUpload writes the uploads row of the batch and forgets its attempt.
+func recordUpload(tx pgx.Tx, batchID, filename string, opts uploadOptions, totalCount, insertedCount, duplicatesCount int) error {
+	_, err := tx.Exec(context.Background(),
+		"INSERT INTO uploads (batch_id, filename, archive_type, total_count, inserted_count, duplicates_count, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		batchID, filename, opts.archiveType, totalCount, insertedCount, duplicatesCount, opts.metadata)
+	if err != nil {
+		return &storeError{"failed to record upload", err}
+	}
+	if _, err = tx.Exec(context.Background(), "DELETE FROM upload_attempts WHERE batch_id = $1", batchID); err != nil {
+		return &storeError{"failed to record upload", err}
+	}
+	return nil
+}
+
+// existingCategories returns which of the records' categories already have
+// rows in the table.
+func existingCategories(tx pgx.Tx, records []priceRecord) (map[string]bool, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		if !seen[rec.category] {
+			seen[rec.category] = true
+			names = append(names, rec.category)
+		}
+	}
+
+	rows, err := tx.Query(context.Background(), "SELECT DISTINCT category FROM prices WHERE category = ANY($1)", names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-			csvFiles = append(csvFiles, csvFileData{name: file.Name, content: content})
+	known := make(map[string]bool)
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
 		}
+		known[category] = true
 	}
+	return known, rows.Err()
+}
 
-	return csvFiles
+func getPrices(c *gin.Context) {
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	opts, err := parseExportOptions(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	query := "SELECT " + opts.exportColumns() + " FROM prices WHERE 1=1" + filter.sql()
+	// Grouped exports rely on the rows coming category by category.
+	if opts.groupBy == "category" || opts.bundle == bundleTar {
+		query += " ORDER BY category, " + opts.orderBy
+	} else {
+		query += " ORDER BY " + opts.orderBy
+	}
+
+	explain, err := parseBoolParam(c, "explain")
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	if explain {
+		c.JSON(http.StatusOK, gin.H{"sql": query, "args": filter.args})
+		return
+	}
+	logQuery("getPrices", query, filter.args)
+
+	// The export reads one repeatable-read snapshot: the change seq its cache
+	// entry is keyed on matches the rows, the rows never show an upload
+	// halfway, and no writer waits for it however long it streams.
+	ctx := c.Request.Context()
+	var tx pgx.Tx
+	err = withRetry(ctx, "export", func() error {
+		var err error
+		tx, err = db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	cacheKey, served := serveCachedExport(c, tx, query, filter.args, opts)
+	if served {
+		return
+	}
+
+	rows, err := tx.Query(ctx, query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	rows = meteredRows{rows, usageFor(c)}
+
+	if opts.format == formatJSON {
+		streamJSONExport(c, rows, opts)
+		return
+	}
+	if opts.format == formatAvro {
+		streamAvroExport(c, rows, opts)
+		return
+	}
+	if opts.format == formatCSV {
+		streamCSVExport(c, rows, opts)
+		return
+	}
+	if opts.bundle == bundleFull {
+		streamFullBundle(c, tx, rows, filter, opts)
+		return
+	}
+
+	var priceRows []priceRow
+	for rows.Next() {
+		row, err := opts.scanRow(rows)
+		if err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		priceRows = append(priceRows, row)
+
+		// Up to EXPORT_BUFFER_ROWS rows are buffered so a small archive is
+		// sent with Content-Length; a larger one is streamed from the cursor.
+		if opts.bundle == "" && len(priceRows) > cfg.exportBufferRows {
+			streamZipExport(c, priceRows, rows, opts)
+			return
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	if opts.bundle == bundleTar {
+		writeTarBundle(c, priceRows, opts)
+		return
+	}
+	writeZipExport(c, priceRows, opts, cacheKey)
 }
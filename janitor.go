@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// janitorRun is what one sweep reclaimed.
+type janitorRun struct {
+	StartedAt         time.Time `json:"started_at"`
+	DurationMS        int64     `json:"duration_ms"`
+	TempFiles         int       `json:"temp_files"`
+	TempFileBytes     int64     `json:"temp_file_bytes"`
+	Sessions          int       `json:"sessions"`
+	SessionBytes      int64     `json:"session_bytes"`
+	CachedExports     int       `json:"cached_exports"`
+	CachedExportBytes int64     `json:"cached_export_bytes"`
+	UploadAttempts    int64     `json:"upload_attempts"`
+	Errors            []string  `json:"errors,omitempty"`
+}
+
+func (r *janitorRun) reclaimedBytes() int64 {
+	return r.TempFileBytes + r.SessionBytes + r.CachedExportBytes
+}
+
+type janitorStats struct {
+	Runs           int64       `json:"runs"`
+	ReclaimedBytes int64       `json:"reclaimed_bytes"`
+	TempFiles      int64       `json:"temp_files"`
+	Sessions       int64       `json:"sessions"`
+	CachedExports  int64       `json:"cached_exports"`
+	UploadAttempts int64       `json:"upload_attempts"`
+	LastRun        *janitorRun `json:"last_run"`
+}
+
+// janitor serialises sweeps, so a manual run never overlaps the periodic
+// one, and keeps their totals for the admin metrics.
+var janitor struct {
+	mu    sync.Mutex
+	stats janitorStats
+}
+
+// sweep removes what has outlived its retention: orphaned temporary files,
+// expired upload sessions, expired export cache entries and the failed
+// upload attempts kept for the uploads list.
+func sweep(ctx context.Context) janitorRun {
+	janitor.mu.Lock()
+	defer janitor.mu.Unlock()
+
+	now := time.Now()
+	run := janitorRun{StartedAt: now.UTC()}
+	run.TempFiles, run.TempFileBytes = removeOrphanedTempFiles(now, &run)
+	run.Sessions, run.SessionBytes = uploadSessions.expire(now)
+	run.CachedExports, run.CachedExportBytes = exportArchives.purgeExpired(now)
+	if cfg.attemptRetention > 0 && !dbReadOnly.Load() {
+		tag, err := db.Exec(ctx,
+			"DELETE FROM upload_attempts WHERE status = 'failed' AND finished_at < now() - make_interval(secs => $1)",
+			cfg.attemptRetention.Seconds())
+		if err != nil {
+			run.Errors = append(run.Errors, "upload attempts: "+err.Error())
+		} else {
+			run.UploadAttempts = tag.RowsAffected()
+		}
+	}
+	run.DurationMS = time.Since(now).Milliseconds()
+
+	s := &janitor.stats
+	s.Runs++
+	s.ReclaimedBytes += run.reclaimedBytes()
+	s.TempFiles += int64(run.TempFiles)
+	s.Sessions += int64(run.Sessions)
+	s.CachedExports += int64(run.CachedExports)
+	s.UploadAttempts += run.UploadAttempts
+	s.LastRun = &run
+
+	if run.TempFiles+run.Sessions+run.CachedExports > 0 || run.UploadAttempts > 0 {
+		log.Printf("Janitor reclaimed %d bytes: %d temporary files, %d upload sessions, %d cached exports; removed %d failed upload attempts",
+			run.reclaimedBytes(), run.TempFiles, run.Sessions, run.CachedExports, run.UploadAttempts)
+	}
+	for _, e := range run.Errors {
+		log.Printf("Janitor: %s", e)
+	}
+	return run
+}
+
+// removeOrphanedTempFiles removes spooled uploads and session files left in
+// the temporary directory by a process that died, once unmodified for
+// TEMP_FILE_RETENTION. Files this process still has open are skipped
+// whatever their age; a file another process just created is too new to
+// qualify.
+func removeOrphanedTempFiles(now time.Time, run *janitorRun) (int, int64) {
+	if cfg.tempFileRetention <= 0 {
+		return 0, 0
+	}
+	var n int
+	var freed int64
+	for _, pattern := range []string{uploadTempPattern, sessionTempPattern} {
+		paths, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err != nil {
+			run.Errors = append(run.Errors, "temporary files: "+err.Error())
+			continue
+		}
+		for _, path := range paths {
+			if _, live := liveTempFiles.Load(path); live {
+				continue
+			}
+			info, err := os.Lstat(path)
+			if err != nil || !info.Mode().IsRegular() || now.Sub(info.ModTime()) < cfg.tempFileRetention {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					run.Errors = append(run.Errors, "temporary files: "+err.Error())
+				}
+				continue
+			}
+			n++
+			freed += info.Size()
+		}
+	}
+	return n, freed
+}
+
+// runJanitor sweeps every JANITOR_INTERVAL until ctx is cancelled.
+func runJanitor(ctx context.Context) {
+	if cfg.janitorInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sweep(ctx)
+	}
+}
+
+func janitorSnapshot() janitorStats {
+	janitor.mu.Lock()
+	defer janitor.mu.Unlock()
+	return janitor.stats
+}
+
+// postJanitorRun sweeps at once, for when the disk fills up before the next
+// scheduled run, and returns what was reclaimed.
+func postJanitorRun(c *gin.Context) {
+	c.JSON(http.StatusOK, sweep(c.Request.Context()))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxLabelLength bounds a label in bytes.
+const maxLabelLength = 64
+
+// labelPrices adds the label in the JSON body to every row matching the
+// export filters in the query, and reports how many rows it was added to.
+// Rows that already carry it are left alone, so repeating the request
+// changes nothing, and so retrying it after a deadlock is safe.
+func labelPrices(c *gin.Context) {
+	var body struct {
+		Label string `json:"label"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	label := strings.TrimSpace(body.Label)
+	if label == "" || len(label) > maxLabelLength || strings.IndexFunc(label, unicode.IsControl) >= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "label must be between 1 and 64 bytes without control characters"})
+		return
+	}
+
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	p := filter.arg(label)
+	where := "NOT labels @> ARRAY[" + p + "]::text[]" + filter.sql()
+	query := "UPDATE prices SET labels = array_append(labels, " + p + ") WHERE " + where
+	logQuery("labelPrices", query, filter.args)
+
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+	var labeled int64
+	err = withRetry(ctx, "label", func() error {
+		return pgx.BeginFunc(context.Background(), db, func(tx pgx.Tx) error {
+			if err := lockPrices(context.Background(), tx, where, filter.args...); err != nil {
+				return err
+			}
+			tag, err := tx.Exec(context.Background(), query, filter.args...)
+			labeled = tag.RowsAffected()
+			return err
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to label records"})
+		return
+	}
+	exportArchives.purge()
+
+	c.JSON(http.StatusOK, gin.H{"label": label, "labeled_count": labeled, "conflict_retries": conflictRetries.Load()})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getLimits lets clients discover the limits requests are checked against
+// instead of learning them from 400 and 413 responses.
+func getLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"filters": gin.H{
+			"max_param_length":       cfg.filterMaxLength,
+			"max_expression_length":  cfg.filterExprMaxLength,
+			"max_clauses":            cfg.filterMaxClauses,
+			"max_expression_depth":   maxFilterExprDepth,
+			"max_expression_clauses": maxFilterExprClauses,
+		},
+		"uploads": gin.H{
+			"max_field_size":        cfg.maxFieldSize,
+			"min_price":             cfg.minPrice,
+			"max_archive_files":     cfg.maxArchiveFiles,
+			"max_uncompressed_size": cfg.maxUncompressedSize,
+			"max_compression_ratio": cfg.maxCompressionRatio,
+			"max_form_field_size":   maxFormFieldSize,
+		},
+		"exports": gin.H{
+			"aggregate_max_groups":  cfg.aggregateMaxGroups,
+			"bundle_max_categories": cfg.exportMaxCategories,
+			"names_max_limit":       maxNamesLimit,
+		},
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// exportLocale controls how human-facing CSV exports render numbers and
+// dates. The zero-value locale is the machine format.
+type exportLocale struct {
+	comma      rune
+	decimalSep string
+	dateLayout string
+}
+
+var machineLocale = exportLocale{comma: ',', decimalSep: ".", dateLayout: "2006-01-02"}
+
+// exportLocales is the explicit set accepted by ?locale=.
+var exportLocales = map[string]exportLocale{
+	// Russian-locale Excel expects comma decimals and splits on semicolons.
+	"ru": {comma: ';', decimalSep: ",", dateLayout: "02.01.2006"},
+}
+
+func parseExportLocale(raw string) (exportLocale, error) {
+	if raw == "" {
+		return machineLocale, nil
+	}
+	locale, ok := exportLocales[raw]
+	if !ok {
+		return exportLocale{}, &filterError{param: "locale", message: "must be one of ru"}
+	}
+	return locale, nil
+}
+
+func (l exportLocale) formatMoney(v float64, mode roundingMode) string {
+	return strings.Replace(formatMoney(v, mode), ".", l.decimalSep, 1)
+}
+
+func (l exportLocale) formatDate(t time.Time) string {
+	return t.Format(l.dateLayout)
+}
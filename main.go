@@ -1,30 +1,95 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"os"
-
-	"github.com/gin-gonic/gin"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		err = runBench(os.Args[2:])
+	} else {
+		testDB := flag.Bool("test-db", false, "check the connection to DATABASE_URL and exit, without starting the server or migrating")
+		flag.Parse()
+		if *testDB {
+			err = runTestDB()
+		} else {
+			err = run()
+		}
+	}
+	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
 
 func run() error {
+	loadConfig()
+
 	connectDB()
 	defer closeDB()
 
-	if err := initDB(); err != nil {
+	readOnly, err := detectReadOnly()
+	if err != nil {
 		return err
 	}
+	if readOnly {
+		dbReadOnly.Store(true)
+		log.Printf("WARNING: the database is read-only (standby or default_transaction_read_only); " +
+			"migrations are skipped and uploads and other writes will be refused with 503")
+	} else {
+		if err := initDB(); err != nil {
+			return err
+		}
+		recoverInterruptedUploads(context.Background(), true)
+	}
+
+	r, err := newRouter()
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: cfg.addr, Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", cfg.addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	r := gin.Default()
-	r.POST("/api/v0/prices", uploadPrices)
-	r.GET("/api/v0/prices", getPrices)
+	go uploadSessions.reapExpired(ctx)
+	go pruneChanges(ctx)
+	go watchUploadAttempts(ctx)
+	go flushUsage(ctx)
+	go runJanitor(ctx)
 
-	return r.Run()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	priceEvents.shutdown()
+	if err := drain.shutdown(srv); err != nil {
+		return err
+	}
+	alertEvaluations.Wait()
+	if !dbReadOnly.Load() {
+		if err := usage.flush(context.Background()); err != nil {
+			log.Printf("Flushing usage failed: %v", err)
+		}
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heapMetric is the memory held by heap objects, live or not yet swept.
+// Reading it does not stop the world as runtime.ReadMemStats does.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// heapSampleEvery is how long a heap reading is reused, so a burst of
+// requests reads the runtime metrics once.
+const heapSampleEvery = 100 * time.Millisecond
+
+// memoryGuard is crude admission control: a heavy request arriving while
+// the heap is above MEMORY_GUARD_BYTES is refused with 503 rather than
+// started and risking the whole process.
+type memoryGuard struct {
+	mu       sync.Mutex
+	sample   []metrics.Sample
+	sampled  time.Time
+	heap     uint64
+	rejected atomic.Int64
+}
+
+var memGuard = &memoryGuard{sample: []metrics.Sample{{Name: heapMetric}}}
+
+func (g *memoryGuard) heapBytes() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.sampled) >= heapSampleEvery {
+		metrics.Read(g.sample)
+		if g.sample[0].Value.Kind() == metrics.KindUint64 {
+			g.heap = g.sample[0].Value.Uint64()
+		}
+		g.sampled = time.Now()
+	}
+	return g.heap
+}
+
+// requireMemoryHeadroom guards the routes that buffer or spool large
+// bodies: uploads, exports, backup and restore.
+func requireMemoryHeadroom() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.memoryGuardBytes > 0 && memGuard.heapBytes() > uint64(cfg.memoryGuardBytes) {
+			memGuard.rejected.Add(1)
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is low on memory, retry later"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type memoryGuardStats struct {
+	LimitBytes int   `json:"limit_bytes"`
+	HeapBytes  int64 `json:"heap_bytes"`
+	Rejected   int64 `json:"rejected"`
+}
+
+func memoryGuardSnapshot() memoryGuardStats {
+	return memoryGuardStats{
+		LimitBytes: cfg.memoryGuardBytes,
+		HeapBytes:  int64(memGuard.heapBytes()),
+		Rejected:   memGuard.rejected.Load(),
+	}
+}
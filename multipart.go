@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFormFieldSize bounds the text fields read next to the file part.
+const maxFormFieldSize = 4096
+
+// streamUpload reads the multipart body part by part instead of letting gin
+// buffer it. Tar archives are unpacked while the file part streams in and
+// the tar itself is spooled so its entries can be sorted; zip needs random
+// access and is spooled as uploaded, as is a plain CSV file (type=csv, or
+// a part sent as text/csv when ?type= is not given).
+//
+// Nothing is written to the database before the whole body has been read,
+// so the text fields may come before or after the file part: the password
+// (only used for zip, which is parsed after spooling), the optional sha256
+// of the file and the metadata object apply either way. Invalid metadata is
+// rejected as soon as its field is read. Unknown fields are ignored and a
+// second file part is rejected. store writes the parsed rows.
+func streamUpload(c *gin.Context, opts uploadOptions, store storeFunc) {
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
+		return
+	}
+
+	var (
+		seenFile bool
+		filename string
+		checksum string
+		archive  *spooledUpload
+		parsed   *parsedUpload
+	)
+	hash := sha256.New()
+	defer func() {
+		if archive != nil {
+			archive.Close()
+		}
+	}()
+	defer finishUploadAttempt(c)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "malformed multipart body"})
+			return
+		}
+
+		switch part.FormName() {
+		case "file":
+			if seenFile {
+				part.Close()
+				c.JSON(http.StatusBadRequest, gin.H{"error": "only one file can be uploaded"})
+				return
+			}
+			seenFile = true
+			filename = part.FileName()
+			body := io.TeeReader(part, hash)
+			if c.Query("type") == "" && isCSVPart(part) {
+				opts.archiveType = archiveCSV
+			}
+
+			if opts.archiveType == archiveTar || opts.archiveType == archiveTarGz {
+				beginUploadAttempt(c, filename, "", opts)
+				parsed, err = parseUpload(body, filename, opts)
+				if err != nil {
+					part.Close()
+					respondParseError(c, err)
+					return
+				}
+				// Hash whatever the tar reader left unread, such as padding.
+				_, err = io.Copy(io.Discard, body)
+			} else {
+				archive, err = spoolUpload(body)
+			}
+		case "password":
+			opts.password, err = readFormField(part)
+		case "sha256":
+			checksum, err = readFormField(part)
+		case "metadata":
+			var raw string
+			if raw, err = readFormField(part); err == nil {
+				opts.metadata, err = parseUploadMetadata(raw)
+			}
+		}
+		part.Close()
+
+		var fieldErr *filterError
+		switch {
+		case errors.Is(err, errInvalidMetadata):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		case errors.As(err, &fieldErr):
+			respondFilterError(c, err)
+			return
+		case errors.Is(err, errTempBudgetExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read file"})
+			return
+		}
+	}
+
+	if !seenFile {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
+		return
+	}
+	if checksum != "" && hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(checksum) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "sha256 of the uploaded file does not match"})
+		return
+	}
+
+	if archive != nil {
+		beginUploadAttempt(c, filename, archive.Name(), opts)
+		parsed, err = parseUpload(archive, filename, opts)
+		if err != nil {
+			respondParseError(c, err)
+			return
+		}
+	}
+	store(c, parsed, filename, opts)
+}
+
+// isCSVPart reports whether the file part is declared as a plain CSV file,
+// which is uploaded as type=csv unless ?type= says otherwise.
+func isCSVPart(part *multipart.Part) bool {
+	mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/csv"
+}
+
+func readFormField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxFormFieldSize {
+		return "", &filterError{param: part.FormName(), message: "is too long"}
+	}
+	return string(value), nil
+}
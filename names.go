@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultNamesLimit = 20
+	maxNamesLimit     = 100
+)
+
+// getPriceNames serves name autocomplete: distinct names starting with the
+// normalized ?q= prefix, most frequent first.
+func getPriceNames(c *gin.Context) {
+	limit := defaultNamesLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxNamesLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	q, err := filterParam(c, "q", cfg.filterMaxLength)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	category, err := filterParam(c, "category", cfg.filterMaxLength)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	filter := newPriceFilter(c)
+	filter.add(`name_norm LIKE %s || '%%'`, escapeLike(normalizeName(q)))
+	if category != "" {
+		filter.add("category = %s", category)
+	}
+
+	query := "SELECT name FROM prices WHERE 1=1" + filter.sql() +
+		" GROUP BY name ORDER BY COUNT(*) DESC, name LIMIT " + filter.arg(limit)
+
+	rows, err := queryWithRetry(c.Request.Context(), "names", query, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, names)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeName folds a product name for case- and accent-insensitive
+// matching: diacritics are stripped, letters lowercased and runs of
+// whitespace collapsed. The result is stored in prices.name_norm.
+func normalizeName(s string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range norm.NFD.String(strings.TrimSpace(s)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	return sb.String()
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec is maintained by hand next to the handlers; update it together
+// with any change to routes, parameters or response fields.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler serves the spec with servers pointing at cfg.basePath so
+// generated clients work behind a path prefix.
+func openAPIHandler() (gin.HandlerFunc, error) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, err
+	}
+	serverURL := cfg.basePath
+	if serverURL == "" {
+		serverURL = "/"
+	}
+	spec["servers"] = []gin.H{{"url": serverURL}}
+
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// failedFile is a file of a ?parallel_insert= upload whose transaction
+// rolled back.
+type failedFile struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// insertUploadParallel inserts each file's records in a transaction of its
+// own, at most opts.parallelInsert at once. It is not all-or-nothing: a
+// file that fails is rolled back on its own and listed in the returned
+// failures while the others stay committed. Each file's transaction adds
+// its counts to the uploads row, so the committed files can be rolled back
+// as one upload whatever happens to the rest. Only when every file fails
+// is the first failure returned as the error, with nothing written.
+//
+// The rows of a file are not checked against rows of files still being
+// inserted, so a repeat across files is only caught by dedup_scope=upload
+// or both.
+func insertUploadParallel(ctx context.Context, batchID string, records []priceRecord, filename string, opts uploadOptions, totalCount, uploadDuplicates int) (storedUpload, []failedFile, error) {
+	// Records of a file are contiguous, in archive order.
+	var files [][]priceRecord
+	for i, rec := range records {
+		if i == 0 || rec.file != records[i-1].file {
+			files = append(files, nil)
+		}
+		files[len(files)-1] = append(files[len(files)-1], rec)
+	}
+
+	results := make([]storedUpload, len(files))
+	errs := make([]error, len(files))
+	sem := make(chan struct{}, opts.parallelInsert)
+	var wg sync.WaitGroup
+	for i, recs := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = withRetry(ctx, "upload", func() error {
+				var err error
+				results[i], err = insertFile(batchID, recs, filename, opts, totalCount, uploadDuplicates)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	stored := storedUpload{categories: make(map[string]int), categoryDuplicates: make(map[string]int)}
+	failed := []failedFile{}
+	var firstErr error
+	for i, part := range results {
+		if errs[i] != nil {
+			failed = append(failed, failedFile{File: files[i][0].file, Error: failureMessage(errs[i])})
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		stored.merge(part)
+	}
+	if len(files) > 0 && len(failed) == len(files) {
+		return stored, nil, firstErr
+	}
+	return stored, failed, nil
+}
+
+// insertFile inserts the records of one file in a transaction of its own,
+// with its share of the uploads row.
+func insertFile(batchID string, records []priceRecord, filename string, opts uploadOptions, totalCount, uploadDuplicates int) (storedUpload, error) {
+	stored := storedUpload{categories: make(map[string]int), categoryDuplicates: make(map[string]int)}
+	tx, err := beginUploadTx()
+	if err != nil {
+		return stored, err
+	}
+	defer tx.Rollback(context.Background())
+	if err = insertRecords(tx, batchID, records, opts, &stored); err != nil {
+		return stored, err
+	}
+	if err = recordUploadPart(tx, batchID, filename, opts, totalCount, uploadDuplicates, stored); err != nil {
+		return stored, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return stored, &permanentError{&storeError{"failed to commit transaction", err}}
+	}
+	return stored, nil
+}
+
+// recordUploadPart writes the uploads row of a parallel upload with the
+// first file to commit and adds each later file's counts to it. The
+// repeats dropped within the upload are counted once, by the row's insert.
+func recordUploadPart(tx pgx.Tx, batchID, filename string, opts uploadOptions, totalCount, uploadDuplicates int, part storedUpload) error {
+	ctx := context.Background()
+	_, err := tx.Exec(ctx,
+		`INSERT INTO uploads (batch_id, filename, archive_type, total_count, inserted_count, duplicates_count, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6 + $7, $8)
+		ON CONFLICT (batch_id) DO UPDATE SET inserted_count = uploads.inserted_count + EXCLUDED.inserted_count,
+			duplicates_count = uploads.duplicates_count + $7`,
+		batchID, filename, opts.archiveType, totalCount, part.insertedCount, uploadDuplicates, part.tableDuplicates, opts.metadata)
+	if err != nil {
+		return &storeError{"failed to record upload", err}
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM upload_attempts WHERE batch_id = $1", batchID); err != nil {
+		return &storeError{"failed to record upload", err}
+	}
+	return nil
+}
+
+// merge adds what another transaction of the same upload wrote.
+func (s *storedUpload) merge(o storedUpload) {
+	s.insertedCount += o.insertedCount
+	s.skippedKnownCategories += o.skippedKnownCategories
+	s.tableDuplicates += o.tableDuplicates
+	s.totalPrice += o.totalPrice
+	s.totalCents += o.totalCents
+	s.idConflicts += o.idConflicts
+	s.updatedCount += o.updatedCount
+	s.maxID = max(s.maxID, o.maxID)
+	for category, n := range o.categories {
+		s.categories[category] += n
+	}
+	for category, n := range o.categoryDuplicates {
+		s.categoryDuplicates[category] += n
+	}
+	if s.insertedCount <= cfg.streamMaxRows && !s.rowsOmitted && !o.rowsOmitted {
+		s.rows = append(s.rows, o.rows...)
+	} else {
+		s.rows, s.rowsOmitted = nil, true
+	}
+}
+
+// failureMessage is what the client is told about a failed file.
+func failureMessage(err error) string {
+	var ice *idConflictError
+	if errors.As(err, &ice) {
+		return ice.Error()
+	}
+	var se *storeError
+	if errors.As(err, &se) {
+		return se.message
+	}
+	return "database error"
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// presetParams are the query parameters a preset may store: the row filters
+// and the export shaping options.
+var presetParams = map[string]bool{
+	"start": true, "end": true, "min": true, "max": true, "batch_id": true, "valid_on": true, "external_id": true, "label": true, "q": true,
+	"format": true, "group_by": true, "rounding": true, "locale": true, "empty": true, "bundle": true, "fields": true, "bom": true,
+	"sort": true, "nulls": true, "redact": true, "redact_with": true,
+}
+
+type filterPreset struct {
+	Name      string            `json:"name"`
+	Params    map[string]string `json:"params"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// validatePresetParams runs the stored parameters through the same parsers
+// as the live export endpoint.
+func validatePresetParams(c *gin.Context, params map[string]string) error {
+	values := url.Values{}
+	for name, value := range params {
+		if !presetParams[name] {
+			return &filterError{param: name, message: "cannot be stored in a preset"}
+		}
+		values.Set(name, value)
+	}
+
+	vc := c.Copy()
+	vc.Request = c.Request.Clone(c.Request.Context())
+	vc.Request.URL.RawQuery = values.Encode()
+
+	if _, err := parsePriceFilter(vc); err != nil {
+		return err
+	}
+	_, err := parseExportOptions(vc)
+	return err
+}
+
+// applyPreset expands ?preset=name into the stored parameters. Parameters
+// given inline take precedence over the preset. It must run before anything
+// reads the query through the gin context, which caches it.
+func applyPreset() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		name := query.Get("preset")
+		if name == "" {
+			c.Next()
+			return
+		}
+
+		preset, err := loadPreset(keyOwner(c), name)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "preset not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+			return
+		}
+
+		for param, value := range preset.Params {
+			if !query.Has(param) {
+				query.Set(param, value)
+			}
+		}
+		query.Del("preset")
+		c.Request.URL.RawQuery = query.Encode()
+		c.Next()
+	}
+}
+
+func loadPreset(owner, name string) (filterPreset, error) {
+	var p filterPreset
+	err := db.QueryRow(context.Background(),
+		"SELECT name, params, created_at, updated_at FROM filter_presets WHERE owner = $1 AND name = $2",
+		owner, name).Scan(&p.Name, &p.Params, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func listPresets(c *gin.Context) {
+	rows, err := db.Query(context.Background(),
+		"SELECT name, params, created_at, updated_at FROM filter_presets WHERE owner = $1 ORDER BY name",
+		keyOwner(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	presets := []filterPreset{}
+	for rows.Next() {
+		var p filterPreset
+		if err := rows.Scan(&p.Name, &p.Params, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		presets = append(presets, p)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, presets)
+}
+
+func getPreset(c *gin.Context) {
+	preset, err := loadPreset(keyOwner(c), c.Param("name"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "preset not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	c.JSON(http.StatusOK, preset)
+}
+
+func createPreset(c *gin.Context) {
+	var body struct {
+		Name   string            `json:"name"`
+		Params map[string]string `json:"params"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if !presetNamePattern.MatchString(body.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "preset name must be 1-64 lowercase letters, digits, '-' or '_'"})
+		return
+	}
+	if body.Params == nil {
+		body.Params = map[string]string{}
+	}
+	if err := validatePresetParams(c, body.Params); err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	preset := filterPreset{Name: body.Name, Params: body.Params}
+	err := db.QueryRow(context.Background(),
+		"INSERT INTO filter_presets (owner, name, params) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
+		keyOwner(c), preset.Name, preset.Params).Scan(&preset.CreatedAt, &preset.UpdatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "preset already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save preset"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, preset)
+}
+
+func updatePreset(c *gin.Context) {
+	var body struct {
+		Params map[string]string `json:"params"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if body.Params == nil {
+		body.Params = map[string]string{}
+	}
+	if err := validatePresetParams(c, body.Params); err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	preset := filterPreset{Name: c.Param("name"), Params: body.Params}
+	err := db.QueryRow(context.Background(),
+		"UPDATE filter_presets SET params = $3, updated_at = now() WHERE owner = $1 AND name = $2 RETURNING created_at, updated_at",
+		keyOwner(c), preset.Name, preset.Params).Scan(&preset.CreatedAt, &preset.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "preset not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save preset"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preset)
+}
+
+func deletePreset(c *gin.Context) {
+	tag, err := db.Exec(context.Background(),
+		"DELETE FROM filter_presets WHERE owner = $1 AND name = $2", keyOwner(c), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete preset"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "preset not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	rejectPriceOutOfBounds = "price_out_of_bounds"
+
+	// maxPriceWarnings caps the advisory warnings listed in an upload
+	// summary; warnings_count has them all.
+	maxPriceWarnings = 100
+)
+
+var errPriceRulesUnavailable = errors.New("failed to load price rules")
+
+// priceRule bounds the prices of the categories matching its pattern, in
+// which * stands for any run of characters and ? for one; matching ignores
+// case. A row outside the bounds is rejected, or only warned about when the
+// rule is advisory.
+type priceRule struct {
+	ID              int64     `json:"id"`
+	CategoryPattern string    `json:"category_pattern"`
+	MinPrice        *float64  `json:"min_price"`
+	MaxPrice        *float64  `json:"max_price"`
+	Advisory        bool      `json:"advisory"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+const priceRuleColumns = "id, category_pattern, min_price, max_price, advisory, created_at, updated_at"
+
+func scanPriceRule(row pgx.Row) (priceRule, error) {
+	var r priceRule
+	err := row.Scan(&r.ID, &r.CategoryPattern, &r.MinPrice, &r.MaxPrice, &r.Advisory, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+func (r *priceRule) violatedBy(price float64) bool {
+	return (r.MinPrice != nil && price < *r.MinPrice) || (r.MaxPrice != nil && price > *r.MaxPrice)
+}
+
+// priceRuleSet is the rules of one upload, compiled when it starts.
+// Patterns without wildcards are looked up by category; the rest are
+// matched once per distinct category and the result remembered, so
+// hundreds of rules cost little per row. It is not safe for concurrent
+// use.
+type priceRuleSet struct {
+	exact    map[string][]*priceRule
+	patterns []compiledPriceRule
+	matched  map[string][]*priceRule
+}
+
+type compiledPriceRule struct {
+	re   *regexp.Regexp
+	rule *priceRule
+}
+
+// loadPriceRules reads and compiles every rule, or returns nil when there
+// are none.
+func loadPriceRules(ctx context.Context) (*priceRuleSet, error) {
+	rows, err := db.Query(ctx, "SELECT "+priceRuleColumns+" FROM price_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	rules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (priceRule, error) { return scanPriceRule(row) })
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	set := &priceRuleSet{exact: make(map[string][]*priceRule), matched: make(map[string][]*priceRule)}
+	for i := range rules {
+		r := &rules[i]
+		if !strings.ContainsAny(r.CategoryPattern, "*?") {
+			key := strings.ToLower(r.CategoryPattern)
+			set.exact[key] = append(set.exact[key], r)
+			continue
+		}
+		set.patterns = append(set.patterns, compiledPriceRule{re: compileCategoryPattern(r.CategoryPattern), rule: r})
+	}
+	return set, nil
+}
+
+func compileCategoryPattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// rulesFor returns the rules of a category in id order.
+func (s *priceRuleSet) rulesFor(category string) []*priceRule {
+	if rules, ok := s.matched[category]; ok {
+		return rules
+	}
+	var rules []*priceRule
+	exact := s.exact[strings.ToLower(category)]
+	i := 0
+	for _, p := range s.patterns {
+		if !p.re.MatchString(category) {
+			continue
+		}
+		for i < len(exact) && exact[i].ID < p.rule.ID {
+			rules = append(rules, exact[i])
+			i++
+		}
+		rules = append(rules, p.rule)
+	}
+	rules = append(rules, exact[i:]...)
+	s.matched[category] = rules
+	return rules
+}
+
+// check returns the first enforced rule the price violates, if any, and
+// otherwise the advisory rules it violates. A nil set has no rules.
+func (s *priceRuleSet) check(category string, price float64) (*priceRule, []*priceRule) {
+	if s == nil {
+		return nil, nil
+	}
+	var advisories []*priceRule
+	for _, r := range s.rulesFor(category) {
+		if !r.violatedBy(price) {
+			continue
+		}
+		if !r.Advisory {
+			return r, nil
+		}
+		advisories = append(advisories, r)
+	}
+	return nil, advisories
+}
+
+// priceWarning is a row an advisory rule flagged.
+type priceWarning struct {
+	File     string  `json:"file"`
+	Line     int     `json:"line"`
+	RuleID   int64   `json:"rule_id"`
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Price    float64 `json:"price"`
+}
+
+type priceRuleInput struct {
+	CategoryPattern string   `json:"category_pattern"`
+	MinPrice        *float64 `json:"min_price"`
+	MaxPrice        *float64 `json:"max_price"`
+	Advisory        bool     `json:"advisory"`
+}
+
+func (in priceRuleInput) validate() error {
+	inRange := func(p *float64) bool { return p == nil || (*p >= 0 && *p <= maxStoredPrice) }
+	switch {
+	case strings.TrimSpace(in.CategoryPattern) == "" || len(in.CategoryPattern) > 255:
+		return errors.New("category_pattern must be between 1 and 255 bytes")
+	case in.MinPrice == nil && in.MaxPrice == nil:
+		return errors.New("min_price or max_price is required")
+	case !inRange(in.MinPrice) || !inRange(in.MaxPrice):
+		return errors.New("min_price and max_price must be between 0 and 99999999.99")
+	case in.MinPrice != nil && in.MaxPrice != nil && *in.MinPrice > *in.MaxPrice:
+		return errors.New("min_price must not exceed max_price")
+	}
+	return nil
+}
+
+func bindPriceRuleInput(c *gin.Context) (priceRuleInput, bool) {
+	var in priceRuleInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return in, false
+	}
+	if err := in.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return in, false
+	}
+	return in, true
+}
+
+func priceRuleID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "price rule not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+func listPriceRules(c *gin.Context) {
+	rows, err := db.Query(context.Background(), "SELECT "+priceRuleColumns+" FROM price_rules ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	rules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (priceRule, error) { return scanPriceRule(row) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+		return
+	}
+	if rules == nil {
+		rules = []priceRule{}
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func createPriceRule(c *gin.Context) {
+	in, ok := bindPriceRuleInput(c)
+	if !ok {
+		return
+	}
+	r, err := scanPriceRule(db.QueryRow(context.Background(),
+		"INSERT INTO price_rules (category_pattern, min_price, max_price, advisory) VALUES ($1, $2, $3, $4) RETURNING "+priceRuleColumns,
+		in.CategoryPattern, in.MinPrice, in.MaxPrice, in.Advisory))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save price rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, r)
+}
+
+func getPriceRule(c *gin.Context) {
+	id, ok := priceRuleID(c)
+	if !ok {
+		return
+	}
+	r, err := scanPriceRule(db.QueryRow(context.Background(), "SELECT "+priceRuleColumns+" FROM price_rules WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "price rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// updatePriceRule replaces the rule's settings; uploads already running
+// keep the rules they started with.
+func updatePriceRule(c *gin.Context) {
+	id, ok := priceRuleID(c)
+	if !ok {
+		return
+	}
+	in, ok := bindPriceRuleInput(c)
+	if !ok {
+		return
+	}
+	r, err := scanPriceRule(db.QueryRow(context.Background(),
+		`UPDATE price_rules SET category_pattern = $2, min_price = $3, max_price = $4, advisory = $5, updated_at = now()
+		WHERE id = $1 RETURNING `+priceRuleColumns,
+		id, in.CategoryPattern, in.MinPrice, in.MaxPrice, in.Advisory))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "price rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save price rule"})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func deletePriceRule(c *gin.Context) {
+	id, ok := priceRuleID(c)
+	if !ok {
+		return
+	}
+	tag, err := db.Exec(context.Background(), "DELETE FROM price_rules WHERE id = $1", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete price rule"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "price rule not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
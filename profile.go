@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// profileTopCategories is how many of the largest categories a profile
+// lists.
+const profileTopCategories = 5
+
+// uploadProfile summarises the accepted rows of an upload for ?profile=true,
+// so an operator can tell at a glance whether it looks right.
+type uploadProfile struct {
+	Rows          int                `json:"rows"`
+	Price         *priceProfile      `json:"price"`
+	Categories    int                `json:"distinct_categories"`
+	TopCategories []categoryCount    `json:"top_categories"`
+	CreateDate    *createDateProfile `json:"create_date"`
+	RowsPerFile   map[string]int     `json:"rows_per_file"`
+}
+
+type priceProfile struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+type createDateProfile struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+type categoryCount struct {
+	Category string `json:"category"`
+	Rows     int    `json:"rows"`
+}
+
+// profileRecords profiles the records in one pass over them; price and
+// create_date are null when there are none.
+func profileRecords(records []priceRecord, rounding roundingMode) uploadProfile {
+	p := uploadProfile{Rows: len(records), TopCategories: []categoryCount{}, RowsPerFile: make(map[string]int)}
+	perCategory := make(map[string]int)
+	var minPrice, maxPrice, sum float64
+	var minDate, maxDate time.Time
+	for i, rec := range records {
+		if i == 0 {
+			minPrice, maxPrice = rec.price, rec.price
+			minDate, maxDate = rec.createDate, rec.createDate
+		}
+		minPrice, maxPrice = min(minPrice, rec.price), max(maxPrice, rec.price)
+		if rec.createDate.Before(minDate) {
+			minDate = rec.createDate
+		}
+		if rec.createDate.After(maxDate) {
+			maxDate = rec.createDate
+		}
+		sum += rec.price
+		perCategory[rec.category]++
+		p.RowsPerFile[rec.file]++
+	}
+	if len(records) == 0 {
+		return p
+	}
+
+	p.Price = &priceProfile{
+		Min: minPrice,
+		Max: maxPrice,
+		Avg: roundMoney(sum/float64(len(records)), rounding),
+	}
+	p.CreateDate = &createDateProfile{Min: minDate.Format(isoDateLayout), Max: maxDate.Format(isoDateLayout)}
+	p.Categories = len(perCategory)
+	for category, n := range perCategory {
+		p.TopCategories = append(p.TopCategories, categoryCount{category, n})
+	}
+	slices.SortFunc(p.TopCategories, func(a, b categoryCount) int {
+		return cmp.Or(cmp.Compare(b.Rows, a.Rows), cmp.Compare(a.Category, b.Category))
+	})
+	p.TopCategories = p.TopCategories[:min(len(p.TopCategories), profileTopCategories)]
+	return p
+}
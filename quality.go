@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Severities of quality findings, from least to most urgent.
+const (
+	severityOK       = "ok"
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var severityRank = map[string]int{severityOK: 0, severityInfo: 1, severityWarning: 2, severityCritical: 3}
+
+const (
+	qualityMaxFindings = 50
+	qualityExampleIDs  = 5
+	// qualityMinDropRows is the smallest prior-period count a category
+	// needs before a drop in it is reported.
+	qualityMinDropRows = 10
+)
+
+// qualityParams are the thresholds of the report, from the query string.
+type qualityParams struct {
+	outlierZ          float64
+	nameMinCategories int
+	periodDays        int
+	dropRatio         float64
+	categories        []string
+	// source is the FROM item of the checks over the whole table: prices,
+	// or a sample of it on a large table.
+	source  string
+	sampled bool
+}
+
+// qualityCheck computes one section of the report. Each finding carries
+// its own severity.
+type qualityCheck struct {
+	name    string
+	sampled bool
+	run     func(ctx context.Context, p qualityParams) ([]gin.H, error)
+}
+
+var qualityChecks = []qualityCheck{
+	{"price_outliers", true, checkPriceOutliers},
+	{"multi_category_names", true, checkMultiCategoryNames},
+	{"upload_gaps", false, checkUploadGaps},
+	{"category_drops", false, checkCategoryDrops},
+}
+
+type qualityResult struct {
+	Status   string  `json:"status"`
+	Severity string  `json:"severity"`
+	Sampled  bool    `json:"sampled"`
+	Findings []gin.H `json:"findings"`
+}
+
+func parseQualityParams(c *gin.Context) (qualityParams, error) {
+	p := qualityParams{outlierZ: 3, nameMinCategories: 3, periodDays: 30, dropRatio: 0.5, categories: readCategories(c)}
+	if raw := c.Query("outlier_z"); raw != "" {
+		z, err := strconv.ParseFloat(raw, 64)
+		if err != nil || z <= 0 || z > 100 {
+			return p, &filterError{param: "outlier_z", message: "must be a number between 0 and 100"}
+		}
+		p.outlierZ = z
+	}
+	if raw := c.Query("name_min_categories"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 2 || n > 1000 {
+			return p, &filterError{param: "name_min_categories", message: "must be an integer between 2 and 1000"}
+		}
+		p.nameMinCategories = n
+	}
+	if raw := c.Query("period_days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 366 {
+			return p, &filterError{param: "period_days", message: "must be an integer between 1 and 366"}
+		}
+		p.periodDays = n
+	}
+	if raw := c.Query("drop_ratio"); raw != "" {
+		r, err := strconv.ParseFloat(raw, 64)
+		if err != nil || r <= 0 || r > 1 {
+			return p, &filterError{param: "drop_ratio", message: "must be a number greater than 0 and at most 1"}
+		}
+		p.dropRatio = r
+	}
+	return p, nil
+}
+
+// getPriceQuality runs the enabled checks concurrently, all within
+// QUALITY_TIMEOUT. A check still running at the deadline is reported as
+// timed_out and the others are returned as usual. On a table larger than
+// QUALITY_SAMPLE_ROWS the whole-table checks read a repeatable sample.
+func getPriceQuality(c *gin.Context) {
+	params, err := parseQualityParams(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	var enabled []qualityCheck
+	for _, check := range qualityChecks {
+		on := true
+		if c.Query(check.name) != "" {
+			if on, err = parseBoolParam(c, check.name); err != nil {
+				respondFilterError(c, err)
+				return
+			}
+		}
+		if on {
+			enabled = append(enabled, check)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.qualityTimeout)
+	defer cancel()
+
+	params.source = "prices p"
+	var estimated float64
+	if err := db.QueryRow(ctx, "SELECT reltuples FROM pg_class WHERE oid = 'prices'::regclass").Scan(&estimated); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	if cfg.qualitySampleRows > 0 && estimated > float64(cfg.qualitySampleRows) {
+		percent := float64(cfg.qualitySampleRows) / estimated * 100
+		params.source = fmt.Sprintf("prices p TABLESAMPLE SYSTEM (%.6f) REPEATABLE (0)", percent)
+		params.sampled = true
+	}
+
+	results := make([]qualityResult, len(enabled))
+	var wg sync.WaitGroup
+	for i, check := range enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runQualityCheck(ctx, check, params)
+		}()
+	}
+	wg.Wait()
+
+	report := make(map[string]qualityResult, len(enabled))
+	overall := severityOK
+	for i, check := range enabled {
+		report[check.name] = results[i]
+		if severityRank[results[i].Severity] > severityRank[overall] {
+			overall = results[i].Severity
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"generated_at": time.Now().UTC(),
+		"severity":     overall,
+		"checks":       report,
+	})
+}
+
+func runQualityCheck(ctx context.Context, check qualityCheck, params qualityParams) qualityResult {
+	result := qualityResult{Status: "ok", Severity: severityOK, Sampled: check.sampled && params.sampled, Findings: []gin.H{}}
+	findings, err := check.run(ctx, params)
+	if err != nil {
+		result.Status = "error"
+		if ctx.Err() != nil {
+			result.Status = "timed_out"
+		} else {
+			log.Printf("Quality check %s failed: %v", check.name, err)
+		}
+		return result
+	}
+	if len(findings) > 0 {
+		result.Status = "findings"
+		result.Findings = findings
+	}
+	for _, finding := range findings {
+		if severity := finding["severity"].(string); severityRank[severity] > severityRank[result.Severity] {
+			result.Severity = severity
+		}
+	}
+	return result
+}
+
+// qualityRows runs a check query and turns every row into a finding.
+func qualityRows[T any](ctx context.Context, query string, args []interface{}, finding func(T) gin.H) ([]gin.H, error) {
+	rows, err := queryWithRetry(ctx, "quality", query, args...)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+	if err != nil {
+		return nil, err
+	}
+	findings := make([]gin.H, len(items))
+	for i, item := range items {
+		findings[i] = finding(item)
+	}
+	return findings, nil
+}
+
+func restrictCategories(f *priceFilter, p qualityParams) string {
+	if p.categories != nil {
+		f.add("p.category = ANY(%s)", p.categories)
+	}
+	return f.sql()
+}
+
+// checkPriceOutliers finds, per category, the rows whose price is more than
+// outlier_z sample standard deviations from the category mean. Findings
+// twice as far out are critical.
+func checkPriceOutliers(ctx context.Context, p qualityParams) ([]gin.H, error) {
+	f := &priceFilter{}
+	scope := restrictCategories(f, p)
+	query := fmt.Sprintf(`WITH stats AS (
+			SELECT p.category, avg(%[1]s) AS mean, stddev_samp(%[1]s) AS sd FROM %[2]s WHERE TRUE%[3]s
+			GROUP BY p.category HAVING count(*) >= 3 AND stddev_samp(%[1]s) > 0
+		), outliers AS (
+			SELECT p.id, p.category, abs(%[1]s - s.mean) / s.sd AS z, s.mean, s.sd
+			FROM %[2]s JOIN stats s USING (category) WHERE abs(%[1]s - s.mean) > %[4]s * s.sd%[3]s
+		)
+		SELECT category, count(*), max(z)::float8, min(mean)::float8, min(sd)::float8,
+			(array_agg(id ORDER BY z DESC))[1:%[5]s]
+		FROM outliers GROUP BY category ORDER BY max(z) DESC, category LIMIT %[6]s`,
+		priceColumn(), p.source, scope, f.arg(p.outlierZ), f.arg(qualityExampleIDs), f.arg(qualityMaxFindings))
+	return qualityRows(ctx, query, f.args, func(r struct {
+		Category string
+		Count    int
+		MaxZ     float64
+		Mean     float64
+		StdDev   float64
+		IDs      []int32
+	}) gin.H {
+		severity := severityWarning
+		if r.MaxZ >= 2*p.outlierZ {
+			severity = severityCritical
+		}
+		return gin.H{"severity": severity, "category": r.Category, "rows": r.Count, "max_z": r.MaxZ,
+			"mean": r.Mean, "stddev": r.StdDev, "example_ids": r.IDs}
+	})
+}
+
+// checkMultiCategoryNames finds names filed under at least
+// name_min_categories categories, which usually means a typo in the
+// category or a name too generic to identify a product.
+func checkMultiCategoryNames(ctx context.Context, p qualityParams) ([]gin.H, error) {
+	f := &priceFilter{}
+	scope := restrictCategories(f, p)
+	query := fmt.Sprintf(`SELECT p.name, count(DISTINCT p.category), (array_agg(DISTINCT p.category))[1:10],
+			(array_agg(p.id ORDER BY p.id))[1:%[3]s]
+		FROM %[1]s WHERE TRUE%[2]s
+		GROUP BY p.name HAVING count(DISTINCT p.category) >= %[4]s
+		ORDER BY count(DISTINCT p.category) DESC, p.name LIMIT %[5]s`,
+		p.source, scope, f.arg(qualityExampleIDs), f.arg(p.nameMinCategories), f.arg(qualityMaxFindings))
+	return qualityRows(ctx, query, f.args, func(r struct {
+		Name       string
+		Count      int
+		Categories []string
+		IDs        []int32
+	}) gin.H {
+		severity := severityInfo
+		if r.Count >= 2*p.nameMinCategories {
+			severity = severityWarning
+		}
+		return gin.H{"severity": severity, "name": r.Name, "categories_count": r.Count,
+			"categories": r.Categories, "example_ids": r.IDs}
+	})
+}
+
+// checkUploadGaps lists the days of the last period_days (in APP_TIMEZONE,
+// not counting today) without an upload that is still in effect. A key restricted to
+// some categories only counts uploads that wrote rows of them.
+func checkUploadGaps(ctx context.Context, p qualityParams) ([]gin.H, error) {
+	f := &priceFilter{}
+	restricted := ""
+	if p.categories != nil {
+		restricted = " AND EXISTS (SELECT 1 FROM prices p WHERE p.batch_id = u.batch_id AND p.category = ANY(" + f.arg(p.categories) + "))"
+	}
+	query := `SELECT d::date::text FROM generate_series(current_date - ` + f.arg(p.periodDays) + `::int, current_date - 1, interval '1 day') d
+		WHERE NOT EXISTS (SELECT 1 FROM uploads u WHERE u.created_at >= d AND u.created_at < d + interval '1 day'
+			AND u.rolled_back_at IS NULL` + restricted + `)
+		ORDER BY d LIMIT ` + f.arg(qualityMaxFindings)
+	return qualityRows(ctx, query, f.args, func(r struct{ Day string }) gin.H {
+		return gin.H{"severity": severityWarning, "date": r.Day}
+	})
+}
+
+// checkCategoryDrops compares each category's rows by create_date in the
+// last period_days with the period before, reporting drops of at least
+// drop_ratio. A category with no rows left in the current period is
+// critical.
+func checkCategoryDrops(ctx context.Context, p qualityParams) ([]gin.H, error) {
+	f := &priceFilter{}
+	days := f.arg(p.periodDays)
+	scope := restrictCategories(f, p)
+	query := fmt.Sprintf(`SELECT p.category,
+			count(*) FILTER (WHERE p.create_date >= current_date - %[1]s::int),
+			count(*) FILTER (WHERE p.create_date < current_date - %[1]s::int),
+			coalesce((array_agg(p.id ORDER BY p.id DESC) FILTER (WHERE p.create_date < current_date - %[1]s::int))[1:%[3]s], '{}')
+		FROM prices p
+		WHERE p.create_date >= current_date - 2 * %[1]s::int AND p.create_date < current_date%[2]s
+		GROUP BY p.category
+		HAVING count(*) FILTER (WHERE p.create_date < current_date - %[1]s::int) >= %[4]s
+			AND count(*) FILTER (WHERE p.create_date >= current_date - %[1]s::int) <=
+				(1 - %[5]s::float8) * count(*) FILTER (WHERE p.create_date < current_date - %[1]s::int)
+		ORDER BY p.category LIMIT %[6]s`,
+		days, scope, f.arg(qualityExampleIDs), f.arg(qualityMinDropRows), f.arg(p.dropRatio), f.arg(qualityMaxFindings))
+	return qualityRows(ctx, query, f.args, func(r struct {
+		Category string
+		Current  int
+		Prior    int
+		IDs      []int32
+	}) gin.H {
+		severity := severityWarning
+		if r.Current == 0 {
+			severity = severityCritical
+		}
+		return gin.H{"severity": severity, "category": r.Category, "current_rows": r.Current,
+			"prior_rows": r.Prior, "drop": 1 - float64(r.Current)/float64(r.Prior), "example_ids": r.IDs}
+	})
+}
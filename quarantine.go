@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Statuses of a quarantined upload; an approved one is also in uploads.
+const (
+	quarantineHeld     = "quarantined"
+	quarantineApproved = "approved"
+	quarantineRejected = "rejected"
+
+	reasonRejectionRate = "rejection_rate"
+	reasonPriceChange   = "price_change"
+)
+
+var (
+	errAlreadyRejected = errors.New("upload already rejected")
+	errAlreadyApproved = errors.New("upload already approved")
+)
+
+// quarantineReason is a threshold an upload exceeded.
+type quarantineReason struct {
+	Reason    string  `json:"reason"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// Compared is how many rows had a stored price to compare with.
+	Compared int `json:"compared,omitempty"`
+}
+
+// quarantineThresholds are the limits an upload is checked against; 0
+// turns a check off. A supplier's own row leaves unset fields at the
+// QUARANTINE_* defaults.
+type quarantineThresholds struct {
+	Supplier      string    `json:"supplier"`
+	RejectionRate *float64  `json:"rejection_rate"`
+	PriceChange   *float64  `json:"price_change"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func thresholdsFor(ctx context.Context, supplier string) (rejectionRate, priceChange float64, err error) {
+	rejectionRate, priceChange = cfg.quarantineRejection, cfg.quarantinePriceChg
+	if supplier == "" {
+		return rejectionRate, priceChange, nil
+	}
+	var rate, change *float64
+	err = db.QueryRow(ctx, "SELECT rejection_rate, price_change FROM quarantine_thresholds WHERE supplier = $1", supplier).
+		Scan(&rate, &change)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rejectionRate, priceChange, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if rate != nil {
+		rejectionRate = *rate
+	}
+	if change != nil {
+		priceChange = *change
+	}
+	return rejectionRate, priceChange, nil
+}
+
+// checkQuarantine returns the thresholds the upload exceeds: the share of
+// its rows rejected by validation, and the mean relative change of its
+// prices against the latest stored price of the same name and category,
+// matched ignoring case. Rows without a stored price are not compared.
+func checkQuarantine(ctx context.Context, supplier string, parsed *parsedUpload, records []priceRecord) ([]quarantineReason, error) {
+	rejectionRate, priceChange, err := thresholdsFor(ctx, supplier)
+	if err != nil {
+		return nil, err
+	}
+
+	var reasons []quarantineReason
+	if rejectionRate > 0 {
+		var rejected int
+		for _, n := range parsed.rejected {
+			rejected += n
+		}
+		if total := rejected + len(parsed.records); total > 0 {
+			if rate := float64(rejected) / float64(total); rate > rejectionRate {
+				reasons = append(reasons, quarantineReason{Reason: reasonRejectionRate, Value: rate, Threshold: rejectionRate})
+			}
+		}
+	}
+
+	if priceChange > 0 && len(records) > 0 {
+		names := make([]string, len(records))
+		categories := make([]string, len(records))
+		prices := make([]float64, len(records))
+		for i, rec := range records {
+			names[i], categories[i], prices[i] = rec.name, rec.category, rec.price
+		}
+		var compared int
+		var change float64
+		err := db.QueryRow(ctx,
+			`SELECT COUNT(*), COALESCE(AVG(abs(u.price - p.price) / p.price), 0)
+			FROM unnest($1::text[], $2::text[], $3::float8[]) AS u(name, category, price)
+			CROSS JOIN LATERAL (
+				SELECT price::float8 AS price FROM prices
+				WHERE lower(name) = lower(u.name) AND lower(category) = lower(u.category)
+				ORDER BY create_date DESC, id DESC LIMIT 1
+			) p
+			WHERE p.price > 0`,
+			names, categories, prices).Scan(&compared, &change)
+		if err != nil {
+			return nil, err
+		}
+		if compared > 0 && change > priceChange {
+			reasons = append(reasons, quarantineReason{Reason: reasonPriceChange, Value: change, Threshold: priceChange, Compared: compared})
+		}
+	}
+	return reasons, nil
+}
+
+// quarantineOptions are the upload options approval inserts the rows
+// with, kept with the quarantined upload.
+type quarantineOptions struct {
+	DedupScope        string `json:"dedup_scope"`
+	Dedupe            string `json:"dedupe"`
+	DateToleranceDays int    `json:"date_tolerance_days"`
+	OnlyNewCategories bool   `json:"only_new_categories"`
+	IDConflict        string `json:"id_conflict"`
+	OnDuplicate       string `json:"on_duplicate"`
+	Rounding          string `json:"rounding"`
+}
+
+func newQuarantineOptions(opts uploadOptions) quarantineOptions {
+	return quarantineOptions{
+		DedupScope:        opts.dedupScope,
+		Dedupe:            opts.dedupe,
+		DateToleranceDays: opts.dateToleranceDays,
+		OnlyNewCategories: opts.onlyNewCategories,
+		IDConflict:        opts.idConflict,
+		OnDuplicate:       opts.onDuplicate,
+		Rounding:          string(opts.rounding),
+	}
+}
+
+func (o quarantineOptions) uploadOptions() uploadOptions {
+	return uploadOptions{
+		mode:              modeAppend,
+		dedupScope:        o.DedupScope,
+		dedupe:            o.Dedupe,
+		dateToleranceDays: o.DateToleranceDays,
+		onlyNewCategories: o.OnlyNewCategories,
+		idConflict:        o.IDConflict,
+		onDuplicate:       o.OnDuplicate,
+		rounding:          roundingMode(o.Rounding),
+	}
+}
+
+// quarantineUpload stages the records under the batch id instead of
+// inserting them, in one transaction that also forgets the attempt.
+func quarantineUpload(ctx context.Context, batchID, filename string, opts uploadOptions, records []priceRecord, totalCount, duplicatesCount int, reasons []quarantineReason) error {
+	ids := make([]*int64, len(records))
+	names := make([]string, len(records))
+	categories := make([]string, len(records))
+	prices := make([]float64, len(records))
+	createDates := make([]time.Time, len(records))
+	validFrom := make([]*time.Time, len(records))
+	validTo := make([]*time.Time, len(records))
+	externalIDs := make([]string, len(records))
+	files := make([]string, len(records))
+	for i, rec := range records {
+		ids[i], names[i], categories[i], prices[i] = rec.id, rec.name, rec.category, rec.price
+		createDates[i], validFrom[i], validTo[i] = rec.createDate, rec.validFrom, rec.validTo
+		externalIDs[i], files[i] = rec.externalID, rec.file
+	}
+	var supplier interface{}
+	if opts.supplier != "" {
+		supplier = opts.supplier
+	}
+
+	return withRetry(ctx, "quarantine", func() error {
+		return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx,
+				`INSERT INTO quarantined_uploads (batch_id, filename, archive_type, supplier, total_count, duplicates_count, metadata, options, reasons)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				batchID, filename, opts.archiveType, supplier, totalCount, duplicatesCount, opts.metadata,
+				newQuarantineOptions(opts), reasons)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx,
+				`INSERT INTO quarantined_prices (batch_id, ord, id, name, category, price, create_date, valid_from, valid_to, external_id, file)
+				SELECT $1, ord, id, name, category, price, create_date, valid_from, valid_to, NULLIF(external_id, ''), file
+				FROM unnest($2::bigint[], $3::text[], $4::text[], $5::float8[], $6::timestamp[], $7::date[], $8::date[], $9::text[], $10::text[])
+					WITH ORDINALITY AS r(id, name, category, price, create_date, valid_from, valid_to, external_id, file, ord)`,
+				batchID, ids, names, categories, prices, createDates, validFrom, validTo, externalIDs, files)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM upload_attempts WHERE batch_id = $1", batchID)
+			return err
+		})
+	})
+}
+
+// respondQuarantined answers an upload that was held for review.
+func respondQuarantined(c *gin.Context, summary gin.H, reasons []quarantineReason) {
+	summary["status"] = quarantineHeld
+	summary["quarantine_reasons"] = reasons
+	c.JSON(http.StatusAccepted, summary)
+	notifyQuarantine(gin.H{
+		"batch_id": summary["batch_id"],
+		"status":   quarantineHeld,
+		"supplier": summary["supplier"],
+		"reasons":  reasons,
+	})
+}
+
+// notifyQuarantine posts a status change of a quarantined upload to
+// QUARANTINE_WEBHOOK, best effort and off the request, like alert
+// firings.
+func notifyQuarantine(event gin.H) {
+	if cfg.quarantineWebhook == "" {
+		return
+	}
+	body, _ := json.Marshal(event)
+	go func() {
+		if err := postWebhook(subsystemQuarantineWebhook, cfg.quarantineWebhook, body); err != nil {
+			log.Printf("Quarantine webhook for %v failed: %v", event["batch_id"], err)
+		}
+	}()
+}
+
+// quarantinedUpload is the row of a quarantined upload, locked by the
+// transaction that decides it.
+type quarantinedUpload struct {
+	filename, archiveType string
+	supplier              *string
+	totalCount            int
+	duplicatesCount       int
+	metadata              map[string]interface{}
+	options               quarantineOptions
+	status                string
+	result                map[string]interface{}
+}
+
+func lockQuarantinedUpload(ctx context.Context, tx pgx.Tx, batchID string) (quarantinedUpload, error) {
+	var q quarantinedUpload
+	err := tx.QueryRow(ctx,
+		`SELECT filename, archive_type, supplier, total_count, duplicates_count, metadata, options, status, result
+		FROM quarantined_uploads WHERE batch_id = $1 FOR UPDATE`, batchID).
+		Scan(&q.filename, &q.archiveType, &q.supplier, &q.totalCount, &q.duplicatesCount, &q.metadata, &q.options, &q.status, &q.result)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return q, errUploadNotFound
+	}
+	if err != nil {
+		return q, &storeError{"database error", err}
+	}
+	return q, nil
+}
+
+func loadQuarantinedRecords(ctx context.Context, tx pgx.Tx, batchID string) ([]priceRecord, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT id, name, category, price::float8, create_date, valid_from, valid_to, COALESCE(external_id, ''), file
+		FROM quarantined_prices WHERE batch_id = $1 ORDER BY ord`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (priceRecord, error) {
+		var rec priceRecord
+		err := row.Scan(&rec.id, &rec.name, &rec.category, &rec.price, &rec.createDate, &rec.validFrom, &rec.validTo, &rec.externalID, &rec.file)
+		return rec, err
+	})
+}
+
+// approveTx moves a quarantined upload's rows into prices through the same
+// duplicate checks as a regular upload, as of now rather than as of when
+// it arrived, and records the upload. It returns the upload summary and
+// whether this call approved it; for an upload approved before, that is
+// the earlier summary with nothing stored.
+func approveTx(ctx context.Context, batchID string) (gin.H, storedUpload, bool, error) {
+	stored := storedUpload{categories: make(map[string]int), categoryDuplicates: make(map[string]int)}
+	tx, err := beginUploadTx()
+	if err != nil {
+		return nil, stored, false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	q, err := lockQuarantinedUpload(ctx, tx, batchID)
+	if err != nil {
+		return nil, stored, false, err
+	}
+	switch q.status {
+	case quarantineApproved:
+		return q.result, stored, false, nil
+	case quarantineRejected:
+		return nil, stored, false, errAlreadyRejected
+	}
+
+	records, err := loadQuarantinedRecords(ctx, tx, batchID)
+	if err != nil {
+		return nil, stored, false, &storeError{"failed to load quarantined records", err}
+	}
+	opts := q.options.uploadOptions()
+	opts.archiveType, opts.metadata = q.archiveType, q.metadata
+	if err = insertRecords(tx, batchID, records, opts, &stored); err != nil {
+		return nil, stored, false, err
+	}
+	duplicatesCount := q.duplicatesCount + stored.tableDuplicates
+	if err = recordUpload(tx, batchID, q.filename, opts, q.totalCount, stored.insertedCount, duplicatesCount); err != nil {
+		return nil, stored, false, err
+	}
+
+	totalPrice := stored.totalPrice
+	if cfg.priceCents {
+		totalPrice = float64(stored.totalCents) / 100
+	}
+	summary := gin.H{
+		"batch_id":                 batchID,
+		"status":                   quarantineApproved,
+		"supplier":                 q.supplier,
+		"total_count":              q.totalCount,
+		"duplicates_count":         duplicatesCount,
+		"total_items":              stored.insertedCount,
+		"total_categories":         len(stored.categories),
+		"total_price":              roundMoney(totalPrice, opts.rounding),
+		"skipped_known_categories": stored.skippedKnownCategories,
+		"id_conflicts":             stored.idConflicts,
+		"updated_count":            stored.updatedCount,
+		"metadata":                 q.metadata,
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM quarantined_prices WHERE batch_id = $1", batchID); err != nil {
+		return nil, stored, false, &storeError{"failed to record approval", err}
+	}
+	_, err = tx.Exec(ctx, "UPDATE quarantined_uploads SET status = $2, result = $3, decided_at = now() WHERE batch_id = $1",
+		batchID, quarantineApproved, summary)
+	if err != nil {
+		return nil, stored, false, &storeError{"failed to record approval", err}
+	}
+
+	// A commit that lost its connection may have gone through, so it is
+	// never retried.
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, stored, false, &permanentError{&storeError{"failed to commit transaction", err}}
+	}
+	return summary, stored, true, nil
+}
+
+// approveUpload commits a quarantined upload. Approving it again answers
+// with the summary of the first approval and writes nothing.
+func approveUpload(c *gin.Context) {
+	batchID := c.Param("batch_id")
+	if !isUUID(batchID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+	var summary gin.H
+	var stored storedUpload
+	var approved bool
+	err := withRetry(ctx, "approve", func() error {
+		var err error
+		summary, stored, approved, err = approveTx(ctx, batchID)
+		return err
+	})
+	if !respondQuarantineError(c, err) {
+		return
+	}
+
+	usageFor(c).rowsInserted += int64(stored.insertedCount)
+	if stored.insertedCount > 0 {
+		categories := slices.Sorted(maps.Keys(stored.categories))
+		priceEvents.publish(batchEvent{
+			BatchID:       batchID,
+			InsertedCount: stored.insertedCount,
+			Categories:    categories,
+			Rows:          stored.rows,
+			RowsOmitted:   stored.rowsOmitted,
+			categoryRows:  stored.categories,
+		})
+		evaluateAlertsAsync(batchID, categories)
+	}
+	if approved {
+		exportArchives.purge()
+		notifyQuarantine(gin.H{"batch_id": batchID, "status": quarantineApproved, "supplier": summary["supplier"]})
+	}
+	summary["conflict_retries"] = conflictRetries.Load()
+	c.JSON(http.StatusOK, summary)
+}
+
+// rejectUpload discards the rows of a quarantined upload, keeping its
+// record. Rejecting it again does nothing.
+func rejectUpload(c *gin.Context) {
+	batchID := c.Param("batch_id")
+	if !isUUID(batchID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var discarded int64
+	var supplier *string
+	var rejected bool
+	err := withRetry(ctx, "reject", func() error {
+		discarded, rejected = 0, false
+		return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			q, err := lockQuarantinedUpload(ctx, tx, batchID)
+			if err != nil {
+				return err
+			}
+			supplier = q.supplier
+			switch q.status {
+			case quarantineRejected:
+				return nil
+			case quarantineApproved:
+				return errAlreadyApproved
+			}
+			tag, err := tx.Exec(ctx, "DELETE FROM quarantined_prices WHERE batch_id = $1", batchID)
+			if err != nil {
+				return &storeError{"failed to discard records", err}
+			}
+			discarded = tag.RowsAffected()
+			_, err = tx.Exec(ctx, "UPDATE quarantined_uploads SET status = $2, decided_at = now() WHERE batch_id = $1",
+				batchID, quarantineRejected)
+			if err != nil {
+				return &storeError{"failed to record rejection", err}
+			}
+			rejected = true
+			return nil
+		})
+	})
+	if !respondQuarantineError(c, err) {
+		return
+	}
+	if rejected {
+		notifyQuarantine(gin.H{"batch_id": batchID, "status": quarantineRejected, "supplier": supplier})
+	}
+	c.JSON(http.StatusOK, gin.H{"batch_id": batchID, "status": quarantineRejected, "discarded_count": discarded})
+}
+
+// respondQuarantineError answers a failed approval or rejection, reporting
+// false when there was one.
+func respondQuarantineError(c *gin.Context, err error) bool {
+	var se *storeError
+	var ice *idConflictError
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errAlreadyRejected), errors.Is(err, errAlreadyApproved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.As(err, &ice):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": ice.Error()})
+	case errors.As(err, &se):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": se.message})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+	}
+	return false
+}
+
+type quarantineThresholdsInput struct {
+	RejectionRate *float64 `json:"rejection_rate"`
+	PriceChange   *float64 `json:"price_change"`
+}
+
+func listQuarantineThresholds(c *gin.Context) {
+	rows, err := db.Query(context.Background(),
+		"SELECT supplier, rejection_rate, price_change, updated_at FROM quarantine_thresholds ORDER BY supplier")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	thresholds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (quarantineThresholds, error) {
+		var t quarantineThresholds
+		err := row.Scan(&t.Supplier, &t.RejectionRate, &t.PriceChange, &t.UpdatedAt)
+		return t, err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+		return
+	}
+	if thresholds == nil {
+		thresholds = []quarantineThresholds{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"defaults":  gin.H{"rejection_rate": cfg.quarantineRejection, "price_change": cfg.quarantinePriceChg},
+		"suppliers": thresholds,
+	})
+}
+
+// putQuarantineThresholds sets a supplier's thresholds; a field left out
+// or null follows the default.
+func putQuarantineThresholds(c *gin.Context) {
+	supplier := c.Param("supplier")
+	if strings.TrimSpace(supplier) == "" || len(supplier) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "supplier must be between 1 and 255 bytes"})
+		return
+	}
+	var in quarantineThresholdsInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if (in.RejectionRate != nil && (*in.RejectionRate < 0 || *in.RejectionRate > 1)) || (in.PriceChange != nil && *in.PriceChange < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rejection_rate must be between 0 and 1 and price_change must not be negative"})
+		return
+	}
+	t := quarantineThresholds{Supplier: supplier}
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO quarantine_thresholds (supplier, rejection_rate, price_change) VALUES ($1, $2, $3)
+		ON CONFLICT (supplier) DO UPDATE SET rejection_rate = EXCLUDED.rejection_rate, price_change = EXCLUDED.price_change, updated_at = now()
+		RETURNING rejection_rate, price_change, updated_at`,
+		supplier, in.RejectionRate, in.PriceChange).Scan(&t.RejectionRate, &t.PriceChange, &t.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save quarantine thresholds"})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func deleteQuarantineThresholds(c *gin.Context) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM quarantine_thresholds WHERE supplier = $1", c.Param("supplier"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete quarantine thresholds"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "supplier has no quarantine thresholds"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
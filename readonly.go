@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dbReadOnly is set at startup when DATABASE_URL points at a standby or a
+// server that defaults to read-only transactions. Writes are then refused
+// up front instead of failing halfway through an upload.
+var dbReadOnly atomic.Bool
+
+func detectReadOnly() (bool, error) {
+	var inRecovery, readOnly bool
+	err := db.QueryRow(context.Background(),
+		"SELECT pg_is_in_recovery(), current_setting('transaction_read_only') = 'on'").Scan(&inRecovery, &readOnly)
+	return inRecovery || readOnly, err
+}
+
+// requireWritableDB guards the routes that write to the database.
+func requireWritableDB() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if dbReadOnly.Load() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "database is read-only"})
+			return
+		}
+		c.Next()
+	}
+}
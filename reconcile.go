@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// rejectOutOfScope marks a reconcile row dated outside the scope's range.
+const rejectOutOfScope = "out_of_scope"
+
+// reconcileScope is the part of the table a reconcile makes match its file:
+// the rows of a supplier, of a date range, or both, and never any category
+// the caller's API key may not write.
+type reconcileScope struct {
+	supplier   string
+	start, end *time.Time
+	categories []string
+}
+
+// parseReconcileScope requires a supplier or a closed date range of at
+// most RECONCILE_MAX_DAYS, so a reconcile can never cover the whole table:
+// a range alone spans every supplier.
+func parseReconcileScope(c *gin.Context) (reconcileScope, error) {
+	scope := reconcileScope{categories: allowedCategories(c)}
+	var err error
+	if scope.supplier, err = filterParam(c, "supplier", cfg.filterMaxLength); err != nil {
+		return scope, err
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"start", &scope.start}, {"end", &scope.end}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(isoDateLayout, raw)
+		if err != nil {
+			return scope, &filterError{param: bound.name, message: "must be a YYYY-MM-DD date"}
+		}
+		*bound.dst = &t
+	}
+
+	switch {
+	case scope.supplier == "" && (scope.start == nil || scope.end == nil):
+		return scope, &filterError{param: "supplier", message: "is required unless both start and end are set"}
+	case scope.start != nil && scope.end != nil && scope.end.Before(*scope.start):
+		return scope, &filterError{param: "end", message: "must not be before start"}
+	case scope.supplier == "" && scope.end.Sub(*scope.start) > time.Duration(cfg.reconcileMaxDays-1)*24*time.Hour:
+		return scope, &filterError{param: "end", message: fmt.Sprintf("must be within %d days of start unless supplier is set", cfg.reconcileMaxDays)}
+	}
+	return scope, nil
+}
+
+// contains reports whether a row from the file falls inside the scope's
+// date range; a row always belongs to the supplier it is reconciled for.
+func (s reconcileScope) contains(rec priceRecord) bool {
+	return (s.start == nil || !rec.createDate.Before(*s.start)) &&
+		(s.end == nil || !rec.createDate.After(*s.end))
+}
+
+// where returns the scope's conditions on the prices row aliased p. f
+// may already hold arguments but no clauses.
+func (s reconcileScope) where(f *priceFilter) string {
+	if s.supplier != "" {
+		f.add("p.supplier = %s", s.supplier)
+	}
+	return s.rangeWhere(f)
+}
+
+// matchWhere is where for the rows a file row may already be stored as:
+// a row stored without a supplier counts as the supplier's, so it is not
+// inserted again, but it is never removed.
+func (s reconcileScope) matchWhere(f *priceFilter) string {
+	if s.supplier != "" {
+		f.add("(p.supplier = %s OR p.supplier IS NULL)", s.supplier)
+	}
+	return s.rangeWhere(f)
+}
+
+func (s reconcileScope) rangeWhere(f *priceFilter) string {
+	if s.start != nil {
+		f.add("p.create_date >= %s", *s.start)
+	}
+	if s.end != nil {
+		f.add("p.create_date <= %s", *s.end)
+	}
+	if s.categories != nil {
+		f.add("p.category = ANY(%s)", s.categories)
+	}
+	return "TRUE" + f.sql()
+}
+
+func (s reconcileScope) summary() gin.H {
+	scope := gin.H{"supplier": nil, "start": nil, "end": nil}
+	if s.supplier != "" {
+		scope["supplier"] = s.supplier
+	}
+	if s.start != nil {
+		scope["start"] = s.start.Format(isoDateLayout)
+	}
+	if s.end != nil {
+		scope["end"] = s.end.Format(isoDateLayout)
+	}
+	return scope
+}
+
+// reconcilePrices makes the scope of the table match the uploaded snapshot:
+// rows only in the file are inserted, rows in both are left alone and rows
+// only in the table are moved to removed_prices. Rows match on name,
+// category, price and create_date, as duplicates do on upload. It all runs
+// in one transaction, which dry_run=true rolls back after counting.
+func reconcilePrices(c *gin.Context) {
+	opts, err := parseUploadOptions(c)
+	if err != nil {
+		respondUploadOptionsError(c, err)
+		return
+	}
+	if opts.mode == modeReplaceAll {
+		respondFilterError(c, &filterError{param: "mode", message: "is not supported by reconcile"})
+		return
+	}
+	if opts.idConflict != idReassign {
+		respondFilterError(c, &filterError{param: "id_conflict", message: "is not supported by reconcile"})
+		return
+	}
+	if opts.onDuplicate != dupSkip {
+		respondFilterError(c, &filterError{param: "on_duplicate", message: "is not supported by reconcile"})
+		return
+	}
+	if opts.parallelInsert > 0 {
+		respondFilterError(c, &filterError{param: "parallel_insert", message: "is not supported by reconcile"})
+		return
+	}
+	scope, err := parseReconcileScope(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	dryRun, err := parseBoolParam(c, "dry_run")
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	streamUpload(c, opts, func(c *gin.Context, parsed *parsedUpload, filename string, opts uploadOptions) {
+		storeReconcile(c, parsed, filename, opts, scope, dryRun)
+	})
+}
+
+// reconciled is what reconcileTx changed, or would have with dry_run.
+type reconciled struct {
+	inserted   int64
+	kept       int64
+	removed    int64
+	categories map[string]int
+}
+
+func storeReconcile(c *gin.Context, parsed *parsedUpload, filename string, opts uploadOptions, scope reconcileScope, dryRun bool) {
+	rejected := parsed.rejected
+	if opts.strict && rejected[rejectInconsistentDate] > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":              "upload mixes date formats",
+			"inconsistent_dates": rejected[rejectInconsistentDate],
+		})
+		return
+	}
+	if err := checkWriteCategories(c, parsed.records); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	var records []priceRecord
+	for _, rec := range parsed.records {
+		if !scope.contains(rec) {
+			rejected[rejectOutOfScope]++
+			continue
+		}
+		records = append(records, rec)
+	}
+	totalCount := len(records)
+	records, duplicates := dedupeWithinUpload(records, false)
+
+	batchID := uploadBatchID(c)
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+	var result reconciled
+	err := withRetry(ctx, "reconcile", func() error {
+		var err error
+		result, err = reconcileTx(batchID, records, filename, opts, scope, totalCount, dryRun)
+		return err
+	})
+	var se *storeError
+	if errors.As(err, &se) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": se.message})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+
+	if !dryRun {
+		usageFor(c).rowsInserted += result.inserted
+		if result.inserted > 0 {
+			categories := slices.Sorted(maps.Keys(result.categories))
+			priceEvents.publish(batchEvent{
+				BatchID:       batchID,
+				InsertedCount: int(result.inserted),
+				Categories:    categories,
+				RowsOmitted:   true,
+				categoryRows:  result.categories,
+			})
+			evaluateAlertsAsync(batchID, categories)
+		}
+		exportArchives.purge()
+		log.Printf("Reconcile %s: inserted %d, kept %d, removed %d", batchID, result.inserted, result.kept, result.removed)
+	}
+
+	var committedBatch interface{}
+	if !dryRun {
+		committedBatch = batchID
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"batch_id":              committedBatch,
+		"dry_run":               dryRun,
+		"scope":                 scope.summary(),
+		"total_count":           totalCount,
+		"duplicates_count":      duplicates,
+		"inserted_count":        result.inserted,
+		"kept_count":            result.kept,
+		"removed_count":         result.removed,
+		"rejected":              rejected,
+		"skipped_files":         parsed.skippedFiles,
+		"header_fallback":       parsed.headerFallback,
+		"price_rule_rejections": parsed.ruleRejections,
+		"warnings":              parsed.warnings,
+		"warnings_count":        parsed.warningsCount,
+		"metadata":              opts.metadata,
+		"conflict_retries":      conflictRetries.Load(),
+	})
+}
+
+// reconcileMatch is true when the table row p has the file row r.
+const reconcileMatch = "p.name = r.name AND p.category = r.category AND p.price_cents = r.price_cents AND p.create_date = r.create_date"
+
+// reconcileTx loads the file into a temporary table and applies the
+// difference against the scope in one transaction, which it commits unless
+// dryRun is set.
+func reconcileTx(batchID string, records []priceRecord, filename string, opts uploadOptions, scope reconcileScope, totalCount int, dryRun bool) (reconciled, error) {
+	result := reconciled{categories: make(map[string]int)}
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return result, &storeError{"failed to start transaction", err}
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `CREATE TEMP TABLE reconcile_rows (
+		ord INTEGER NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		category VARCHAR(255) NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		price_cents BIGINT NOT NULL,
+		create_date TIMESTAMP NOT NULL,
+		name_norm TEXT NOT NULL,
+		valid_from DATE,
+		valid_to DATE
+	) ON COMMIT DROP`)
+	if err != nil {
+		return result, &storeError{"database error", err}
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"reconcile_rows"},
+		[]string{"ord", "name", "category", "price", "price_cents", "create_date", "name_norm", "valid_from", "valid_to"},
+		pgx.CopyFromSlice(len(records), func(i int) ([]interface{}, error) {
+			rec := records[i]
+			return []interface{}{i, rec.name, rec.category, rec.price, toCents(rec.price), rec.createDate,
+				normalizeName(rec.name), rec.validFrom, rec.validTo}, nil
+		}))
+	if err != nil {
+		return result, &storeError{"failed to load records", err}
+	}
+
+	// The scope is locked before anything in it changes, in the id order
+	// every bulk write uses.
+	f := &priceFilter{}
+	if err := lockPrices(ctx, tx, scope.where(f), f.args...); err != nil {
+		return result, &storeError{"failed to remove records", err}
+	}
+
+	f = &priceFilter{}
+	removedBy := f.arg(batchID)
+	tag, err := tx.Exec(ctx, `WITH removed AS (
+			DELETE FROM prices p WHERE `+scope.where(f)+`
+				AND NOT EXISTS (SELECT 1 FROM reconcile_rows r WHERE `+reconcileMatch+`)
+			RETURNING p.id, p.name, p.category, p.price, p.create_date, p.batch_id, p.supplier, p.valid_from, p.valid_to, p.external_id, p.labels
+		)
+		INSERT INTO removed_prices (id, name, category, price, create_date, batch_id, supplier, valid_from, valid_to, external_id, labels, removed_by)
+		SELECT id, name, category, price, create_date, batch_id, supplier, valid_from, valid_to, external_id, labels, `+removedBy+` FROM removed`,
+		f.args...)
+	if err != nil {
+		return result, &storeError{"failed to remove records", err}
+	}
+	result.removed = tag.RowsAffected()
+
+	f = &priceFilter{}
+	if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM prices p WHERE "+scope.where(f), f.args...).Scan(&result.kept); err != nil {
+		return result, &storeError{"database error", err}
+	}
+
+	f = &priceFilter{}
+	var supplier interface{}
+	if scope.supplier != "" {
+		supplier = scope.supplier
+	}
+	batch, supplierArg := f.arg(batchID), f.arg(supplier)
+	rows, err := tx.Query(ctx, `INSERT INTO prices (name, category, price, create_date, batch_id, name_norm, price_cents, valid_from, valid_to, supplier)
+		SELECT r.name, r.category, r.price, r.create_date, `+batch+`, r.name_norm, r.price_cents, r.valid_from, r.valid_to, `+supplierArg+`
+		FROM reconcile_rows r WHERE NOT EXISTS (SELECT 1 FROM prices p WHERE `+scope.matchWhere(f)+` AND `+reconcileMatch+`)
+		ORDER BY r.ord
+		RETURNING category`, f.args...)
+	if err != nil {
+		return result, &storeError{"failed to insert records", err}
+	}
+	categories, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return result, &storeError{"failed to insert records", err}
+	}
+	result.inserted = int64(len(categories))
+	for _, category := range categories {
+		result.categories[category]++
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO uploads (batch_id, filename, archive_type, total_count, inserted_count, duplicates_count, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		batchID, filename, opts.archiveType, totalCount, result.inserted, int64(totalCount)-result.inserted, opts.metadata)
+	if err != nil {
+		return result, &storeError{"failed to record upload", err}
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM upload_attempts WHERE batch_id = $1", batchID); err != nil {
+		return result, &storeError{"failed to record upload", err}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return result, &permanentError{&storeError{"failed to commit transaction", err}}
+	}
+	return result, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Ways ?redact_with= hides a redacted value: hash keeps equal values
+// equal, so rows of one product can still be told apart from another's;
+// placeholder replaces every value with the same text.
+const (
+	redactHash        = "hash"
+	redactPlaceholder = "placeholder"
+
+	redactedPlaceholder = "[redacted]"
+)
+
+// redactableColumns are the columns ?redact= may hide. Category, price and
+// dates are what a redacted export is shared for, so they stay.
+var redactableColumns = map[string]bool{"name": true, "external_id": true}
+
+// redaction is which columns an export hides and how.
+type redaction struct {
+	name       bool
+	externalID bool
+	with       string
+}
+
+func (r redaction) column(column string) bool {
+	return (column == "name" && r.name) || (column == "external_id" && r.externalID)
+}
+
+// redactKey is REDACT_KEY, the key of the hashes of redacted values. Hashes
+// are keyed so they cannot be reversed by hashing guessed names. Without
+// it a random key is used, and hashes change with every restart and differ
+// between instances.
+func redactKey() []byte {
+	if key := os.Getenv("REDACT_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// parseRedaction reads ?redact=, a comma-separated list of columns, and
+// ?redact_with=, hash by default.
+func parseRedaction(redact, with string) (redaction, error) {
+	r := redaction{with: redactHash}
+	for _, column := range splitList(redact) {
+		if !redactableColumns[column] {
+			return r, &filterError{param: "redact", message: fmt.Sprintf("cannot redact %q; only name, external_id can be redacted", column)}
+		}
+		r.name = r.name || column == "name"
+		r.externalID = r.externalID || column == "external_id"
+	}
+	switch with {
+	case "":
+	case redactHash, redactPlaceholder:
+		if !r.name && !r.externalID {
+			return r, &filterError{param: "redact_with", message: "requires redact"}
+		}
+		r.with = with
+	default:
+		return r, &filterError{param: "redact_with", message: "must be one of hash, placeholder"}
+	}
+	return r, nil
+}
+
+func (r redaction) value(v string) string {
+	if r.with == redactPlaceholder {
+		return redactedPlaceholder
+	}
+	mac := hmac.New(sha256.New, cfg.redactKey)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// apply hides the redacted columns of a row as it is read, so every export
+// format gets the same values.
+func (r redaction) apply(row *priceRow) {
+	if r.name {
+		row.name = r.value(row.name)
+	}
+	if r.externalID && row.externalID != nil {
+		v := r.value(*row.externalID)
+		row.externalID = &v
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = 2 * time.Second
+
+// retryStats counts retries per operation for GET /api/v0/admin/metrics.
+type retryStats struct {
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Exhausted int64 `json:"exhausted"`
+}
+
+var (
+	retryStatsMu sync.Mutex
+	dbRetryStats = make(map[string]*retryStats)
+)
+
+func recordRetry(op string, update func(*retryStats)) {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	s, ok := dbRetryStats[op]
+	if !ok {
+		s = &retryStats{}
+		dbRetryStats[op] = s
+	}
+	update(s)
+}
+
+// permanentError stops withRetry even if the wrapped error looks transient.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+type conflictRetriesKey struct{}
+
+// withConflictCounter returns a context in which withRetry counts its
+// retries after serialization failures and deadlocks, which a handler
+// reports as conflict_retries.
+func withConflictCounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	n := new(atomic.Int64)
+	return context.WithValue(ctx, conflictRetriesKey{}, n), n
+}
+
+// withRetry runs fn, an idempotent unit of work, and runs it again up to
+// DB_RETRIES times on transient database errors. Attempts back off
+// exponentially from DB_RETRY_DELAY with jitter. No retry is started that
+// would sleep past the deadline of ctx. A unit that writes must be a whole
+// transaction: it either committed or rolled back before fn returned.
+func withRetry(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 0 {
+				recordRetry(op, func(s *retryStats) { s.Recovered++ })
+			}
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || !isTransientDBError(err) {
+			return err
+		}
+
+		delay := backoffDelay(attempt)
+		deadline, hasDeadline := ctx.Deadline()
+		if attempt >= cfg.dbRetries || ctx.Err() != nil || (hasDeadline && time.Now().Add(delay).After(deadline)) {
+			recordRetry(op, func(s *retryStats) { s.Exhausted++ })
+			return err
+		}
+
+		recordRetry(op, func(s *retryStats) { s.Retries++ })
+		if n, ok := ctx.Value(conflictRetriesKey{}).(*atomic.Int64); ok && isConflictError(err) {
+			n.Add(1)
+		}
+		log.Printf("Transient database error in %s (attempt %d/%d), retrying in %s: %v", op, attempt+1, cfg.dbRetries+1, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoffDelay doubles DB_RETRY_DELAY per attempt and picks a random delay
+// between half and the full value, so instances recovering from the same
+// failover do not retry in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	delay := min(cfg.dbRetryDelay<<attempt, maxRetryDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// queryWithRetry starts a read-only query under withRetry. Only starting
+// the query is retried; errors while reading rows are not.
+func queryWithRetry(ctx context.Context, op, query string, args ...interface{}) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := withRetry(ctx, op, func() error {
+		var err error
+		rows, err = db.Query(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// isTransientDBError reports errors that a fresh attempt may not hit:
+// connection failures (SQLSTATE class 08, resets, failed connects),
+// cannot_connect_now during a restart, serialization failures and
+// deadlocks.
+func isTransientDBError(err error) bool {
+	if isConflictError(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "57P03" || strings.HasPrefix(pgErr.Code, "08")
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || pgconn.SafeToRetry(err)
+}
+
+// isConflictError reports a transaction that lost to a concurrent one: a
+// serialization failure or a deadlock.
+func isConflictError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+func getAdminMetrics(c *gin.Context) {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	stats := make(map[string]retryStats, len(dbRetryStats))
+	for op, s := range dbRetryStats {
+		stats[op] = *s
+	}
+	c.JSON(http.StatusOK, gin.H{"db_retries": stats, "memory_guard": memoryGuardSnapshot(), "janitor": janitorSnapshot(),
+		"deprecated_usage": deprecatedUsageSnapshot(), "degraded": degradedSubsystems()})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// invalidLabelPrefix starts the label revalidation puts on a row failing the
+// current rules, followed by the reason, e.g. invalid:below_min_price.
+const invalidLabelPrefix = "invalid:"
+
+// storedColumns reads a stored row back through validateRecord: the
+// positional layout with external_id after valid_to.
+var storedColumns = columnMap{id: 0, name: 1, category: 2, price: 3, createDate: 4, validFrom: 5, validTo: 6, externalID: 7}
+
+// revalidation is what a scan of the stored rows found.
+type revalidation struct {
+	scanned        int64
+	invalid        int
+	reasons        map[string]int
+	ruleRejections map[int64]int
+}
+
+func newRevalidation() *revalidation {
+	return &revalidation{reasons: make(map[string]int), ruleRejections: make(map[int64]int)}
+}
+
+func (r *revalidation) record(reason string, fired *priceRule) {
+	r.scanned++
+	if reason == "" {
+		return
+	}
+	r.invalid++
+	r.reasons[reason]++
+	if fired != nil {
+		r.ruleRejections[fired.ID]++
+	}
+}
+
+func (r *revalidation) merge(o *revalidation) {
+	r.scanned += o.scanned
+	r.invalid += o.invalid
+	for reason, n := range o.reasons {
+		r.reasons[reason] += n
+	}
+	for id, n := range o.ruleRejections {
+		r.ruleRejections[id] += n
+	}
+}
+
+// storedPrice is a row as revalidation reads it.
+type storedPrice struct {
+	id                 int64
+	name, category     string
+	price              float64
+	createDate         time.Time
+	validFrom, validTo *time.Time
+	externalID         *string
+	labels             []string
+}
+
+// revalidatePrices checks the rows matching the export filters against the
+// current validation rules and price rules, so rows stored before the rules
+// were tightened can be found. Failing rows are labelled invalid:<reason>,
+// and rows that pass lose a stale invalid: label; with ?delete=true they
+// are deleted instead. The counts are by reason, as in the upload summary.
+//
+// The scope is walked in id order, REVALIDATE_BATCH_SIZE rows at a time,
+// and each batch is written in a transaction of its own that locks only the
+// rows it changes, so uploads are not held up for the whole scan. A
+// revalidation that fails part way keeps the batches already written.
+func revalidatePrices(c *gin.Context) {
+	del, err := parseBoolParam(c, "delete")
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	filter, err := parsePriceFilter(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	priceRules, err := loadPriceRules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errPriceRulesUnavailable.Error()})
+		return
+	}
+
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+	found := newRevalidation()
+	var changed int64
+	var afterID int64
+	for {
+		batch, err := readRevalidationBatch(ctx, filter, afterID)
+		if err == nil && len(batch) == 0 {
+			break
+		}
+		if err == nil {
+			afterID = batch[len(batch)-1].id
+			var part *revalidation
+			var n int64
+			err = withRetry(ctx, "revalidate", func() error {
+				return pgx.BeginFunc(context.Background(), db, func(tx pgx.Tx) error {
+					var err error
+					part, n, err = revalidateBatch(tx, filter, batch, priceRules, del)
+					return err
+				})
+			})
+			if err == nil {
+				found.merge(part)
+				changed += n
+			}
+		}
+		var se *storeError
+		switch {
+		case errors.As(err, &se):
+			c.JSON(http.StatusInternalServerError, gin.H{"error": se.message})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+			return
+		}
+	}
+	if changed > 0 {
+		exportArchives.purge()
+	}
+
+	result := gin.H{
+		"scanned_count":         found.scanned,
+		"invalid_count":         found.invalid,
+		"rejected":              found.reasons,
+		"price_rule_rejections": found.ruleRejections,
+		"conflict_retries":      conflictRetries.Load(),
+	}
+	if del {
+		result["deleted_count"] = changed
+	} else {
+		result["updated_count"] = changed
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// readRevalidationBatch reads the next batch of the scope after afterID,
+// without locking anything.
+func readRevalidationBatch(ctx context.Context, filter *priceFilter, afterID int64) ([]storedPrice, error) {
+	f := filter.clone()
+	f.add("id > %s", afterID)
+	query := "SELECT " + storedPriceColumns() + " FROM prices WHERE 1=1" + f.sql() +
+		" ORDER BY id LIMIT " + f.arg(max(1, cfg.revalidateBatchSize))
+	logQuery("revalidatePrices", query, f.args)
+	return queryStoredPrices(ctx, db, query, f.args)
+}
+
+func storedPriceColumns() string {
+	return "id, name, category, " + priceColumn() + ", create_date, valid_from, valid_to, external_id, labels"
+}
+
+// querier is what both the pool and a transaction read through.
+type querier interface {
+	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+}
+
+func queryStoredPrices(ctx context.Context, q querier, query string, args []interface{}) ([]storedPrice, error) {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, &storeError{"failed to read records", err}
+	}
+	defer rows.Close()
+	var prices []storedPrice
+	for rows.Next() {
+		var p storedPrice
+		if err := rows.Scan(&p.id, &p.name, &p.category, &p.price, &p.createDate, &p.validFrom, &p.validTo, &p.externalID, &p.labels); err != nil {
+			return nil, &storeError{"failed to scan row", err}
+		}
+		prices = append(prices, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &storeError{"failed to read records", err}
+	}
+	return prices, nil
+}
+
+// revalidateBatch checks a batch read without locks and writes the rows
+// whose outcome changes. Those rows are locked in id order and checked
+// again, as they may have changed since the read; a row that has left the
+// scope meanwhile is skipped.
+func revalidateBatch(tx pgx.Tx, filter *priceFilter, batch []storedPrice, priceRules *priceRuleSet, del bool) (*revalidation, int64, error) {
+	found := newRevalidation()
+	var pending []int64
+	for _, p := range batch {
+		reason, fired := checkStoredPrice(p, priceRules)
+		if needsRevalidationWrite(p, reason, del) {
+			pending = append(pending, p.id)
+			continue
+		}
+		found.record(reason, fired)
+	}
+	if len(pending) == 0 {
+		return found, 0, nil
+	}
+
+	ctx := context.Background()
+	if err := lockChangeFeed(ctx, tx); err != nil {
+		return nil, 0, &storeError{"database error", err}
+	}
+	f := filter.clone()
+	f.add("id = ANY(%s)", pending)
+	query := "SELECT " + storedPriceColumns() + " FROM prices WHERE 1=1" + f.sql() + " ORDER BY id FOR UPDATE"
+	logQuery("revalidatePrices", query, f.args)
+	locked, err := queryStoredPrices(ctx, tx, query, f.args)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ids []int64
+	var labels []string
+	for _, p := range locked {
+		reason, fired := checkStoredPrice(p, priceRules)
+		found.record(reason, fired)
+		if needsRevalidationWrite(p, reason, del) {
+			ids = append(ids, p.id)
+			labels = append(labels, invalidLabel(reason))
+		}
+	}
+	if del {
+		n, err := deleteInvalid(tx, ids)
+		return found, n, err
+	}
+	n, err := flagInvalid(tx, ids, labels)
+	return found, n, err
+}
+
+// checkStoredPrice runs a row through validateRecord and the price rules
+// and returns why it fails, or "".
+func checkStoredPrice(p storedPrice, priceRules *priceRuleSet) (string, *priceRule) {
+	rules := validationRules{dateLayouts: []string{isoDateLayout}, columns: storedColumns}
+	record := []string{"", p.name, p.category, strconv.FormatFloat(p.price, 'f', -1, 64), p.createDate.Format(isoDateLayout),
+		formatOptionalDate(p.validFrom), formatOptionalDate(p.validTo), ""}
+	if p.externalID != nil {
+		record[7] = *p.externalID
+	}
+	rec, reason := validateRecord(record, rules)
+	if reason != "" {
+		return reason, nil
+	}
+	if fired, _ := priceRules.check(rec.category, rec.price); fired != nil {
+		return rejectPriceOutOfBounds, fired
+	}
+	return "", nil
+}
+
+// needsRevalidationWrite reports whether the outcome for p changes the
+// row: a failing row is deleted, or its invalid: labels differ from the
+// one it should carry.
+func needsRevalidationWrite(p storedPrice, reason string, del bool) bool {
+	if del {
+		return reason != ""
+	}
+	return !slices.Equal(p.labels, relabel(p.labels, invalidLabel(reason)))
+}
+
+// invalidLabel is the label for reason, or "" for a row that passes.
+func invalidLabel(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return invalidLabelPrefix + reason
+}
+
+// relabel replaces the invalid: labels among labels with label, as
+// flagInvalid does in SQL.
+func relabel(labels []string, label string) []string {
+	out := make([]string, 0, len(labels)+1)
+	for _, l := range labels {
+		if !strings.HasPrefix(l, invalidLabelPrefix) {
+			out = append(out, l)
+		}
+	}
+	if label != "" {
+		out = append(out, label)
+	}
+	return out
+}
+
+func formatOptionalDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(isoDateLayout)
+}
+
+func deleteInvalid(tx pgx.Tx, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	tag, err := tx.Exec(context.Background(), "DELETE FROM prices WHERE id = ANY($1)", ids)
+	if err != nil {
+		return 0, &storeError{"failed to delete records", err}
+	}
+	return tag.RowsAffected(), nil
+}
+
+// flagInvalid replaces the invalid: labels of the rows with the paired
+// label, dropping them where the label is "".
+func flagInvalid(tx pgx.Tx, ids []int64, labels []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	query := `UPDATE prices SET labels = ARRAY(SELECT l FROM unnest(prices.labels) l WHERE l NOT LIKE $3)
+			|| array_remove(ARRAY[v.label], '')
+		FROM unnest($1::bigint[], $2::text[]) v(id, label)
+		WHERE prices.id = v.id`
+	args := []interface{}{ids, labels, invalidLabelPrefix + "%"}
+	logQuery("revalidatePrices", query, args)
+	tag, err := tx.Exec(context.Background(), query, args...)
+	if err != nil {
+		return 0, &storeError{"failed to label records", err}
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+type roundingMode string
+
+const (
+	roundHalfUp     roundingMode = "half_up"
+	roundHalfEven   roundingMode = "half_even"
+	roundTruncate   roundingMode = "truncate"
+	defaultRounding              = roundHalfUp
+)
+
+func parseRoundingMode(raw string) (roundingMode, error) {
+	switch mode := roundingMode(raw); mode {
+	case "":
+		return defaultRounding, nil
+	case roundHalfUp, roundHalfEven, roundTruncate:
+		return mode, nil
+	}
+	return "", &filterError{param: "rounding", message: "must be one of half_up, half_even, truncate"}
+}
+
+// roundMoney rounds v to whole cents. The value is rounded on its shortest
+// decimal representation rather than its binary one, so 1.005 is treated as
+// exactly halfway between 1.00 and 1.01.
+func roundMoney(v float64, mode roundingMode) float64 {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	intPart, frac, _ := strings.Cut(s, ".")
+	if len(frac) <= 2 {
+		return v
+	}
+
+	cents, _ := new(big.Int).SetString(intPart+frac[:2], 10)
+	rest := frac[2:]
+
+	var up bool
+	switch mode {
+	case roundHalfUp:
+		up = rest[0] >= '5'
+	case roundHalfEven:
+		switch {
+		case rest[0] > '5':
+			up = true
+		case rest[0] == '5' && strings.Trim(rest[1:], "0") != "":
+			up = true
+		case rest[0] == '5':
+			up = cents.Bit(0) == 1
+		}
+	}
+	if up {
+		cents.Add(cents, big.NewInt(1))
+	}
+
+	digits := fmt.Sprintf("%03s", cents.String())
+	result, _ := strconv.ParseFloat(digits[:len(digits)-2]+"."+digits[len(digits)-2:], 64)
+	if negative {
+		result = -result
+	}
+	return result
+}
+
+func formatMoney(v float64, mode roundingMode) string {
+	return strconv.FormatFloat(roundMoney(v, mode), 'f', 2, 64)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter registers every route under cfg.basePath.
+func newRouter() (*gin.Engine, error) {
+	r := gin.Default()
+	// With no TRUSTED_PROXIES no forwarding header is trusted and
+	// c.ClientIP() is the direct peer address.
+	if err := r.SetTrustedProxies(cfg.trustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	r.NoRoute(notFound)
+
+	openAPI, err := openAPIHandler()
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded OpenAPI spec: %w", err)
+	}
+
+	root := r.Group(cfg.basePath)
+	root.GET("/readyz", readyz)
+	root.GET("/version", getVersion)
+	root.GET("/openapi.json", openAPI)
+	root.StaticFS("/ui", uiFS())
+
+	api := root.Group("/", drainMiddleware(), deprecateV0())
+
+	v0 := api.Group("/api/v0", authenticate(), readAllCategories(), meterUsage())
+	v0.POST("/prices", requireMemoryHeadroom(), requireWritableDB(), uploadPrices)
+	v0.POST("/prices/base64", requireMemoryHeadroom(), requireWritableDB(), uploadPricesBase64)
+	v0.POST("/prices/reconcile", requireMemoryHeadroom(), requireWritableDB(), reconcilePrices)
+	v0.GET("/prices", requireMemoryHeadroom(), applyPreset(), getPrices)
+	v0.GET("/prices/names", getPriceNames)
+	v0.GET("/prices/aggregate", applyPreset(), getAggregate)
+	v0.GET("/prices/extremes", applyPreset(), getPriceExtremes)
+	v0.POST("/prices/validate-record", validatePriceRecord)
+	v0.POST("/prices/label", requireWritableDB(), labelPrices)
+	v0.GET("/prices/changes", getPriceChanges)
+	v0.GET("/prices/diff", requireMemoryHeadroom(), getPriceDiff)
+	v0.GET("/prices/stream", streamPrices)
+	v0.GET("/prices/anomalies", getPriceAnomalies)
+	v0.GET("/prices/quality", getPriceQuality)
+	v0.GET("/prices/schema.sql", getPricesSchemaSQL)
+	v0.GET("/prices/schema", getPricesSchema)
+	v0.GET("/categories", applyPreset(), getCategories)
+
+	v0.GET("/limits", getLimits)
+
+	v0.GET("/filters", listPresets)
+	v0.POST("/filters", requireWritableDB(), createPreset)
+	v0.GET("/filters/:name", getPreset)
+	v0.PUT("/filters/:name", requireWritableDB(), updatePreset)
+	v0.DELETE("/filters/:name", requireWritableDB(), deletePreset)
+
+	// The flag is checked ahead of the drain, deprecation and key checks, so
+	// a disabled session route answers like NoRoute even without a key.
+	sessions := root.Group("/api/v0/uploads/sessions", requireFeature(featureAsyncUpload),
+		drainMiddleware(), deprecateV0(), authenticate(), readAllCategories(), meterUsage())
+	sessions.POST("", requireWritableDB(), createUploadSession)
+	sessions.GET("/:id", getUploadSession)
+	sessions.PUT("/:id", requireMemoryHeadroom(), putUploadChunk)
+	sessions.POST("/:id/complete", requireMemoryHeadroom(), requireWritableDB(), completeUploadSession)
+	sessions.DELETE("/:id", deleteUploadSession)
+
+	api.GET("/api/v0/uploads", requireAdmin(), listUploads)
+	api.GET("/api/v0/uploads/diff", requireAdmin(), compareUploads)
+	api.DELETE("/api/v0/uploads/:batch_id", requireAdmin(), requireWritableDB(), rollbackUpload)
+	api.POST("/api/v0/uploads/:batch_id/approve", requireAdmin(), requireWritableDB(), approveUpload)
+	api.POST("/api/v0/uploads/:batch_id/reject", requireAdmin(), requireWritableDB(), rejectUpload)
+	api.GET("/api/v0/uploads/:batch_id/what-if", requireAdmin(), whatIfUpload)
+	api.POST("/api/v0/prices/revalidate", requireAdmin(), requireWritableDB(), revalidatePrices)
+
+	admin := api.Group("/api/v0/admin", requireAdmin())
+	admin.GET("/config", getAdminConfig)
+	admin.PATCH("/config", patchAdminConfig)
+	admin.GET("/metrics", getAdminMetrics)
+	admin.GET("/usage", getUsage)
+	admin.POST("/janitor/run", postJanitorRun)
+	admin.GET("/backup", requireMemoryHeadroom(), getBackup)
+	admin.POST("/restore", requireMemoryHeadroom(), requireWritableDB(), postRestore)
+	admin.GET("/alerts", listAlerts)
+	admin.POST("/alerts", requireWritableDB(), createAlert)
+	admin.GET("/alerts/:id", getAlert)
+	admin.PUT("/alerts/:id", requireWritableDB(), updateAlert)
+	admin.DELETE("/alerts/:id", requireWritableDB(), deleteAlert)
+	admin.GET("/price-rules", listPriceRules)
+	admin.POST("/price-rules", requireWritableDB(), createPriceRule)
+	admin.GET("/price-rules/:id", getPriceRule)
+	admin.PUT("/price-rules/:id", requireWritableDB(), updatePriceRule)
+	admin.DELETE("/price-rules/:id", requireWritableDB(), deletePriceRule)
+	admin.GET("/quarantine-thresholds", listQuarantineThresholds)
+	admin.PUT("/quarantine-thresholds/:supplier", requireWritableDB(), putQuarantineThresholds)
+	admin.DELETE("/quarantine-thresholds/:supplier", requireWritableDB(), deleteQuarantineThresholds)
+
+	return r, nil
+}
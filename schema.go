@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// columnSpec describes a column of prices. The list is what the schema
+// endpoints print and what mapHeader looks up in a CSV header, so a column
+// added by a migration must be added here too.
+type columnSpec struct {
+	name string
+	// sqlType is the PostgreSQL type the migrations create the column with,
+	// the key of warehouseTypes.
+	sqlType    string
+	notNull    bool
+	primaryKey bool
+	// def is the PostgreSQL DEFAULT expression, if any.
+	def string
+	// csv marks the columns an upload reads by header name; required ones
+	// must be in a header.
+	csv      bool
+	required bool
+}
+
+var pricesColumns = []columnSpec{
+	{name: "id", sqlType: "SERIAL", primaryKey: true, notNull: true, csv: true},
+	{name: "name", sqlType: "VARCHAR(255)", notNull: true, csv: true, required: true},
+	{name: "category", sqlType: "VARCHAR(255)", notNull: true, csv: true, required: true},
+	{name: "price", sqlType: "DECIMAL(10, 2)", notNull: true, csv: true, required: true},
+	{name: "create_date", sqlType: "TIMESTAMP", notNull: true, csv: true, required: true},
+	{name: "batch_id", sqlType: "UUID"},
+	{name: "name_norm", sqlType: "TEXT"},
+	{name: "price_cents", sqlType: "BIGINT"},
+	{name: "valid_from", sqlType: "DATE", csv: true},
+	{name: "valid_to", sqlType: "DATE", csv: true},
+	{name: "supplier", sqlType: "TEXT"},
+	{name: "external_id", sqlType: "VARCHAR(255)", csv: true},
+	{name: "labels", sqlType: "TEXT[]", notNull: true, def: "'{}'"},
+}
+
+// columnWidth is the number of characters the VARCHAR column name holds,
+// as declared in pricesColumns, so validation rejects what the column would.
+// It panics for a column that is not a VARCHAR.
+func columnWidth(name string) int {
+	for _, col := range pricesColumns {
+		var width int
+		if col.name == name {
+			if _, err := fmt.Sscanf(col.sqlType, "VARCHAR(%d)", &width); err != nil {
+				panic("prices." + name + " is not a VARCHAR")
+			}
+			return width
+		}
+	}
+	panic("prices has no column " + name)
+}
+
+// pricesIndexes are the indexes the migrations create on prices, besides
+// the primary key.
+var pricesIndexes = []string{
+	"CREATE INDEX prices_batch_id_idx ON prices (batch_id)",
+	"CREATE INDEX prices_name_norm_idx ON prices (name_norm text_pattern_ops)",
+	"CREATE INDEX prices_identity_ci_idx ON prices (lower(name), lower(category))",
+	"CREATE INDEX prices_supplier_idx ON prices (supplier, create_date)",
+	"CREATE INDEX prices_create_date_idx ON prices (create_date)",
+	"CREATE UNIQUE INDEX prices_external_id_idx ON prices (COALESCE(supplier, ''), external_id) WHERE external_id IS NOT NULL",
+	"CREATE INDEX prices_labels_idx ON prices USING GIN (labels)",
+}
+
+// Warehouse dialects for ?dialect=.
+const (
+	dialectBigQuery   = "bigquery"
+	dialectClickHouse = "clickhouse"
+)
+
+// warehouseTypes maps each PostgreSQL type of pricesColumns to its closest
+// type in the warehouse dialects. create_date holds a calendar date in a
+// TIMESTAMP without time zone, so it maps to a type without one as well.
+var warehouseTypes = map[string]map[string]string{
+	"SERIAL":         {dialectBigQuery: "INT64", dialectClickHouse: "Int32"},
+	"BIGINT":         {dialectBigQuery: "INT64", dialectClickHouse: "Int64"},
+	"VARCHAR(255)":   {dialectBigQuery: "STRING(255)", dialectClickHouse: "String"},
+	"TEXT":           {dialectBigQuery: "STRING", dialectClickHouse: "String"},
+	"DECIMAL(10, 2)": {dialectBigQuery: "NUMERIC(10, 2)", dialectClickHouse: "Decimal(10, 2)"},
+	"TIMESTAMP":      {dialectBigQuery: "DATETIME", dialectClickHouse: "DateTime"},
+	"DATE":           {dialectBigQuery: "DATE", dialectClickHouse: "Date32"},
+	"UUID":           {dialectBigQuery: "STRING", dialectClickHouse: "UUID"},
+	"TEXT[]":         {dialectBigQuery: "ARRAY<STRING>", dialectClickHouse: "Array(String)"},
+}
+
+// schemaHeader starts every DDL with the schema version it describes.
+func schemaHeader(dialect string) string {
+	return fmt.Sprintf("-- prices, schema version %d (%s)\n", len(migrations), dialect)
+}
+
+// postgresSchema is the CREATE TABLE and CREATE INDEX statements that give
+// a fresh database the prices table the migrations end with.
+func postgresSchema() string {
+	var b strings.Builder
+	b.WriteString(schemaHeader("postgresql"))
+	b.WriteString("CREATE TABLE prices (\n")
+	for i, col := range pricesColumns {
+		b.WriteString("    " + col.name + " " + col.sqlType)
+		switch {
+		case col.primaryKey:
+			b.WriteString(" PRIMARY KEY")
+		case col.notNull:
+			b.WriteString(" NOT NULL")
+		}
+		if col.def != "" {
+			b.WriteString(" DEFAULT " + col.def)
+		}
+		if i < len(pricesColumns)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+	for _, index := range pricesIndexes {
+		b.WriteString(index + ";\n")
+	}
+	return b.String()
+}
+
+// warehouseSchema translates the table to a warehouse dialect, best
+// effort: types go through warehouseTypes, and indexes and defaults, which
+// the warehouses handle their own way, are left out. BigQuery gets the
+// primary key as an unenforced constraint; ClickHouse wraps nullable
+// columns in Nullable and sorts a MergeTree by id.
+func warehouseSchema(dialect string) string {
+	var b strings.Builder
+	b.WriteString(schemaHeader(dialect))
+	b.WriteString("CREATE TABLE prices (\n")
+	lines := make([]string, 0, len(pricesColumns)+1)
+	for _, col := range pricesColumns {
+		typ := warehouseTypes[col.sqlType][dialect]
+		array := strings.HasSuffix(col.sqlType, "[]")
+		switch {
+		case dialect == dialectClickHouse && !col.notNull && !array:
+			typ = "Nullable(" + typ + ")"
+		case dialect == dialectBigQuery && col.notNull && !array:
+			// BigQuery arrays are never NULL, and cannot be declared NOT NULL.
+			typ += " NOT NULL"
+		}
+		lines = append(lines, "    "+col.name+" "+typ)
+	}
+	if dialect == dialectBigQuery {
+		lines = append(lines, "    PRIMARY KEY (id) NOT ENFORCED")
+	}
+	b.WriteString(strings.Join(lines, ",\n"))
+	b.WriteString("\n)")
+	if dialect == dialectClickHouse {
+		b.WriteString("\nENGINE = MergeTree\nORDER BY id")
+	}
+	b.WriteString(";\n")
+	return b.String()
+}
+
+// getPricesSchemaSQL answers with the PostgreSQL DDL of prices, for tools
+// that keep their own copy of the table definition.
+func getPricesSchemaSQL(c *gin.Context) {
+	c.Data(http.StatusOK, "application/sql; charset=utf-8", []byte(postgresSchema()))
+}
+
+// getPricesSchema answers with the DDL of prices in ?dialect=: bigquery,
+// clickhouse, or postgresql as in schema.sql.
+func getPricesSchema(c *gin.Context) {
+	var ddl string
+	switch dialect := c.DefaultQuery("dialect", "postgresql"); dialect {
+	case "postgresql":
+		ddl = postgresSchema()
+	case dialectBigQuery, dialectClickHouse:
+		ddl = warehouseSchema(dialect)
+	default:
+		respondFilterError(c, &filterError{param: "dialect", message: "must be one of postgresql, bigquery, clickhouse"})
+		return
+	}
+	c.Data(http.StatusOK, "application/sql; charset=utf-8", []byte(ddl))
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	sha256Pattern       = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+)
+
+// byteRange is an inclusive range of received bytes.
+type byteRange struct {
+	start, end int64
+}
+
+// uploadSession is a resumable upload assembled in a temporary file. Chunks
+// are written at their offsets, so they may arrive in any order and be
+// retried; where chunks overlap, the bytes of the later one are kept and
+// the checksum on completion decides whether the result is usable.
+//
+// mu guards the fields, not the file: chunks are copied into the file
+// without it, and writers counts the copies in flight so the file is
+// neither hashed nor closed under them.
+type uploadSession struct {
+	mu        sync.Mutex
+	id        string
+	owner     string
+	filename  string
+	checksum  string
+	file      *spooledUpload
+	received  []byteRange
+	expiresAt time.Time
+	done      bool
+	writers   int
+	closed    bool
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+var uploadSessions = sessionStore{sessions: make(map[string]*uploadSession)}
+
+// add merges r into the received ranges, keeping them sorted and disjoint.
+func (s *uploadSession) add(r byteRange) {
+	ranges := append(s.received, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.start <= last.end+1 {
+			last.end = max(last.end, next.end)
+			continue
+		}
+		merged = append(merged, next)
+	}
+	s.received = merged
+}
+
+func (s *uploadSession) receivedBytes() int64 {
+	var n int64
+	for _, r := range s.received {
+		n += r.end - r.start + 1
+	}
+	return n
+}
+
+func (s *uploadSession) summary() gin.H {
+	received := make([][2]int64, len(s.received))
+	for i, r := range s.received {
+		received[i] = [2]int64{r.start, r.end}
+	}
+	return gin.H{
+		"id":             s.id,
+		"filename":       s.filename,
+		"size":           s.file.size,
+		"received":       received,
+		"received_bytes": s.receivedBytes(),
+		"expires_at":     s.expiresAt,
+	}
+}
+
+// remove deletes the session and its temporary file. The session must be
+// done; if a chunk is still being copied, the file is closed once the copy
+// ends.
+func (st *sessionStore) remove(s *uploadSession) {
+	st.mu.Lock()
+	delete(st.sessions, s.id)
+	st.mu.Unlock()
+	s.mu.Lock()
+	s.closeIdle()
+	s.mu.Unlock()
+}
+
+// closeIdle closes the file of a done session once no chunk is being
+// copied into it. The caller holds s.mu.
+func (s *uploadSession) closeIdle() {
+	if s.done && s.writers == 0 && !s.closed {
+		s.closed = true
+		s.file.Close()
+	}
+}
+
+// lookup returns a live session owned by the caller.
+func (st *sessionStore) lookup(c *gin.Context) *uploadSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[c.Param("id")]
+	if !ok || s.owner != keyOwner(c) {
+		return nil
+	}
+	return s
+}
+
+// reapExpired removes sessions idle for longer than UPLOAD_SESSION_TTL and
+// frees their temporary space. It runs until ctx is cancelled.
+func (st *sessionStore) reapExpired(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			st.expire(now)
+		}
+	}
+}
+
+// expire removes the sessions expired by now and returns how many there
+// were and the temporary space they held. A session being completed is
+// done already and is left to its request, and one receiving a chunk is not
+// idle. The store lock is released before any session lock is taken.
+func (st *sessionStore) expire(now time.Time) (int, int64) {
+	st.mu.Lock()
+	sessions := make([]*uploadSession, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		sessions = append(sessions, s)
+	}
+	st.mu.Unlock()
+
+	var expired []*uploadSession
+	var freed int64
+	for _, s := range sessions {
+		s.mu.Lock()
+		if now.After(s.expiresAt) && !s.done && s.writers == 0 {
+			s.done = true
+			freed += s.file.size
+			expired = append(expired, s)
+		}
+		s.mu.Unlock()
+	}
+
+	for _, s := range expired {
+		st.remove(s)
+		log.Printf("Upload session %s expired", s.id)
+	}
+	return len(expired), freed
+}
+
+func createUploadSession(c *gin.Context) {
+	var body struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+		SHA256   string `json:"sha256"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if body.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be positive"})
+		return
+	}
+	if !sha256Pattern.MatchString(body.SHA256) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 must be 64 lowercase hex digits"})
+		return
+	}
+
+	file, err := reserveUpload(body.Size)
+	if errors.Is(err, errTempBudgetExceeded) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to create session file"})
+		return
+	}
+
+	s := &uploadSession{
+		id:        newUUID(),
+		owner:     keyOwner(c),
+		filename:  body.Filename,
+		checksum:  body.SHA256,
+		file:      file,
+		expiresAt: time.Now().Add(cfg.uploadSessionTTL),
+	}
+	uploadSessions.mu.Lock()
+	uploadSessions.sessions[s.id] = s
+	uploadSessions.mu.Unlock()
+
+	c.JSON(http.StatusCreated, s.summary())
+}
+
+func getUploadSession(c *gin.Context) {
+	s := uploadSessions.lookup(c)
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.JSON(http.StatusOK, s.summary())
+}
+
+// putUploadChunk writes one Content-Range chunk. Sending the same range
+// again is harmless. The body is copied without holding the session lock,
+// so a slow client holds up neither other chunks nor status requests.
+func putUploadChunk(c *gin.Context) {
+	s := uploadSessions.lookup(c)
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+
+	m := contentRangePattern.FindStringSubmatch(c.GetHeader("Content-Range"))
+	if m == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Range must be bytes start-end/total"})
+		return
+	}
+	start, _ := strconv.ParseInt(m[1], 10, 64)
+	end, _ := strconv.ParseInt(m[2], 10, 64)
+	total, _ := strconv.ParseInt(m[3], 10, 64)
+
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	if total != s.file.size || start > end || end >= s.file.size {
+		size := s.file.size
+		s.mu.Unlock()
+		c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": fmt.Sprintf("range must lie within the declared size of %d bytes", size)})
+		return
+	}
+	s.writers++
+	s.mu.Unlock()
+
+	length := end - start + 1
+	n, err := io.Copy(io.NewOffsetWriter(s.file, start), io.LimitReader(c.Request.Body, length))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writers--
+	if s.done {
+		// Deleted or expired while the chunk was copied.
+		s.closeIdle()
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to write chunk"})
+		return
+	}
+	if n != length {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunk body has %d bytes, Content-Range declares %d", n, length)})
+		return
+	}
+
+	s.add(byteRange{start, end})
+	s.expiresAt = time.Now().Add(cfg.uploadSessionTTL)
+	c.JSON(http.StatusOK, s.summary())
+}
+
+// completeUploadSession verifies the assembled file and runs it through the
+// regular upload processing, taking the same query parameters and password
+// form field as POST /api/v0/prices.
+func completeUploadSession(c *gin.Context) {
+	opts, err := parseUploadOptions(c)
+	if err != nil {
+		respondUploadOptionsError(c, err)
+		return
+	}
+	opts.password = c.PostForm("password")
+	if opts.metadata, err = parseUploadMetadata(c.PostForm("metadata")); err != nil {
+		if errors.Is(err, errInvalidMetadata) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		} else {
+			respondFilterError(c, err)
+		}
+		return
+	}
+
+	s := uploadSessions.lookup(c)
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	if s.writers > 0 {
+		s.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "chunks are still being written"})
+		return
+	}
+	if missing := s.file.size - s.receivedBytes(); missing > 0 {
+		summary := s.summary()
+		s.mu.Unlock()
+		summary["error"] = fmt.Sprintf("%d bytes have not been received", missing)
+		c.JSON(http.StatusConflict, summary)
+		return
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, io.NewSectionReader(s.file, 0, s.file.size))
+	if err != nil {
+		s.mu.Unlock()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read session file"})
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != s.checksum {
+		s.mu.Unlock()
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "sha256 of the assembled file does not match"})
+		return
+	}
+
+	// The session is consumed from here on, whatever the outcome.
+	s.done = true
+	s.mu.Unlock()
+	defer uploadSessions.remove(s)
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read session file"})
+		return
+	}
+	beginUploadAttempt(c, s.filename, s.file.Name(), opts)
+	defer finishUploadAttempt(c)
+	processUpload(c, s.file, s.filename, opts)
+}
+
+func deleteUploadSession(c *gin.Context) {
+	s := uploadSessions.lookup(c)
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	s.mu.Lock()
+	done := s.done
+	s.done = true
+	s.mu.Unlock()
+	if done {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+		return
+	}
+	uploadSessions.remove(s)
+	c.Status(http.StatusNoContent)
+}
+
+// reserveUpload creates an empty temporary file and reserves size bytes of
+// the temp-space budget for it up front.
+func reserveUpload(size int64) (*spooledUpload, error) {
+	if tempSpaceUsed.Add(size) > int64(cfg.uploadTempBudget) {
+		tempSpaceUsed.Add(-size)
+		return nil, errTempBudgetExceeded
+	}
+
+	f, err := os.CreateTemp("", sessionTempPattern)
+	if err != nil {
+		tempSpaceUsed.Add(-size)
+		return nil, err
+	}
+	liveTempFiles.Store(f.Name(), true)
+	return &spooledUpload{File: f, size: size}, nil
+}
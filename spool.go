@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var errTempBudgetExceeded = errors.New("upload does not fit into the temporary space budget")
+
+// tempSpaceUsed is the number of bytes currently held in spooled uploads
+// across all requests, checked against cfg.uploadTempBudget.
+var tempSpaceUsed atomic.Int64
+
+// liveTempFiles are the paths of this process's open spooled uploads, which
+// the janitor must not remove however old they are.
+var liveTempFiles sync.Map
+
+// Temporary files are created with these patterns so the janitor can
+// recognise the ones a crashed process left behind.
+const (
+	uploadTempPattern  = "prices-upload-*"
+	sessionTempPattern = "prices-session-*"
+)
+
+// spooledUpload is an uploaded archive copied to a temporary file so it can
+// be read with random access (zip) without keeping it in memory.
+type spooledUpload struct {
+	*os.File
+	size int64
+}
+
+// spoolUpload copies src into a temporary file, reserving its size against
+// the temp-space budget as it goes. On error nothing is left on disk.
+func spoolUpload(src io.Reader) (*spooledUpload, error) {
+	f, err := os.CreateTemp("", uploadTempPattern)
+	if err != nil {
+		return nil, err
+	}
+	liveTempFiles.Store(f.Name(), true)
+
+	s := &spooledUpload{File: f}
+	if _, err := io.Copy(budgetWriter{s}, src); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close removes the temporary file and returns its space to the budget.
+func (s *spooledUpload) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	liveTempFiles.Delete(s.Name())
+	tempSpaceUsed.Add(-s.size)
+	s.size = 0
+	return err
+}
+
+type budgetWriter struct {
+	s *spooledUpload
+}
+
+func (w budgetWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if tempSpaceUsed.Add(n) > int64(cfg.uploadTempBudget) {
+		tempSpaceUsed.Add(-n)
+		return 0, errTempBudgetExceeded
+	}
+	w.s.size += n
+
+	written, err := w.s.File.Write(p)
+	if unused := n - int64(written); unused > 0 {
+		tempSpaceUsed.Add(-unused)
+		w.s.size -= unused
+	}
+	return written, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// LOG_SQL modes. Argument values can carry customer data, so they are only
+// logged when asked for explicitly.
+const (
+	logSQLOff   = ""
+	logSQLOn    = "true"
+	logSQLValue = "args"
+)
+
+func envLogSQL() string {
+	switch value := os.Getenv("LOG_SQL"); value {
+	case "", "false":
+		return logSQLOff
+	case logSQLOn, logSQLValue:
+		return value
+	default:
+		log.Printf("Invalid LOG_SQL=%q, using default false", value)
+		return logSQLOff
+	}
+}
+
+// logQuery writes a dynamically built query to the log according to
+// LOG_SQL: the SQL and the number of arguments, plus their values with
+// LOG_SQL=args.
+func logQuery(handler, query string, args []interface{}) {
+	switch cfg.logSQL {
+	case logSQLOn:
+		log.Printf("SQL %s: %s (%d args)", handler, query, len(args))
+	case logSQLValue:
+		log.Printf("SQL %s: %s args=%v", handler, query, args)
+	}
+}
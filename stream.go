@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// streamBuffer is how many events a subscriber may fall behind before
+	// it is disconnected.
+	streamBuffer    = 16
+	streamKeepalive = 30 * time.Second
+)
+
+// Reasons a stream is closed by the server.
+const (
+	streamClosedSlow     = "slow_consumer"
+	streamClosedShutdown = "shutdown"
+)
+
+type streamRow struct {
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+}
+
+// batchEvent is pushed to subscribers once an upload has committed. Rows
+// are omitted when the batch inserted more than STREAM_MAX_ROWS.
+type batchEvent struct {
+	BatchID       string      `json:"batch_id"`
+	InsertedCount int         `json:"inserted_count"`
+	Categories    []string    `json:"categories"`
+	Rows          []streamRow `json:"rows,omitempty"`
+	RowsOmitted   bool        `json:"rows_omitted,omitempty"`
+	// categoryRows counts the inserted rows of each category, so a
+	// narrowed event counts only the rows its subscriber may see.
+	categoryRows map[string]int
+}
+
+// forCategories narrows the event to the given categories, reporting false
+// when nothing in it matches. A nil set matches everything.
+func (e batchEvent) forCategories(set map[string]bool) (batchEvent, bool) {
+	if set == nil {
+		return e, true
+	}
+	narrowed := e
+	narrowed.Categories = slices.DeleteFunc(slices.Clone(e.Categories), func(c string) bool { return !set[c] })
+	if e.categoryRows != nil {
+		narrowed.InsertedCount = 0
+		for _, c := range narrowed.Categories {
+			narrowed.InsertedCount += e.categoryRows[c]
+		}
+	}
+	if len(narrowed.Categories) == 0 {
+		return narrowed, false
+	}
+	if e.Rows != nil {
+		narrowed.Rows = slices.DeleteFunc(slices.Clone(e.Rows), func(r streamRow) bool { return !set[r.Category] })
+	}
+	return narrowed, true
+}
+
+type streamSubscriber struct {
+	events     chan batchEvent
+	categories map[string]bool
+	reason     string
+}
+
+// eventBroker fans committed uploads out to the streams of this instance.
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[*streamSubscriber]bool
+	closed bool
+}
+
+var priceEvents = eventBroker{subs: make(map[*streamSubscriber]bool)}
+
+func (b *eventBroker) subscribe(categories map[string]bool) *streamSubscriber {
+	sub := &streamSubscriber{events: make(chan batchEvent, streamBuffer), categories: categories}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		sub.reason = streamClosedShutdown
+		close(sub.events)
+		return sub
+	}
+	b.subs[sub] = true
+	return sub
+}
+
+func (b *eventBroker) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drop(sub, "")
+}
+
+// drop closes the subscriber's channel once; b.mu must be held.
+func (b *eventBroker) drop(sub *streamSubscriber, reason string) {
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		sub.reason = reason
+		close(sub.events)
+	}
+}
+
+// publish never blocks: a subscriber whose buffer is full is dropped.
+func (b *eventBroker) publish(event batchEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		narrowed, ok := event.forCategories(sub.categories)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.events <- narrowed:
+		default:
+			b.drop(sub, streamClosedSlow)
+		}
+	}
+}
+
+// shutdown closes every stream and refuses new ones.
+func (b *eventBroker) shutdown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		b.drop(sub, streamClosedShutdown)
+	}
+}
+
+// streamCategories is the category filter of a stream: the ?category= list
+// intersected with the categories of a restricted API key.
+func streamCategories(c *gin.Context) map[string]bool {
+	requested := splitList(c.Query("category"))
+	allowed := readCategories(c)
+	if requested == nil && allowed == nil {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, category := range requested {
+		if allowed == nil || slices.Contains(allowed, category) {
+			set[category] = true
+		}
+	}
+	if requested == nil {
+		for _, category := range allowed {
+			set[category] = true
+		}
+	}
+	return set
+}
+
+var streamUpgrader = websocket.Upgrader{}
+
+// streamReadLimit is the largest message a stream client may send.
+const streamReadLimit = 512
+
+// streamPrices pushes an event per committed upload batch as Server-Sent
+// Events, or over a WebSocket when the request asks for an upgrade. Only
+// batches committed after the stream opened are sent.
+func streamPrices(c *gin.Context) {
+	sub := priceEvents.subscribe(streamCategories(c))
+	defer priceEvents.unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		streamWebSocket(c, sub)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteString(": connected\n\n")
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			c.Writer.WriteString(": ping\n\n")
+		case event, ok := <-sub.events:
+			if !ok {
+				fmt.Fprintf(c.Writer, "event: close\ndata: {\"reason\":%q}\n\n", sub.reason)
+				c.Writer.Flush()
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(c.Writer, "event: batch\nid: %s\ndata: %s\n\n", event.BatchID, data)
+		}
+		c.Writer.Flush()
+	}
+}
+
+func streamWebSocket(c *gin.Context, sub *streamSubscriber) {
+	conn, err := streamUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		return
+	}
+	defer conn.Close()
+
+	// The client sends nothing; reading is only needed to notice it leave,
+	// so anything larger than a control frame closes the connection.
+	conn.SetReadLimit(streamReadLimit)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-gone:
+			return
+		case <-keepalive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		case event, ok := <-sub.events:
+			if !ok {
+				code := websocket.CloseGoingAway
+				if sub.reason == streamClosedSlow {
+					code = websocket.ClosePolicyViolation
+				}
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, sub.reason), time.Now().Add(time.Second))
+				return
+			}
+			err = conn.WriteJSON(event)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
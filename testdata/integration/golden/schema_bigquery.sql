@@ -0,0 +1,17 @@
+-- prices, schema version 21 (bigquery)
+CREATE TABLE prices (
+    id INT64 NOT NULL,
+    name STRING(255) NOT NULL,
+    category STRING(255) NOT NULL,
+    price NUMERIC(10, 2) NOT NULL,
+    create_date DATETIME NOT NULL,
+    batch_id STRING,
+    name_norm STRING,
+    price_cents INT64,
+    valid_from DATE,
+    valid_to DATE,
+    supplier STRING,
+    external_id STRING(255),
+    labels ARRAY<STRING>,
+    PRIMARY KEY (id) NOT ENFORCED
+);
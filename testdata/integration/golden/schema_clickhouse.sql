@@ -0,0 +1,18 @@
+-- prices, schema version 21 (clickhouse)
+CREATE TABLE prices (
+    id Int32,
+    name String,
+    category String,
+    price Decimal(10, 2),
+    create_date DateTime,
+    batch_id Nullable(UUID),
+    name_norm Nullable(String),
+    price_cents Nullable(Int64),
+    valid_from Nullable(Date32),
+    valid_to Nullable(Date32),
+    supplier Nullable(String),
+    external_id Nullable(String),
+    labels Array(String)
+)
+ENGINE = MergeTree
+ORDER BY id;
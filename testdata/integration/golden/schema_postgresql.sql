@@ -0,0 +1,23 @@
+-- prices, schema version 21 (postgresql)
+CREATE TABLE prices (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    category VARCHAR(255) NOT NULL,
+    price DECIMAL(10, 2) NOT NULL,
+    create_date TIMESTAMP NOT NULL,
+    batch_id UUID,
+    name_norm TEXT,
+    price_cents BIGINT,
+    valid_from DATE,
+    valid_to DATE,
+    supplier TEXT,
+    external_id VARCHAR(255),
+    labels TEXT[] NOT NULL DEFAULT '{}'
+);
+CREATE INDEX prices_batch_id_idx ON prices (batch_id);
+CREATE INDEX prices_name_norm_idx ON prices (name_norm text_pattern_ops);
+CREATE INDEX prices_identity_ci_idx ON prices (lower(name), lower(category));
+CREATE INDEX prices_supplier_idx ON prices (supplier, create_date);
+CREATE INDEX prices_create_date_idx ON prices (create_date);
+CREATE UNIQUE INDEX prices_external_id_idx ON prices (COALESCE(supplier, ''), external_id) WHERE external_id IS NOT NULL;
+CREATE INDEX prices_labels_idx ON prices USING GIN (labels);
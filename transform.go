@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The ?transform= language rewrites fields of each uploaded row before it
+// is validated:
+//
+//	rules   = rule { ";" rule }
+//	rule    = field "=" expr
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | field | func "(" expr ")" | "(" expr ")"
+//
+// price is a number and takes arithmetic; name and category are strings and
+// take upper, lower and trim. Rules run in order, each seeing the row as the
+// previous ones left it.
+const (
+	maxTransformRules = 10
+	maxTransformDepth = 8
+)
+
+// transformFields are the fields a rule may read and assign, with whether
+// they are numeric.
+var transformFields = map[string]bool{"name": false, "category": false, "price": true}
+
+var transformFuncs = map[string]func(string) string{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+}
+
+// transformRow is the part of a row transforms operate on.
+type transformRow struct {
+	name, category string
+	price          float64
+}
+
+func (r *transformRow) str(field string) string {
+	if field == "name" {
+		return r.name
+	}
+	return r.category
+}
+
+// transformExpr is a typed expression: numeric ones are evaluated with num,
+// string ones with str.
+type transformExpr interface {
+	numeric() bool
+	num(r *transformRow) float64
+	str(r *transformRow) string
+}
+
+type numberLit float64
+
+func (n numberLit) numeric() bool             { return true }
+func (n numberLit) num(*transformRow) float64 { return float64(n) }
+func (n numberLit) str(*transformRow) string  { return "" }
+
+type fieldRef string
+
+func (f fieldRef) numeric() bool               { return transformFields[string(f)] }
+func (f fieldRef) num(r *transformRow) float64 { return r.price }
+func (f fieldRef) str(r *transformRow) string  { return r.str(string(f)) }
+
+type arithExpr struct {
+	op          rune
+	left, right transformExpr
+}
+
+func (e *arithExpr) numeric() bool            { return true }
+func (e *arithExpr) str(*transformRow) string { return "" }
+
+func (e *arithExpr) num(r *transformRow) float64 {
+	l, rt := e.left.num(r), e.right.num(r)
+	switch e.op {
+	case '+':
+		return l + rt
+	case '-':
+		return l - rt
+	case '*':
+		return l * rt
+	}
+	return l / rt
+}
+
+type negExpr struct{ x transformExpr }
+
+func (e *negExpr) numeric() bool               { return true }
+func (e *negExpr) num(r *transformRow) float64 { return -e.x.num(r) }
+func (e *negExpr) str(*transformRow) string    { return "" }
+
+type callExpr struct {
+	fn  func(string) string
+	arg transformExpr
+}
+
+func (e *callExpr) numeric() bool              { return false }
+func (e *callExpr) num(*transformRow) float64  { return 0 }
+func (e *callExpr) str(r *transformRow) string { return e.fn(e.arg.str(r)) }
+
+type transformRule struct {
+	field string
+	expr  transformExpr
+}
+
+// transforms are the parsed rules of an upload.
+type transforms []transformRule
+
+// apply runs the rules over a row. A price that stops being a finite number,
+// as after a division by zero, is left for validation to reject.
+func (t transforms) apply(r *transformRow) {
+	for _, rule := range t {
+		switch rule.field {
+		case "price":
+			r.price = rule.expr.num(r)
+		case "name":
+			r.name = rule.expr.str(r)
+		case "category":
+			r.category = rule.expr.str(r)
+		}
+	}
+}
+
+type transformToken struct {
+	kind string // "number", "ident", "op", "(", ")", "=", ";", "eof"
+	text string
+	pos  int
+}
+
+func tokenizeTransform(input string) ([]transformToken, error) {
+	var tokens []transformToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("()=;", r):
+			tokens = append(tokens, transformToken{kind: string(r), text: string(r), pos: i})
+			i++
+		case strings.ContainsRune("+-*/", r):
+			tokens = append(tokens, transformToken{kind: "op", text: string(r), pos: i})
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, transformToken{kind: "number", text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, transformToken{kind: "ident", text: string(runes[start:i]), pos: start})
+		default:
+			return nil, &filterError{param: "transform", message: fmt.Sprintf("unexpected %q", r), position: i}
+		}
+	}
+	tokens = append(tokens, transformToken{kind: "eof", pos: len(runes)})
+	return tokens, nil
+}
+
+type transformParser struct {
+	tokens []transformToken
+	pos    int
+}
+
+// parseTransforms parses the ?transform= rules; an empty value means none.
+func parseTransforms(input string) (transforms, error) {
+	tokens, err := tokenizeTransform(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &transformParser{tokens: tokens}
+	var rules transforms
+	for p.peek().kind != "eof" {
+		if len(rules) == maxTransformRules {
+			return nil, p.errorf(p.peek(), "more than %d rules", maxTransformRules)
+		}
+		rule, err := p.parseRule()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+		if tok := p.next(); tok.kind != ";" && tok.kind != "eof" {
+			return nil, p.errorf(tok, "unexpected %q", tok.text)
+		}
+	}
+	return rules, nil
+}
+
+func (p *transformParser) peek() transformToken {
+	return p.tokens[p.pos]
+}
+
+func (p *transformParser) next() transformToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *transformParser) errorf(tok transformToken, format string, args ...interface{}) error {
+	return &filterError{param: "transform", message: fmt.Sprintf(format, args...), position: tok.pos}
+}
+
+func (p *transformParser) parseRule() (transformRule, error) {
+	fieldTok := p.next()
+	field := strings.ToLower(fieldTok.text)
+	numeric, ok := transformFields[field]
+	if fieldTok.kind != "ident" || !ok {
+		return transformRule{}, p.errorf(fieldTok, "expected one of name, category, price")
+	}
+	if tok := p.next(); tok.kind != "=" {
+		return transformRule{}, p.errorf(tok, "expected =")
+	}
+	start := p.peek()
+	expr, err := p.parseSum(1)
+	if err != nil {
+		return transformRule{}, err
+	}
+	if expr.numeric() != numeric {
+		return transformRule{}, p.errorf(start, "%s must be set to a %s", field, transformTypeName(numeric))
+	}
+	return transformRule{field: field, expr: expr}, nil
+}
+
+func transformTypeName(numeric bool) string {
+	if numeric {
+		return "number"
+	}
+	return "string"
+}
+
+// operand checks that an operand of arithmetic is a number.
+func (p *transformParser) operand(tok transformToken, e transformExpr) error {
+	if !e.numeric() {
+		return p.errorf(tok, "arithmetic needs numbers")
+	}
+	return nil
+}
+
+func (p *transformParser) parseSum(depth int) (transformExpr, error) {
+	leftTok := p.peek()
+	left, err := p.parseProduct(depth)
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == "op" && (tok.text == "+" || tok.text == "-"); tok = p.peek() {
+		p.next()
+		rightTok := p.peek()
+		right, err := p.parseProduct(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.operand(leftTok, left); err != nil {
+			return nil, err
+		}
+		if err := p.operand(rightTok, right); err != nil {
+			return nil, err
+		}
+		left = &arithExpr{op: rune(tok.text[0]), left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *transformParser) parseProduct(depth int) (transformExpr, error) {
+	leftTok := p.peek()
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == "op" && (tok.text == "*" || tok.text == "/"); tok = p.peek() {
+		p.next()
+		rightTok := p.peek()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.operand(leftTok, left); err != nil {
+			return nil, err
+		}
+		if err := p.operand(rightTok, right); err != nil {
+			return nil, err
+		}
+		left = &arithExpr{op: rune(tok.text[0]), left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *transformParser) parseUnary(depth int) (transformExpr, error) {
+	if tok := p.peek(); tok.kind == "op" && tok.text == "-" {
+		p.next()
+		x, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.operand(tok, x); err != nil {
+			return nil, err
+		}
+		return &negExpr{x}, nil
+	}
+	return p.parsePrimary(depth)
+}
+
+func (p *transformParser) parsePrimary(depth int) (transformExpr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "number":
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil || math.IsInf(v, 0) {
+			return nil, p.errorf(tok, "bad number %q", tok.text)
+		}
+		return numberLit(v), nil
+	case "(":
+		if depth >= maxTransformDepth {
+			return nil, p.errorf(tok, "expression nested deeper than %d levels", maxTransformDepth)
+		}
+		expr, err := p.parseSum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, p.errorf(closing, "expected )")
+		}
+		return expr, nil
+	case "ident":
+		name := strings.ToLower(tok.text)
+		if p.peek().kind != "(" {
+			if _, ok := transformFields[name]; !ok {
+				return nil, p.errorf(tok, "unknown field %q", tok.text)
+			}
+			return fieldRef(name), nil
+		}
+		fn, ok := transformFuncs[name]
+		if !ok {
+			return nil, p.errorf(tok, "unknown function %q", tok.text)
+		}
+		open := p.next()
+		if depth >= maxTransformDepth {
+			return nil, p.errorf(open, "expression nested deeper than %d levels", maxTransformDepth)
+		}
+		argTok := p.peek()
+		arg, err := p.parseSum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if arg.numeric() {
+			return nil, p.errorf(argTok, "%s needs a string", name)
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, p.errorf(closing, "expected )")
+		}
+		return &callExpr{fn: fn, arg: arg}, nil
+	}
+	return nil, p.errorf(tok, "expected a number, field or function")
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+// uiFS serves the embedded single-page UI. The page only uses relative URLs,
+// so it works under any path prefix.
+func uiFS() http.FileSystem {
+	sub, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
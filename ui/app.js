@@ -0,0 +1,63 @@
+// All URLs are relative to the page so the UI keeps working when the
+// service is mounted under a path prefix.
+const pricesURL = new URL("../api/v0/prices", document.baseURI);
+
+function fillTable(table, entries) {
+  table.replaceChildren();
+  for (const [key, value] of entries) {
+    const row = table.insertRow();
+    row.insertCell().textContent = key;
+    row.insertCell().textContent = typeof value === "object" ? JSON.stringify(value) : value;
+  }
+}
+
+document.getElementById("upload-form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  const result = document.getElementById("upload-result");
+  const error = document.getElementById("upload-error");
+  result.hidden = true;
+  error.hidden = true;
+
+  const url = new URL(pricesURL);
+  url.searchParams.set("type", form.type.value);
+  const body = new FormData();
+  body.append("file", form.file.files[0]);
+  if (form.password.value) {
+    body.append("password", form.password.value);
+  }
+  const headers = {};
+  if (form.api_key.value) {
+    headers["X-API-Key"] = form.api_key.value;
+  }
+
+  try {
+    const response = await fetch(url, { method: "POST", body, headers });
+    const summary = await response.json();
+    if (!response.ok) {
+      throw new Error(summary.error || response.statusText);
+    }
+    const { rejected = {}, skipped_files: skipped = [], ...rest } = summary;
+    fillTable(document.getElementById("summary"), Object.entries(rest));
+    fillTable(document.getElementById("rejected"), Object.entries(rejected));
+    fillTable(document.getElementById("skipped"), skipped.map((f) => [f.name, f.reason]));
+    result.hidden = false;
+  } catch (err) {
+    error.textContent = err.message;
+    error.hidden = false;
+  }
+});
+
+document.getElementById("export-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const url = new URL(pricesURL);
+  for (const [name, value] of new FormData(event.target)) {
+    if (value !== "") {
+      url.searchParams.set(name, value);
+    }
+  }
+  const link = document.getElementById("export-link");
+  link.href = url;
+  link.textContent = url;
+  link.hidden = false;
+});
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// base64BodySlack is the room a base64 upload body has beyond its data for
+// the other fields and the JSON syntax.
+const base64BodySlack = 64 << 10
+
+var errBase64TooLarge = errors.New("archive exceeds BASE64_UPLOAD_MAX_SIZE")
+
+// base64Upload is the JSON body of POST /api/v0/prices/base64, for clients
+// that can only send JSON. The fields mirror the multipart form.
+type base64Upload struct {
+	Type     string          `json:"type"`
+	Data     string          `json:"data"`
+	Filename string          `json:"filename"`
+	Password string          `json:"password"`
+	SHA256   string          `json:"sha256"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// uploadPricesBase64 decodes the base64 archive in the JSON body to a
+// spooled file and runs it through the same pipeline as a multipart
+// upload, so the temporary space budget and the extraction limits apply
+// to the decoded archive. The body is held in memory while it is decoded,
+// so it is capped by BASE64_UPLOAD_MAX_SIZE of decoded data.
+func uploadPricesBase64(c *gin.Context) {
+	opts, err := parseUploadOptions(c)
+	if err != nil {
+		respondUploadOptionsError(c, err)
+		return
+	}
+
+	limit := int64(base64.StdEncoding.EncodedLen(cfg.base64UploadMax) + base64BodySlack)
+	var body base64Upload
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, limit)).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errBase64TooLarge.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+
+	if body.Type != "" {
+		opts.archiveType = body.Type
+	}
+	switch opts.archiveType {
+	case archiveZip, archiveTar, archiveTarGz, archiveCSV:
+	case archiveTgz:
+		opts.archiveType = archiveTarGz
+	default:
+		respondFilterError(c, &filterError{param: "type", message: "must be one of zip, tar, tar.gz, tgz, csv"})
+		return
+	}
+	if body.Data == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no file uploaded"})
+		return
+	}
+	if len(body.Password) > maxFormFieldSize {
+		respondFilterError(c, &filterError{param: "password", message: "is too long"})
+		return
+	}
+	opts.password = body.Password
+	if len(body.Metadata) > 0 && string(body.Metadata) != "null" {
+		if opts.metadata, err = parseUploadMetadata(string(body.Metadata)); err != nil {
+			if errors.Is(err, errInvalidMetadata) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			} else {
+				respondFilterError(c, err)
+			}
+			return
+		}
+	}
+	filename := body.Filename
+	if filename == "" {
+		filename = "upload." + opts.archiveType
+	}
+
+	hash := sha256.New()
+	decoded := base64.NewDecoder(base64.StdEncoding, strings.NewReader(body.Data))
+	archive, err := spoolUpload(io.TeeReader(io.LimitReader(decoded, int64(cfg.base64UploadMax)+1), hash))
+	body.Data = ""
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		switch {
+		case errors.As(err, &corrupt):
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("data is not valid base64 at byte %d", int64(corrupt))})
+		case errors.Is(err, errTempBudgetExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read file"})
+		}
+		return
+	}
+	defer archive.Close()
+	if archive.size > int64(cfg.base64UploadMax) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errBase64TooLarge.Error()})
+		return
+	}
+	if body.SHA256 != "" && hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(body.SHA256) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "sha256 of the uploaded file does not match"})
+		return
+	}
+
+	beginUploadAttempt(c, filename, archive.Name(), opts)
+	defer finishUploadAttempt(c)
+	processUpload(c, archive, filename, opts)
+}
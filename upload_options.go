@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxDateToleranceDays = 365
+
+var errInvalidMetadata = errors.New("metadata must be a JSON object")
+
+// Upload modes for ?mode=: append adds rows, replace_all empties the table
+// first in the same transaction.
+const (
+	modeAppend     = "append"
+	modeReplaceAll = "replace_all"
+)
+
+// Orders of CSV entries within an archive for ?order=. Duplicate detection
+// keeps the row seen first, so modtime_desc makes the newest file win.
+const (
+	orderName        = "name"
+	orderModTime     = "modtime"
+	orderModTimeDesc = "modtime_desc"
+)
+
+// Policies for ?id_conflict=, what to do with the ids in the files:
+// reassign ignores them and lets the database number the rows; skip keeps
+// them and drops a row whose id is taken, by the table or an earlier row
+// of the upload; error keeps them and fails the upload on the first taken
+// id.
+const (
+	idReassign = "reassign"
+	idSkip     = "skip"
+	idError    = "error"
+)
+
+// Duplicate policies for ?on_duplicate=: skip drops a row already in the
+// table; upsert_external matches rows carrying an external_id by it
+// instead, updating the stored row when the content differs.
+const (
+	dupSkip           = "skip"
+	dupUpsertExternal = "upsert_external"
+)
+
+var errReplaceAllForbidden = errors.New("mode=replace_all requires the admin token")
+
+// uploadOptions are the query parameters accepted by uploadPrices.
+type uploadOptions struct {
+	archiveType string
+	password    string
+	rounding    roundingMode
+	// dateToleranceDays widens duplicate detection to create_dates within
+	// this many days of each other.
+	dateToleranceDays int
+	dedupScope        string
+	dedupe            string
+	dateLayouts       []string
+	// consistentDates pins the date layout to the one of the first valid
+	// row; rows in another recognizable layout are skipped, or fail the
+	// whole upload when strict is set.
+	consistentDates bool
+	strict          bool
+	// onlyNewCategories skips rows whose category already has prices.
+	onlyNewCategories bool
+	// recurse extracts CSV files from archives nested in the upload.
+	recurse bool
+	// allowEmpty accepts an archive without CSV files as an upload of no
+	// rows instead of rejecting it.
+	allowEmpty bool
+	// header selects how CSV columns are found: by position, or by the
+	// names in the header row. headerFallback lets a column missing from
+	// the header keep its position.
+	header         string
+	headerFallback bool
+	// metadata is the client's own JSON object stored with the upload and
+	// echoed back; it is never interpreted.
+	metadata map[string]interface{}
+	mode     string
+	// order is the order in which CSV entries are processed.
+	order string
+	// transforms rewrite fields of each row before it is validated.
+	transforms transforms
+	// priceRules are the price bounds, loaded once as the upload starts.
+	priceRules *priceRuleSet
+	// idConflict also governs a taken external_id.
+	idConflict  string
+	onDuplicate string
+	// profile adds a profile of the accepted rows to the summary.
+	profile bool
+	// categoryBreakdown adds the inserted and duplicate rows of each
+	// category to the summary.
+	categoryBreakdown bool
+	// parallelInsert, when set, inserts each file in its own transaction,
+	// at most this many at once, instead of the whole upload in one.
+	parallelInsert int
+	// supplier picks the quarantine thresholds of a plain upload; reconcile
+	// scopes its snapshot to it.
+	supplier string
+}
+
+func parseUploadOptions(c *gin.Context) (uploadOptions, error) {
+	// The password is only read from the form body, by the caller; query
+	// strings end up in access logs.
+	if c.Query("password") != "" {
+		return uploadOptions{}, &filterError{param: "password", message: "must be sent as a form field, not in the query string"}
+	}
+
+	opts := uploadOptions{
+		archiveType: c.DefaultQuery("type", "zip"),
+	}
+	if opts.archiveType == archiveTgz {
+		opts.archiveType = archiveTarGz
+	}
+
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		return opts, err
+	}
+	opts.rounding = rounding
+
+	if raw := c.Query("date_tolerance_days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 || n > maxDateToleranceDays {
+			return opts, &filterError{param: "date_tolerance_days", message: "must be an integer between 0 and 365"}
+		}
+		opts.dateToleranceDays = n
+	}
+
+	if opts.dateLayouts, err = parseDateFormat(c.Query("date_format")); err != nil {
+		return opts, err
+	}
+
+	if opts.consistentDates, err = parseBoolParam(c, "consistent_dates"); err != nil {
+		return opts, err
+	}
+	// With a single layout every date is consistent already.
+	if opts.consistentDates && c.Query("date_format") != "auto" {
+		return opts, &filterError{param: "consistent_dates", message: "requires date_format=auto"}
+	}
+	if opts.strict, err = parseBoolParam(c, "strict"); err != nil {
+		return opts, err
+	}
+	if opts.onlyNewCategories, err = parseBoolParam(c, "only_new_categories"); err != nil {
+		return opts, err
+	}
+	if opts.recurse, err = parseBoolParam(c, "recurse"); err != nil {
+		return opts, err
+	}
+	if opts.allowEmpty, err = parseBoolParam(c, "allow_empty"); err != nil {
+		return opts, err
+	}
+	if opts.profile, err = parseBoolParam(c, "profile"); err != nil {
+		return opts, err
+	}
+	if opts.categoryBreakdown, err = parseBoolParam(c, "category_breakdown"); err != nil {
+		return opts, err
+	}
+
+	opts.header = c.DefaultQuery("header", headerPositional)
+	if opts.header != headerPositional && opts.header != headerNames {
+		return opts, &filterError{param: "header", message: "must be one of positional, names"}
+	}
+	switch c.Query("header_fallback") {
+	case "":
+	case headerPositional:
+		if opts.header != headerNames {
+			return opts, &filterError{param: "header_fallback", message: "requires header=names"}
+		}
+		opts.headerFallback = true
+	default:
+		return opts, &filterError{param: "header_fallback", message: "must be positional"}
+	}
+
+	opts.dedupScope = c.DefaultQuery("dedup_scope", dedupTable)
+	switch opts.dedupScope {
+	case dedupTable, dedupUpload, dedupBoth:
+	default:
+		return opts, &filterError{param: "dedup_scope", message: "must be one of table, upload, both"}
+	}
+
+	// replace_all deletes every row, so it needs both the server's opt-in
+	// and the admin token on top of the regular API key.
+	switch opts.mode = c.DefaultQuery("mode", modeAppend); opts.mode {
+	case modeAppend:
+	case modeReplaceAll:
+		if !featureEnabled(modeReplaceAll) {
+			return opts, &filterError{param: "mode", message: "replace_all is not enabled on this server"}
+		}
+		if !isAdmin(c) {
+			return opts, errReplaceAllForbidden
+		}
+	default:
+		return opts, &filterError{param: "mode", message: "must be one of append, replace_all"}
+	}
+
+	opts.order = c.DefaultQuery("order", orderName)
+	switch opts.order {
+	case orderName, orderModTime, orderModTimeDesc:
+	default:
+		return opts, &filterError{param: "order", message: "must be one of name, modtime, modtime_desc"}
+	}
+
+	opts.dedupe = c.DefaultQuery("dedupe", dedupeExact)
+	if opts.dedupe != dedupeExact && opts.dedupe != dedupeCI {
+		return opts, &filterError{param: "dedupe", message: "must be one of exact, ci"}
+	}
+
+	switch opts.idConflict = c.DefaultQuery("id_conflict", idReassign); opts.idConflict {
+	case idReassign, idSkip, idError:
+	default:
+		return opts, &filterError{param: "id_conflict", message: "must be one of reassign, skip, error"}
+	}
+
+	switch opts.onDuplicate = c.DefaultQuery("on_duplicate", dupSkip); opts.onDuplicate {
+	case dupSkip, dupUpsertExternal:
+	default:
+		return opts, &filterError{param: "on_duplicate", message: "must be one of skip, upsert_external"}
+	}
+
+	if raw := c.Query("parallel_insert"); raw != "" {
+		limit := parallelInsertLimit()
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > limit {
+			return opts, &filterError{param: "parallel_insert", message: fmt.Sprintf("must be an integer between 1 and %d", limit)}
+		}
+		switch {
+		case opts.mode == modeReplaceAll:
+			return opts, &filterError{param: "parallel_insert", message: "cannot be combined with mode=replace_all"}
+		case opts.onlyNewCategories:
+			return opts, &filterError{param: "parallel_insert", message: "cannot be combined with only_new_categories"}
+		}
+		opts.parallelInsert = n
+	}
+
+	if opts.supplier, err = filterParam(c, "supplier", cfg.filterMaxLength); err != nil {
+		return opts, err
+	}
+
+	if opts.transforms, err = parseTransforms(c.Query("transform")); err != nil {
+		return opts, err
+	}
+
+	if opts.priceRules, err = loadPriceRules(c.Request.Context()); err != nil {
+		return opts, errPriceRulesUnavailable
+	}
+
+	return opts, nil
+}
+
+// respondUploadOptionsError answers a parseUploadOptions error.
+func respondUploadOptionsError(c *gin.Context, err error) {
+	if errors.Is(err, errReplaceAllForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errPriceRulesUnavailable) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondFilterError(c, err)
+}
+
+// parseUploadMetadata validates the metadata form field: a JSON object of
+// at most maxFormFieldSize bytes.
+func parseUploadMetadata(raw string) (map[string]interface{}, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if len(raw) > maxFormFieldSize {
+		return nil, &filterError{param: "metadata", message: "is too long"}
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil || metadata == nil {
+		return nil, errInvalidMetadata
+	}
+	return metadata, nil
+}
+
+// parallelInsertLimit is the largest ?parallel_insert=: PARALLEL_INSERT_MAX,
+// but at most half the pool, so one upload leaves connections for
+// everything else.
+func parallelInsertLimit() int {
+	return max(1, min(cfg.parallelInsertMax, int(db.Config().MaxConns)/2))
+}
+
+func parseBoolParam(c *gin.Context, name string) (bool, error) {
+	return parseBoolValue(name, c.Query(name))
+}
+
+// parseBoolValue parses the raw value of the boolean parameter name; empty
+// is false.
+func parseBoolValue(name, raw string) (bool, error) {
+	if raw == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, &filterError{param: name, message: "must be true or false"}
+	}
+	return b, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultUploadsLimit = 50
+	maxUploadsLimit     = 500
+)
+
+type uploadRecord struct {
+	BatchID         string                 `json:"batch_id"`
+	Filename        string                 `json:"filename"`
+	ArchiveType     string                 `json:"archive_type"`
+	TotalCount      int                    `json:"total_count"`
+	InsertedCount   int                    `json:"inserted_count"`
+	DuplicatesCount int                    `json:"duplicates_count"`
+	CreatedAt       time.Time              `json:"created_at"`
+	RolledBackAt    *time.Time             `json:"rolled_back_at"`
+	Metadata        map[string]interface{} `json:"metadata"`
+	Status          string                 `json:"status"`
+	FailureReason   *string                `json:"failure_reason"`
+	// QuarantineReasons are set on uploads held for review or rejected.
+	QuarantineReasons []quarantineReason `json:"quarantine_reasons,omitempty"`
+}
+
+// listUploads returns the most recent upload batches, newest first, with
+// the uploads still processing or interrupted and those quarantined or
+// rejected among them. An approved upload is listed as completed.
+func listUploads(c *gin.Context) {
+	limit := defaultUploadsLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxUploadsLimit {
+			respondFilterError(c, &filterError{param: "limit", message: "must be an integer between 1 and " + strconv.Itoa(maxUploadsLimit)})
+			return
+		}
+		limit = n
+	}
+
+	rows, err := db.Query(context.Background(),
+		`SELECT batch_id::text, filename, archive_type, total_count, inserted_count, duplicates_count,
+			created_at, rolled_back_at, metadata, 'completed', NULL, NULL::jsonb
+		FROM uploads
+		UNION ALL
+		SELECT batch_id::text, filename, archive_type, 0, 0, 0, started_at, NULL, metadata, status, failure_reason, NULL
+		FROM upload_attempts
+		UNION ALL
+		SELECT batch_id::text, filename, archive_type, total_count, 0, duplicates_count, created_at, NULL, metadata, status, NULL, reasons
+		FROM quarantined_uploads WHERE status <> 'approved'
+		ORDER BY created_at DESC LIMIT $1`, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	uploads := []uploadRecord{}
+	for rows.Next() {
+		var u uploadRecord
+		err := rows.Scan(&u.BatchID, &u.Filename, &u.ArchiveType, &u.TotalCount, &u.InsertedCount,
+			&u.DuplicatesCount, &u.CreatedAt, &u.RolledBackAt, &u.Metadata, &u.Status, &u.FailureReason, &u.QuarantineReasons)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		uploads = append(uploads, u)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, uploads)
+}
+
+var (
+	errUploadNotFound    = errors.New("upload not found")
+	errAlreadyRolledBack = errors.New("upload already rolled back")
+)
+
+func rollbackUpload(c *gin.Context) {
+	batchID := c.Param("batch_id")
+	if !isUUID(batchID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	ctx, conflictRetries := withConflictCounter(c.Request.Context())
+	var deleted int64
+	err := withRetry(ctx, "rollback", func() error {
+		var err error
+		deleted, err = rollbackTx(batchID)
+		return err
+	})
+	var se *storeError
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errAlreadyRolledBack):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.As(err, &se):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": se.message})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	exportArchives.purge()
+
+	c.JSON(http.StatusOK, gin.H{
+		"batch_id":         batchID,
+		"deleted_count":    deleted,
+		"conflict_retries": conflictRetries.Load(),
+	})
+}
+
+// rollbackTx deletes the rows of an upload and marks it rolled back in one
+// transaction. The change feed lock and then the rows in id order are
+// locked first, like every bulk write, so a concurrent label or reconcile
+// over them cannot deadlock it.
+func rollbackTx(batchID string) (int64, error) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return 0, &storeError{"failed to start transaction", err}
+	}
+	defer tx.Rollback(ctx)
+	if err := lockChangeFeed(ctx, tx); err != nil {
+		return 0, &storeError{"database error", err}
+	}
+
+	var rolledBackAt *time.Time
+	err = tx.QueryRow(ctx, "SELECT rolled_back_at FROM uploads WHERE batch_id = $1 FOR UPDATE", batchID).Scan(&rolledBackAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errUploadNotFound
+	}
+	if err != nil {
+		return 0, &storeError{"database error", err}
+	}
+	if rolledBackAt != nil {
+		return 0, errAlreadyRolledBack
+	}
+
+	if err := lockPrices(ctx, tx, "batch_id = $1", batchID); err != nil {
+		return 0, &storeError{"failed to delete records", err}
+	}
+	tag, err := tx.Exec(ctx, "DELETE FROM prices WHERE batch_id = $1", batchID)
+	if err != nil {
+		return 0, &storeError{"failed to delete records", err}
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE uploads SET rolled_back_at = now() WHERE batch_id = $1", batchID); err != nil {
+		return 0, &storeError{"failed to record rollback", err}
+	}
+
+	// A commit that lost its connection may have gone through, so it is
+	// never retried.
+	if err = tx.Commit(ctx); err != nil {
+		return 0, &permanentError{&storeError{"failed to commit transaction", err}}
+	}
+	return tag.RowsAffected(), nil
+}
+
+const (
+	defaultUploadDiffLimit = 1000
+	maxUploadDiffLimit     = 10000
+)
+
+// uploadDiffItem is a product present in only one of the compared uploads.
+type uploadDiffItem struct {
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Price    float64 `json:"price"`
+}
+
+// uploadPriceChange is a product whose price differs between the uploads.
+type uploadPriceChange struct {
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	OldPrice float64 `json:"old_price"`
+	NewPrice float64 `json:"new_price"`
+	Change   float64 `json:"change"`
+}
+
+// compareUploads returns the products added, removed and repriced from
+// upload a to upload b. Products match on name and category; a product
+// with several rows in an upload is taken at its latest create_date. Only
+// rows still in the table are compared.
+func compareUploads(c *gin.Context) {
+	ids := [2]string{c.Query("a"), c.Query("b")}
+	for i, name := range []string{"a", "b"} {
+		if !isUUID(ids[i]) {
+			respondFilterError(c, &filterError{param: name, message: "must be an upload batch_id"})
+			return
+		}
+	}
+	limit := defaultUploadDiffLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxUploadDiffLimit {
+			respondFilterError(c, &filterError{param: "limit", message: "must be an integer between 1 and " + strconv.Itoa(maxUploadDiffLimit)})
+			return
+		}
+		limit = n
+	}
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	var summaries [2]gin.H
+	for i, batchID := range ids {
+		var filename string
+		var createdAt time.Time
+		var rolledBackAt *time.Time
+		err := db.QueryRow(ctx, "SELECT filename, created_at, rolled_back_at FROM uploads WHERE batch_id = $1", batchID).
+			Scan(&filename, &createdAt, &rolledBackAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found", "batch_id": batchID})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+			return
+		}
+		if rolledBackAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload has been rolled back", "batch_id": batchID})
+			return
+		}
+		summaries[i] = gin.H{"batch_id": batchID, "filename": filename, "created_at": createdAt}
+	}
+
+	latest := `SELECT DISTINCT ON (name, category) name, category, ` + priceColumn() + ` AS price
+		FROM prices WHERE batch_id = %s ORDER BY name, category, create_date DESC, id DESC`
+	rows, err := queryWithRetry(ctx, "uploads diff",
+		`SELECT name, category, a.price, b.price
+		FROM (`+fmt.Sprintf(latest, "$1")+`) a FULL JOIN (`+fmt.Sprintf(latest, "$2")+`) b USING (name, category)
+		ORDER BY name, category`,
+		ids[0], ids[1])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	defer rows.Close()
+
+	added, removed, changed := []uploadDiffItem{}, []uploadDiffItem{}, []uploadPriceChange{}
+	var addedCount, removedCount, changedCount, unchangedCount int
+	for rows.Next() {
+		var name, category string
+		var oldPrice, newPrice *float64
+		if err := rows.Scan(&name, &category, &oldPrice, &newPrice); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+			return
+		}
+		switch {
+		case oldPrice == nil:
+			if addedCount++; addedCount <= limit {
+				added = append(added, uploadDiffItem{name, category, roundMoney(*newPrice, rounding)})
+			}
+		case newPrice == nil:
+			if removedCount++; removedCount <= limit {
+				removed = append(removed, uploadDiffItem{name, category, roundMoney(*oldPrice, rounding)})
+			}
+		case *oldPrice != *newPrice:
+			if changedCount++; changedCount <= limit {
+				changed = append(changed, uploadPriceChange{
+					Name:     name,
+					Category: category,
+					OldPrice: roundMoney(*oldPrice, rounding),
+					NewPrice: roundMoney(*newPrice, rounding),
+					Change:   roundMoney(*newPrice-*oldPrice, rounding),
+				})
+			}
+		default:
+			unchangedCount++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"a":               summaries[0],
+		"b":               summaries[1],
+		"added":           added,
+		"removed":         removed,
+		"changed":         changed,
+		"added_count":     addedCount,
+		"removed_count":   removedCount,
+		"changed_count":   changedCount,
+		"unchanged_count": unchangedCount,
+		"truncated":       addedCount > limit || removedCount > limit || changedCount > limit,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const usageContextKey = "usage"
+
+// usageCounters are what one API key used in one month, or what one request
+// used while it runs. A request's counters are only touched by its own
+// handler goroutine, so they need no locking.
+type usageCounters struct {
+	requests      int64
+	uploadedBytes int64
+	exportedBytes int64
+	rowsInserted  int64
+	rowsExported  int64
+}
+
+func (u *usageCounters) add(o *usageCounters) {
+	u.requests += o.requests
+	u.uploadedBytes += o.uploadedBytes
+	u.exportedBytes += o.exportedBytes
+	u.rowsInserted += o.rowsInserted
+	u.rowsExported += o.rowsExported
+}
+
+type usageKey struct {
+	keyID  string
+	period time.Time
+}
+
+// usageMeter aggregates usage in memory until the next flush, so a request
+// costs one map update under a mutex. A crash loses at most one
+// USAGE_FLUSH_INTERVAL of usage.
+type usageMeter struct {
+	mu      sync.Mutex
+	pending map[usageKey]*usageCounters
+	// flushMu keeps flushes from adding the same counters twice.
+	flushMu sync.Mutex
+}
+
+var usage = &usageMeter{pending: make(map[usageKey]*usageCounters)}
+
+func usagePeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (m *usageMeter) record(keyID string, at time.Time, counters *usageCounters) {
+	key := usageKey{keyID, usagePeriod(at)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total, ok := m.pending[key]
+	if !ok {
+		total = &usageCounters{}
+		m.pending[key] = total
+	}
+	total.add(counters)
+}
+
+// flush adds the pending counters to the usage table in one transaction. On
+// failure they are kept for the next flush.
+func (m *usageMeter) flush(ctx context.Context) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[usageKey]*usageCounters)
+	m.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for key, u := range pending {
+		batch.Queue(`INSERT INTO usage (key_id, period, requests, uploaded_bytes, exported_bytes, rows_inserted, rows_exported)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (key_id, period) DO UPDATE SET
+				requests = usage.requests + EXCLUDED.requests,
+				uploaded_bytes = usage.uploaded_bytes + EXCLUDED.uploaded_bytes,
+				exported_bytes = usage.exported_bytes + EXCLUDED.exported_bytes,
+				rows_inserted = usage.rows_inserted + EXCLUDED.rows_inserted,
+				rows_exported = usage.rows_exported + EXCLUDED.rows_exported`,
+			key.keyID, key.period, u.requests, u.uploadedBytes, u.exportedBytes, u.rowsInserted, u.rowsExported)
+	}
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	if err != nil {
+		m.mu.Lock()
+		for key, u := range pending {
+			if total, ok := m.pending[key]; ok {
+				total.add(u)
+			} else {
+				m.pending[key] = u
+			}
+		}
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// flushUsage flushes every USAGE_FLUSH_INTERVAL until ctx is cancelled;
+// shutdown makes the final flush once requests have drained.
+func flushUsage(ctx context.Context) {
+	if cfg.usageFlushInterval <= 0 || dbReadOnly.Load() {
+		return
+	}
+	ticker := time.NewTicker(cfg.usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := usage.flush(ctx); err != nil {
+			log.Printf("Flushing usage failed: %v", err)
+		}
+	}
+}
+
+// countingReader counts the request body bytes the handler reads.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// meteredRows counts the rows an export reads from its cursor.
+type meteredRows struct {
+	pgx.Rows
+	usage *usageCounters
+}
+
+func (r meteredRows) Next() bool {
+	if r.Rows.Next() {
+		r.usage.rowsExported++
+		return true
+	}
+	return false
+}
+
+// meterUsage counts each request against the caller's API key: request and
+// response body bytes as they pass, and the rows handlers report through
+// usageFor. The response is counted at the writer, so streamed exports are
+// counted as sent.
+func meterUsage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		counters := &usageCounters{requests: 1}
+		c.Set(usageContextKey, counters)
+		if c.Request.Body != nil {
+			c.Request.Body = countingReader{c.Request.Body, &counters.uploadedBytes}
+		}
+		c.Next()
+		counters.exportedBytes = int64(max(c.Writer.Size(), 0))
+		usage.record(keyOwner(c), time.Now(), counters)
+	}
+}
+
+// usageFor returns the counters of the request; outside meterUsage they go
+// nowhere.
+func usageFor(c *gin.Context) *usageCounters {
+	if v, ok := c.Get(usageContextKey); ok {
+		return v.(*usageCounters)
+	}
+	return &usageCounters{}
+}
+
+type usageRow struct {
+	KeyID         string `json:"key_id"`
+	Requests      int64  `json:"requests"`
+	UploadedBytes int64  `json:"uploaded_bytes"`
+	ExportedBytes int64  `json:"exported_bytes"`
+	RowsInserted  int64  `json:"rows_inserted"`
+	RowsExported  int64  `json:"rows_exported"`
+}
+
+// getUsage returns the usage of every API key in a month (?period=YYYY-MM,
+// the current one by default) as JSON or CSV. This instance's pending
+// counters are flushed first; other instances' arrive with their next
+// flush.
+func getUsage(c *gin.Context) {
+	period := usagePeriod(time.Now())
+	if raw := c.Query("period"); raw != "" {
+		t, err := time.Parse("2006-01", raw)
+		if err != nil {
+			respondFilterError(c, &filterError{param: "period", message: "must be a YYYY-MM month"})
+			return
+		}
+		period = t
+	}
+	format := c.DefaultQuery("format", formatJSON)
+	if format != formatJSON && format != "csv" {
+		respondFilterError(c, &filterError{param: "format", message: "must be one of json, csv"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if !dbReadOnly.Load() {
+		if err := usage.flush(ctx); err != nil {
+			log.Printf("Flushing usage failed: %v", err)
+		}
+	}
+	rows, err := db.Query(ctx,
+		`SELECT key_id, requests, uploaded_bytes, exported_bytes, rows_inserted, rows_exported
+		FROM usage WHERE period = $1 ORDER BY key_id`, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database query failed"})
+		return
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (usageRow, error) {
+		var u usageRow
+		err := row.Scan(&u.KeyID, &u.Requests, &u.UploadedBytes, &u.ExportedBytes, &u.RowsInserted, &u.RowsExported)
+		return u, err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan row"})
+		return
+	}
+	if keys == nil {
+		keys = []usageRow{}
+	}
+
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"key_id", "requests", "uploaded_bytes", "exported_bytes", "rows_inserted", "rows_exported"})
+		for _, u := range keys {
+			w.Write([]string{u.KeyID,
+				strconv.FormatInt(u.Requests, 10), strconv.FormatInt(u.UploadedBytes, 10),
+				strconv.FormatInt(u.ExportedBytes, 10), strconv.FormatInt(u.RowsInserted, 10),
+				strconv.FormatInt(u.RowsExported, 10)})
+		}
+		w.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"period": period.Format("2006-01"), "keys": keys})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons a CSV row is skipped during upload, reported in the summary.
+const (
+	rejectTooFewColumns    = "too_few_columns"
+	rejectEmptyName        = "empty_name"
+	rejectEmptyCategory    = "empty_category"
+	rejectFieldTooLong     = "field_too_long"
+	rejectInvalidPrice     = "invalid_price"
+	rejectNonPositivePrice = "non_positive_price"
+	rejectBelowMinPrice    = "below_min_price"
+	rejectInvalidDate      = "invalid_date"
+	rejectInconsistentDate = "inconsistent_date_format"
+	rejectInvalidValidity  = "invalid_validity"
+	rejectInvalidID        = "invalid_id"
+)
+
+// validationRules are the per-upload knobs of validateRecord.
+type validationRules struct {
+	// dateLayouts are the accepted create_date layouts, tried in order.
+	dateLayouts []string
+	columns     columnMap
+	// transforms run on name, category and price before they are checked;
+	// a transformed price is rounded to cents with rounding.
+	transforms transforms
+	rounding   roundingMode
+	// ids reads the id column; an empty cell leaves the id to the database.
+	ids bool
+}
+
+// defaultValidationRules check a single row laid out positionally, with
+// valid_from and valid_to after create_date.
+var defaultValidationRules = validationRules{dateLayouts: []string{isoDateLayout},
+	columns: columnMap{id: 0, name: 1, category: 2, price: 3, createDate: 4, validFrom: 5, validTo: 6, externalID: -1}}
+
+// validateRecord applies the upload validation rules to a single CSV row and
+// returns the reason it was rejected, or "" when the row is valid.
+func validateRecord(record []string, rules validationRules) (priceRecord, string) {
+	cols := rules.columns
+	if len(record) < cols.width() {
+		return priceRecord{}, rejectTooFewColumns
+	}
+
+	name := strings.TrimSpace(record[cols.name])
+	category := strings.TrimSpace(record[cols.category])
+	price, err := strconv.ParseFloat(strings.TrimSpace(record[cols.price]), 64)
+	priceOK := err == nil
+	if priceOK && len(rules.transforms) > 0 {
+		row := transformRow{name: name, category: category, price: price}
+		rules.transforms.apply(&row)
+		name, category, price = row.name, row.category, row.price
+		// A division by zero leaves no price to store.
+		if priceOK = !math.IsNaN(price) && !math.IsInf(price, 0); priceOK {
+			price = roundMoney(price, rules.rounding)
+		}
+	}
+
+	if name == "" {
+		return priceRecord{}, rejectEmptyName
+	}
+	if category == "" {
+		return priceRecord{}, rejectEmptyCategory
+	}
+	// MAX_FIELD_SIZE may only lower the limit the columns set.
+	if len(name) > cfg.maxFieldSize || len(category) > cfg.maxFieldSize ||
+		utf8.RuneCountInString(name) > columnWidth("name") || utf8.RuneCountInString(category) > columnWidth("category") {
+		return priceRecord{}, rejectFieldTooLong
+	}
+
+	if !priceOK {
+		return priceRecord{}, rejectInvalidPrice
+	}
+	if price <= 0 {
+		return priceRecord{}, rejectNonPositivePrice
+	}
+	// Sub-cent prices would round to 0.00 in the DECIMAL(10,2) column.
+	if price < cfg.minPrice {
+		return priceRecord{}, rejectBelowMinPrice
+	}
+
+	createDate, layout, ok := parseDate(strings.TrimSpace(record[cols.createDate]), rules.dateLayouts)
+	if !ok {
+		return priceRecord{}, rejectInvalidDate
+	}
+
+	validFrom, ok := optionalDate(record, cols.validFrom, rules.dateLayouts)
+	if !ok {
+		return priceRecord{}, rejectInvalidValidity
+	}
+	validTo, ok := optionalDate(record, cols.validTo, rules.dateLayouts)
+	if !ok || (validFrom != nil && validTo != nil && validTo.Before(*validFrom)) {
+		return priceRecord{}, rejectInvalidValidity
+	}
+
+	var id *int64
+	if rules.ids && cols.id >= 0 && cols.id < len(record) && strings.TrimSpace(record[cols.id]) != "" {
+		// prices.id is a SERIAL, a 4-byte integer.
+		n, err := strconv.ParseInt(strings.TrimSpace(record[cols.id]), 10, 32)
+		if err != nil || n <= 0 {
+			return priceRecord{}, rejectInvalidID
+		}
+		id = &n
+	}
+
+	var externalID string
+	if cols.externalID >= 0 && cols.externalID < len(record) {
+		externalID = strings.TrimSpace(record[cols.externalID])
+		if utf8.RuneCountInString(externalID) > columnWidth("external_id") {
+			return priceRecord{}, rejectFieldTooLong
+		}
+	}
+
+	return priceRecord{
+		id:         id,
+		name:       name,
+		category:   category,
+		price:      price,
+		createDate: createDate,
+		dateLayout: layout,
+		validFrom:  validFrom,
+		validTo:    validTo,
+		externalID: externalID,
+	}, ""
+}
+
+// optionalDate parses the date in column i, returning nil when the file has
+// no such column or the cell is empty.
+func optionalDate(record []string, i int, layouts []string) (*time.Time, bool) {
+	if i < 0 || i >= len(record) || strings.TrimSpace(record[i]) == "" {
+		return nil, true
+	}
+	t, _, ok := parseDate(strings.TrimSpace(record[i]), layouts)
+	if !ok {
+		return nil, false
+	}
+	return &t, true
+}
+
+// validatePriceRecord checks a single JSON record against the upload rules
+// so a form can give feedback without building an archive.
+func validatePriceRecord(c *gin.Context) {
+	var body struct {
+		Name       string      `json:"name"`
+		Category   string      `json:"category"`
+		Price      interface{} `json:"price"`
+		CreateDate string      `json:"create_date"`
+		ValidFrom  string      `json:"valid_from"`
+		ValidTo    string      `json:"valid_to"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+
+	var price string
+	switch v := body.Price.(type) {
+	case float64:
+		price = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		price = v
+	}
+
+	record := []string{"", body.Name, body.Category, price, body.CreateDate, body.ValidFrom, body.ValidTo}
+	rec, reason := validateRecord(record, defaultValidationRules)
+	if reason != "" {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "reason": reason})
+		return
+	}
+
+	priceRules, err := loadPriceRules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errPriceRulesUnavailable.Error()})
+		return
+	}
+	fired, advisories := priceRules.check(rec.category, rec.price)
+	if fired != nil {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "reason": rejectPriceOutOfBounds, "rule": fired})
+		return
+	}
+	warnings := []*priceRule{}
+	warnings = append(warnings, advisories...)
+	c.JSON(http.StatusOK, gin.H{"valid": true, "warnings": warnings})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultWhatIfLimit = 100
+	maxWhatIfLimit     = 1000
+)
+
+// whatIfCategory is a category the staged rows touch, as it is and as it
+// would be once they are inserted.
+type whatIfCategory struct {
+	Category       string  `json:"category"`
+	CurrentRows    int64   `json:"current_rows"`
+	CurrentTotal   float64 `json:"current_total"`
+	ProjectedRows  int64   `json:"projected_rows"`
+	ProjectedTotal float64 `json:"projected_total"`
+}
+
+// whatIfChange is a product whose latest price the upload would change.
+// OldPrice is nil for a product the table does not have yet.
+type whatIfChange struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	OldPrice *float64 `json:"old_price"`
+	NewPrice float64  `json:"new_price"`
+	// after is the ord of the staged row, the cursor of the next page.
+	after int
+}
+
+// whatIfUpload shows what approving a quarantined upload would do: the
+// totals of the categories it touches before and after, and the products
+// whose latest price would change, paged by ?after=. Both are computed by
+// joining the staged rows with prices in one read-only snapshot; nothing
+// is written.
+func whatIfUpload(c *gin.Context) {
+	batchID := c.Param("batch_id")
+	if !isUUID(batchID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	limit := defaultWhatIfLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxWhatIfLimit {
+			respondFilterError(c, &filterError{param: "limit", message: fmt.Sprintf("must be an integer between 1 and %d", maxWhatIfLimit)})
+			return
+		}
+		limit = n
+	}
+	after, err := strconv.Atoi(c.DefaultQuery("after", "0"))
+	if err != nil || after < 0 {
+		respondFilterError(c, &filterError{param: "after", message: "must be a non-negative integer"})
+		return
+	}
+	rounding, err := parseRoundingMode(c.Query("rounding"))
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	var categories []whatIfCategory
+	var changes []whatIfChange
+	var duplicates int64
+	err = withRetry(ctx, "what-if", func() error {
+		return pgx.BeginTxFunc(ctx, db, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+			var status string
+			var options quarantineOptions
+			err := tx.QueryRow(ctx, "SELECT status, options FROM quarantined_uploads WHERE batch_id = $1", batchID).Scan(&status, &options)
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				return errUploadNotFound
+			case err != nil:
+				return &storeError{"database error", err}
+			case status == quarantineApproved:
+				return errAlreadyApproved
+			case status == quarantineRejected:
+				return errAlreadyRejected
+			}
+			if categories, duplicates, err = whatIfCategories(ctx, tx, batchID, options); err != nil {
+				return err
+			}
+			changes, err = whatIfChanges(ctx, tx, batchID, after, limit)
+			return err
+		})
+	})
+	if !respondQuarantineError(c, err) {
+		return
+	}
+
+	for i := range categories {
+		categories[i].CurrentTotal = roundMoney(categories[i].CurrentTotal, rounding)
+		categories[i].ProjectedTotal = roundMoney(categories[i].ProjectedTotal, rounding)
+	}
+	for i := range changes {
+		if changes[i].OldPrice != nil {
+			old := roundMoney(*changes[i].OldPrice, rounding)
+			changes[i].OldPrice = &old
+		}
+		changes[i].NewPrice = roundMoney(changes[i].NewPrice, rounding)
+	}
+	var next *int
+	if len(changes) == limit {
+		next = &changes[len(changes)-1].after
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"batch_id":         batchID,
+		"categories":       categories,
+		"duplicates_count": duplicates,
+		"price_changes":    changes,
+		"next_after":       next,
+	})
+}
+
+// whatIfCategories totals the categories of the staged rows in prices and
+// with the staged rows added. A staged row approval would skip as a
+// duplicate of a stored one, by the upload's dedup options, is left out
+// and counted in the second result.
+func whatIfCategories(ctx context.Context, tx pgx.Tx, batchID string, options quarantineOptions) ([]whatIfCategory, int64, error) {
+	f := &priceFilter{}
+	batch := f.arg(batchID)
+	duplicate := "false"
+	if options.DedupScope != dedupUpload {
+		identity := "p.name = s.name AND p.category = s.category"
+		if options.Dedupe == dedupeCI {
+			identity = "lower(p.name) = lower(s.name) AND lower(p.category) = lower(s.category)"
+		}
+		priceMatch := "p.price = s.price"
+		if cfg.priceCents {
+			priceMatch = "p.price_cents = round(s.price * 100)"
+		}
+		tolerance := f.arg(options.DateToleranceDays)
+		duplicate = "s.external_id IS NULL AND EXISTS (SELECT 1 FROM prices p WHERE " + identity + " AND " + priceMatch +
+			" AND p.create_date BETWEEN s.create_date - make_interval(days => " + tolerance + ")" +
+			" AND s.create_date + make_interval(days => " + tolerance + "))"
+	}
+	query := `WITH staged AS (
+			SELECT s.category, s.price::float8 AS price, ` + duplicate + ` AS duplicate
+			FROM quarantined_prices s WHERE s.batch_id = ` + batch + `
+		)
+		SELECT s.category, COALESCE(l.n, 0), COALESCE(l.total, 0),
+			COUNT(*) FILTER (WHERE NOT s.duplicate), COALESCE(SUM(s.price) FILTER (WHERE NOT s.duplicate), 0),
+			COUNT(*) FILTER (WHERE s.duplicate)
+		FROM staged s
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS n, SUM(` + priceColumn() + `)::float8 AS total FROM prices WHERE category = s.category
+		) l ON true
+		GROUP BY s.category, l.n, l.total
+		ORDER BY s.category`
+	logQuery("whatIfUpload", query, f.args)
+	rows, err := tx.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, 0, &storeError{"database query failed", err}
+	}
+	defer rows.Close()
+
+	categories := []whatIfCategory{}
+	var duplicates int64
+	for rows.Next() {
+		var w whatIfCategory
+		var added float64
+		var skipped int64
+		if err := rows.Scan(&w.Category, &w.CurrentRows, &w.CurrentTotal, &w.ProjectedRows, &added, &skipped); err != nil {
+			return nil, 0, &storeError{"failed to scan row", err}
+		}
+		w.ProjectedRows += w.CurrentRows
+		w.ProjectedTotal = w.CurrentTotal + added
+		duplicates += skipped
+		categories = append(categories, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, &storeError{"error reading rows", err}
+	}
+	return categories, duplicates, nil
+}
+
+// whatIfChanges lists the products, by name and category ignoring case as
+// the quarantine check matches them, whose latest staged row would become
+// their latest row with another price. The latest row is the one with the
+// latest create_date; on a tie the staged row wins, as it would be
+// inserted last.
+func whatIfChanges(ctx context.Context, tx pgx.Tx, batchID string, after, limit int) ([]whatIfChange, error) {
+	rows, err := tx.Query(ctx, `WITH staged AS (
+			SELECT DISTINCT ON (lower(name), lower(category)) ord, name, category, price::float8 AS price, create_date
+			FROM quarantined_prices WHERE batch_id = $1
+			ORDER BY lower(name), lower(category), create_date DESC, ord DESC
+		)
+		SELECT s.ord, s.name, s.category, p.price, s.price
+		FROM staged s
+		LEFT JOIN LATERAL (
+			SELECT `+priceColumn()+`::float8 AS price, create_date FROM prices
+			WHERE lower(name) = lower(s.name) AND lower(category) = lower(s.category)
+			ORDER BY create_date DESC, id DESC LIMIT 1
+		) p ON true
+		WHERE s.ord > $2 AND (p.price IS NULL OR (s.create_date >= p.create_date AND s.price <> p.price))
+		ORDER BY s.ord LIMIT $3`, batchID, after, limit)
+	if err != nil {
+		return nil, &storeError{"database query failed", err}
+	}
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (whatIfChange, error) {
+		var w whatIfChange
+		err := row.Scan(&w.after, &w.Name, &w.Category, &w.OldPrice, &w.NewPrice)
+		return w, err
+	})
+	if err != nil {
+		return nil, &storeError{"failed to scan row", err}
+	}
+	if changes == nil {
+		changes = []whatIfChange{}
+	}
+	return changes, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	cryptozip "github.com/alexmullins/zip"
+)
+
+var (
+	errArchivePasswordRequired = errors.New("archive is encrypted, a password is required")
+	errBadArchivePassword      = errors.New("wrong archive password")
+)
+
+// zipMethodAES is the compression method WinZip AES entries are stored
+// with; the real method is kept in the AES extra field.
+const zipMethodAES = 99
+
+// zipDecrypter opens the encrypted entries of one zip archive. Plain
+// entries never go through it, so archives without encryption are read by
+// archive/zip alone.
+type zipDecrypter struct {
+	archive  *spooledUpload
+	password string
+	aes      *cryptozip.Reader
+}
+
+// open decrypts entry i of the archive. The standard library cannot
+// decrypt AES, so those entries are read through a second reader over the
+// same file; its File slice follows the same central directory order.
+func (d *zipDecrypter) open(i int, file *zip.File) (io.ReadCloser, error) {
+	if d.password == "" {
+		return nil, errArchivePasswordRequired
+	}
+
+	if file.Method != zipMethodAES {
+		return openZipCrypto(file, d.password)
+	}
+
+	if d.aes == nil {
+		aes, err := cryptozip.NewReader(d.archive, d.archive.size)
+		if err != nil {
+			return nil, err
+		}
+		d.aes = aes
+	}
+	aesFile := d.aes.File[i]
+	aesFile.SetPassword(d.password)
+	rc, err := aesFile.Open()
+	if err != nil {
+		return nil, passwordError(err)
+	}
+	return rc, nil
+}
+
+func passwordError(err error) error {
+	if errors.Is(err, cryptozip.ErrPassword) || errors.Is(err, cryptozip.ErrAuthentication) || errors.Is(err, cryptozip.ErrDecryption) {
+		return errBadArchivePassword
+	}
+	return err
+}
+
+// openZipCrypto reads an entry encrypted with the traditional PKWARE
+// scheme (ZipCrypto).
+func openZipCrypto(file *zip.File, password string) (io.ReadCloser, error) {
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	r := newZipCryptoReader(raw, password)
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	// The last header byte is a password check against the CRC, or the
+	// modification time when sizes follow in a data descriptor.
+	check := byte(file.CRC32 >> 24)
+	if file.Flags&0x8 != 0 {
+		check = byte(file.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, errBadArchivePassword
+	}
+
+	var body io.ReadCloser
+	switch file.Method {
+	case zip.Store:
+		body = io.NopCloser(r)
+	case zip.Deflate:
+		body = flate.NewReader(r)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	return &zipCryptoChecksum{ReadCloser: body, hash: crc32.NewIEEE(), want: file.CRC32}, nil
+}
+
+type zipCryptoReader struct {
+	r          io.Reader
+	k0, k1, k2 uint32
+}
+
+func newZipCryptoReader(r io.Reader, password string) *zipCryptoReader {
+	z := &zipCryptoReader{r: r, k0: 0x12345678, k1: 0x23456789, k2: 0x34567890}
+	for i := 0; i < len(password); i++ {
+		z.update(password[i])
+	}
+	return z
+}
+
+func (z *zipCryptoReader) update(b byte) {
+	z.k0 = crc32.IEEETable[byte(z.k0)^b] ^ (z.k0 >> 8)
+	z.k1 = (z.k1+(z.k0&0xff))*134775813 + 1
+	z.k2 = crc32.IEEETable[byte(z.k2)^byte(z.k1>>24)] ^ (z.k2 >> 8)
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		t := z.k2 | 2
+		p[i] ^= byte((t * (t ^ 1)) >> 8)
+		z.update(p[i])
+	}
+	return n, err
+}
+
+// zipCryptoChecksum verifies the CRC at the end of the entry. The header
+// check byte lets one wrong password in 256 through, so a mismatch here or
+// corrupt compressed data is reported as a wrong password as well.
+type zipCryptoChecksum struct {
+	io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (c *zipCryptoChecksum) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.hash.Write(p[:n])
+	var corrupt flate.CorruptInputError
+	switch {
+	case errors.As(err, &corrupt):
+		return n, errBadArchivePassword
+	case err == io.EOF && c.hash.Sum32() != c.want:
+		return n, errBadArchivePassword
+	}
+	return n, err
+}